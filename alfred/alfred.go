@@ -8,8 +8,11 @@ import (
 	"bytes"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"time"
 )
 
 const (
@@ -29,6 +32,22 @@ const (
 	ALFRED_STATUS_ERROR     = 4
 	ALFRED_MODESWITCH       = 5
 	ALFRED_CHANGE_INTERFACE = 6
+	ALFRED_CHANGE_BAT_IFACE = 7
+	ALFRED_SERVER_STATUS    = 8
+	ALFRED_EVENT_REGISTER   = 9
+	ALFRED_EVENT_NOTIFY     = 10
+	// extensions of this implementation, ignored by others:
+	ALFRED_SIGNATURE = 128
+)
+
+// element types in server status replies
+const (
+	ALFRED_SERVER_OP_MODE   = 0
+	ALFRED_SERVER_NET_IFACE = 1
+	ALFRED_SERVER_BAT_IFACE = 2
+	// extensions of this implementation, skipped by others:
+	ALFRED_SERVER_RETENTION = 128
+	ALFRED_SERVER_WARM      = 129
 )
 
 // operation modes
@@ -41,6 +60,48 @@ var ErrTooLarge = errors.New("data chunk is too large to fit into packet")
 var ErrUnknownType = errors.New("unknown data type")
 var ErrParseMAC = errors.New("error parsing MAC address")
 var ErrRead = errors.New("cannot read data")
+var ErrTruncated = errors.New("packet is truncated")
+var ErrTrailingData = errors.New("trailing data after packet")
+var ErrInvalidLength = errors.New("invalid length")
+
+// Returned when a packet is malformed. It matches ErrRead.
+type DecodeError struct {
+	// position of the problem, counted from the start of the packet
+	Offset int
+	// type of the packet, -1 if its header was incomplete
+	Type int
+	// the problem, one of ErrTruncated, ErrTrailingData,
+	// ErrInvalidLength, ErrTooLarge and ErrUnknownType
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Type < 0 {
+		return fmt.Sprintf("cannot decode packet at offset %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("cannot decode %s packet at offset %d: %v", PacketTypeName(uint8(e.Type)), e.Offset, e.Err)
+}
+
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrRead
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// wrap errors that denote a malformed packet, pass others (e.g. I/O
+// errors) through
+func decodeError(packettype int, offset int, err error) error {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		err = ErrTruncated
+	case ErrTruncated, ErrTrailingData, ErrInvalidLength, ErrTooLarge, ErrUnknownType, ErrRead:
+	default:
+		return err
+	}
+	return &DecodeError{Offset: offset, Type: packettype, Err: err}
+}
 
 // interface for data that is being transported via A.L.F.R.E.D.
 type Content interface {
@@ -88,13 +149,10 @@ type TLV struct {
 func ReadTLV(r io.Reader) (*TLV, error, int) {
 	tlv := TLV{}
 	data := make([]byte, 4)
-	n, err := r.Read(data)
+	n, err := io.ReadFull(r, data)
 	if err != nil {
 		return &tlv, err, n
 	}
-	if n < 4 {
-		return &tlv, ErrRead, n
-	}
 	tlv.Type = data[0]
 	tlv.Version = data[1]
 	tlv.Length = uint16(data[2])<<8 + uint16(data[3])
@@ -126,6 +184,11 @@ type Data struct {
 // Returns the packet, an error if anything went wrong, and the number
 // of bytes read from the io.Reader
 func ReadData(r io.Reader) (*Data, error, int) {
+	return readData(r, 0xFFFF+10)
+}
+
+// read a Data packet that may not be larger than limit bytes
+func readData(r io.Reader, limit int) (*Data, error, int) {
 	var n, c int
 	var err error
 	data := Data{Source: make([]byte, 6)}
@@ -133,10 +196,13 @@ func ReadData(r io.Reader) (*Data, error, int) {
 		return &data, err, n
 	}
 	if data.Header, err, c = ReadTLV(r); err != nil {
-		return &data, err, n
+		return &data, err, n + c
 	} else {
 		n += c
 	}
+	if int(data.Header.Length) > limit-n {
+		return &data, ErrTooLarge, n
+	}
 	data.Data = make([]byte, data.Header.Length)
 	c, err = io.ReadFull(r, data.Data)
 	return &data, err, n + c
@@ -160,15 +226,18 @@ func (d *Data) Equals(other *Data) bool {
 	return false
 }
 
+// write the data item. The length written is that of the payload, the
+// header is not changed, as it might be shared with the data store.
 func (d *Data) Write(w io.Writer) error {
 	if len(d.Data) > 0xFFFF {
 		return ErrTooLarge
 	}
-	d.Header.Length = (uint16)(len(d.Data))
+	header := *d.Header
+	header.Length = (uint16)(len(d.Data))
 	if _, err := w.Write(d.Source); err != nil {
 		return err
 	}
-	if err := d.Header.Write(w); err != nil {
+	if err := header.Write(w); err != nil {
 		return err
 	}
 	_, err := w.Write(d.Data)
@@ -194,13 +263,10 @@ type TransactionMgmt struct {
 func ReadTransactionMgmt(r io.Reader) (*TransactionMgmt, error, int) {
 	tx := TransactionMgmt{}
 	data := make([]byte, 4)
-	n, err := r.Read(data)
+	n, err := io.ReadFull(r, data)
 	if err != nil {
 		return &tx, err, n
 	}
-	if n < 4 {
-		return &tx, ErrRead, n
-	}
 	tx.Id = uint16(data[0])<<8 + uint16(data[1])
 	tx.SeqNo = uint16(data[2])<<8 + uint16(data[3])
 	return &tx, nil, n
@@ -238,7 +304,8 @@ func NewPushDataV0(tx *TransactionMgmt, data []Data) *PushDataV0 {
 	}
 }
 
-// Read a TransactionMgmt packet
+// Read a PushDataV0 packet. The data items must exactly fill the
+// length given in the header.
 // Returns the packet, an error if anything went wrong, and the number
 // of bytes read from the io.Reader
 func ReadPushDataV0(r io.Reader, header *TLV) (*PushDataV0, error, int) {
@@ -248,9 +315,14 @@ func ReadPushDataV0(r io.Reader, header *TLV) (*PushDataV0, error, int) {
 	if pd.Tx, err, read = ReadTransactionMgmt(r); err != nil {
 		return &pd, err, read
 	}
+	if int(header.Length) < read {
+		return &pd, ErrInvalidLength, read
+	}
+	// never read beyond the packet
+	lr := io.LimitReader(r, int64(header.Length)-int64(read))
 	for read < (int)(pd.Header.Length) {
-		if data, err, c := ReadData(r); err != nil {
-			return &pd, err, read
+		if data, err, c := readData(lr, int(header.Length)-read); err != nil {
+			return &pd, err, read + c
 		} else {
 			pd.Data = append(pd.Data, *data)
 			read += c
@@ -346,13 +418,10 @@ func NewRequestV0(requestedtype uint8, txid uint16) *RequestV0 {
 func ReadRequestV0(r io.Reader, header *TLV) (*RequestV0, error, int) {
 	rq := RequestV0{Header: header}
 	data := make([]byte, 3)
-	n, err := r.Read(data)
+	n, err := io.ReadFull(r, data)
 	if err != nil {
 		return &rq, err, n
 	}
-	if n < 3 {
-		return &rq, ErrRead, n
-	}
 	rq.RequestedType = data[0]
 	rq.TxId = uint16(data[1])<<8 + uint16(data[2])
 	return &rq, nil, 3
@@ -397,7 +466,7 @@ func NewModeSwitchV0(mode uint8) *ModeSwitchV0 {
 func ReadModeSwitchV0(r io.Reader, header *TLV) (*ModeSwitchV0, error, int) {
 	m := ModeSwitchV0{Header: header}
 	data := make([]byte, 1)
-	n, err := r.Read(data)
+	n, err := io.ReadFull(r, data)
 	if err != nil {
 		return &m, err, n
 	}
@@ -431,6 +500,7 @@ func NewChangeInterfaceV0(interfaces []byte) *ChangeInterfaceV0 {
 			Version: 0,
 			Length:  ALFRED_IFNAMSIZ * 16,
 		},
+		Ifaces: new([ALFRED_IFNAMSIZ * 16]byte),
 	}
 	copy(c.Ifaces[:], interfaces)
 	return &c
@@ -440,11 +510,28 @@ func NewChangeInterfaceV0(interfaces []byte) *ChangeInterfaceV0 {
 // Returns the packet, an error if anything went wrong, and the number
 // of bytes read from the io.Reader
 func ReadChangeInterfaceV0(r io.Reader, header *TLV) (*ChangeInterfaceV0, error, int) {
-	c := ChangeInterfaceV0{Header: header}
+	c := ChangeInterfaceV0{Header: header, Ifaces: new([ALFRED_IFNAMSIZ * 16]byte)}
 	n, err := io.ReadFull(r, c.Ifaces[:])
 	return &c, err, n
 }
 
+// return the list of interface names contained in the packet.
+// The list is a comma-separated, zero-terminated string.
+func (c *ChangeInterfaceV0) Interfaces() []string {
+	ifaces := make([]string, 0)
+	list := c.Ifaces[:]
+	if end := bytes.IndexByte(list, 0); end != -1 {
+		list = list[:end]
+	}
+	for _, iface := range bytes.Split(list, []byte{','}) {
+		iface = bytes.TrimSpace(iface)
+		if len(iface) > 0 {
+			ifaces = append(ifaces, string(iface))
+		}
+	}
+	return ifaces
+}
+
 func (c *ChangeInterfaceV0) Write(w io.Writer) error {
 	if err := c.Header.Write(w); err != nil {
 		return err
@@ -497,35 +584,514 @@ func (s *StatusV0) Size() int {
 	return s.Header.Size() + s.Tx.Size()
 }
 
+// A client sends this to a server to query its status.
+type ServerStatusReqV0 struct {
+	Header *TLV
+	Tx     *TransactionMgmt
+}
+
+func NewServerStatusReqV0(tx *TransactionMgmt) *ServerStatusReqV0 {
+	return &ServerStatusReqV0{
+		Header: &TLV{
+			Type:    ALFRED_SERVER_STATUS,
+			Version: 0,
+			Length:  (uint16)(tx.Size()),
+		},
+		Tx: tx,
+	}
+}
+
+func (s *ServerStatusReqV0) Write(w io.Writer) error {
+	if err := s.Header.Write(w); err != nil {
+		return err
+	}
+	return s.Tx.Write(w)
+}
+
+func (s *ServerStatusReqV0) Size() int {
+	return s.Header.Size() + s.Tx.Size()
+}
+
+// Information about a network interface a server is bound to
+type ServerStatusNetIface struct {
+	Name   string
+	Active bool
+}
+
+// Retention time for data of a given type. A type of
+// PACKETTYPE_ALL denotes the default for all other types.
+type ServerStatusRetention struct {
+	Type uint8
+	TTL  time.Duration
+}
+
+// The reply of a server to a ServerStatusReqV0.
+// On the wire, the information is contained in a list of TLV
+// elements following the transaction information.
+type ServerStatusRepV0 struct {
+	Header *TLV
+	Tx     *TransactionMgmt
+	// operation mode, ALFRED_MODESWITCH_*
+	Mode uint8
+	// network interfaces the server is bound to
+	NetIfaces []ServerStatusNetIface
+	// batman-adv interface used by the server, empty if none
+	BatIface string
+	// retention times for data, only sent by this implementation
+	Retention []ServerStatusRetention
+	// set if the server has fetched the data of other masters after
+	// starting up, nil if not reported (only sent by this
+	// implementation)
+	Warm *bool
+}
+
+func NewServerStatusRepV0(tx *TransactionMgmt, mode uint8, netifaces []ServerStatusNetIface, batiface string) *ServerStatusRepV0 {
+	return &ServerStatusRepV0{
+		Header: &TLV{
+			Type:    ALFRED_SERVER_STATUS,
+			Version: 0,
+		},
+		Tx:        tx,
+		Mode:      mode,
+		NetIfaces: netifaces,
+		BatIface:  batiface,
+	}
+}
+
+// put an interface name into a fixed size field
+func ifname(name string) []byte {
+	field := make([]byte, ALFRED_IFNAMSIZ)
+	copy(field[:ALFRED_IFNAMSIZ-1], name)
+	return field
+}
+
+// read an interface name from a fixed size field
+func readIfname(field []byte) string {
+	if end := bytes.IndexByte(field, 0); end != -1 {
+		field = field[:end]
+	}
+	return string(field)
+}
+
+// Read a server status packet, which might be either a request or a
+// reply - the former does not contain any status elements.
+// Returns the packet, an error if anything went wrong, and the number
+// of bytes read from the io.Reader
+func ReadServerStatusV0(r io.Reader, header *TLV) (Packet, error, int) {
+	tx, err, read := ReadTransactionMgmt(r)
+	if err != nil {
+		return &ServerStatusReqV0{Header: header, Tx: tx}, err, read
+	}
+	if (int)(header.Length) < tx.Size() {
+		return &ServerStatusReqV0{Header: header, Tx: tx}, ErrInvalidLength, read
+	}
+	if (int)(header.Length) == tx.Size() {
+		return &ServerStatusReqV0{Header: header, Tx: tx}, nil, read
+	}
+	s := ServerStatusRepV0{Header: header, Tx: tx}
+	// never read beyond the packet
+	lr := io.LimitReader(r, int64(header.Length)-int64(read))
+	for read < (int)(header.Length) {
+		element, err, c := ReadTLV(lr)
+		read += c
+		if err != nil {
+			return &s, err, read
+		}
+		if int(element.Length) > int(header.Length)-read {
+			return &s, ErrTooLarge, read
+		}
+		value := make([]byte, element.Length)
+		c, err = io.ReadFull(lr, value)
+		read += c
+		if err != nil {
+			return &s, err, read
+		}
+		switch element.Type {
+		case ALFRED_SERVER_OP_MODE:
+			if len(value) < 1 {
+				return &s, ErrInvalidLength, read
+			}
+			s.Mode = value[0]
+		case ALFRED_SERVER_NET_IFACE:
+			if len(value) < ALFRED_IFNAMSIZ+1 {
+				return &s, ErrInvalidLength, read
+			}
+			s.NetIfaces = append(s.NetIfaces, ServerStatusNetIface{
+				Name:   readIfname(value[:ALFRED_IFNAMSIZ]),
+				Active: value[ALFRED_IFNAMSIZ] != 0,
+			})
+		case ALFRED_SERVER_BAT_IFACE:
+			if len(value) < ALFRED_IFNAMSIZ {
+				return &s, ErrInvalidLength, read
+			}
+			s.BatIface = readIfname(value[:ALFRED_IFNAMSIZ])
+		case ALFRED_SERVER_RETENTION:
+			if len(value) < 5 {
+				return &s, ErrInvalidLength, read
+			}
+			seconds := uint32(value[1])<<24 + uint32(value[2])<<16 + uint32(value[3])<<8 + uint32(value[4])
+			s.Retention = append(s.Retention, ServerStatusRetention{
+				Type: value[0],
+				TTL:  time.Duration(seconds) * time.Second,
+			})
+		case ALFRED_SERVER_WARM:
+			if len(value) < 1 {
+				return &s, ErrInvalidLength, read
+			}
+			warm := value[0] != 0
+			s.Warm = &warm
+		default:
+			// skip unknown elements
+		}
+	}
+	return &s, nil, read
+}
+
+// serialize the status elements
+func (s *ServerStatusRepV0) elements() []byte {
+	buf := new(bytes.Buffer)
+	(&TLV{Type: ALFRED_SERVER_OP_MODE, Length: 1}).Write(buf)
+	buf.WriteByte(s.Mode)
+	for _, iface := range s.NetIfaces {
+		(&TLV{Type: ALFRED_SERVER_NET_IFACE, Length: ALFRED_IFNAMSIZ + 1}).Write(buf)
+		buf.Write(ifname(iface.Name))
+		if iface.Active {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	}
+	if s.BatIface != "" {
+		(&TLV{Type: ALFRED_SERVER_BAT_IFACE, Length: ALFRED_IFNAMSIZ}).Write(buf)
+		buf.Write(ifname(s.BatIface))
+	}
+	for _, r := range s.Retention {
+		seconds := uint32(r.TTL / time.Second)
+		(&TLV{Type: ALFRED_SERVER_RETENTION, Length: 5}).Write(buf)
+		buf.Write([]byte{r.Type,
+			byte(seconds >> 24), byte(seconds >> 16), byte(seconds >> 8), byte(seconds)})
+	}
+	if s.Warm != nil {
+		(&TLV{Type: ALFRED_SERVER_WARM, Length: 1}).Write(buf)
+		if *s.Warm {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (s *ServerStatusRepV0) Write(w io.Writer) error {
+	elements := s.elements()
+	length := s.Tx.Size() + len(elements)
+	if length > 0xFFFF {
+		return ErrTooLarge
+	}
+	s.Header.Length = (uint16)(length)
+	if err := s.Header.Write(w); err != nil {
+		return err
+	}
+	if err := s.Tx.Write(w); err != nil {
+		return err
+	}
+	_, err := w.Write(elements)
+	return err
+}
+
+func (s *ServerStatusRepV0) Size() int {
+	return s.Header.Size() + s.Tx.Size() + len(s.elements())
+}
+
+// Header-only packet sent by a client to register for notifications
+// about changed data. The server will keep the connection open and
+// send an EventNotifyV0 for each change.
+type EventRegisterV0 struct {
+	Header *TLV
+}
+
+func NewEventRegisterV0() *EventRegisterV0 {
+	return &EventRegisterV0{
+		Header: &TLV{
+			Type:    ALFRED_EVENT_REGISTER,
+			Version: 0,
+			Length:  0,
+		},
+	}
+}
+
+func (e *EventRegisterV0) Write(w io.Writer) error {
+	return e.Header.Write(w)
+}
+
+func (e *EventRegisterV0) Size() int {
+	return e.Header.Size()
+}
+
+// Sent by a server to registered clients when data of a given type
+// from a given source has changed.
+type EventNotifyV0 struct {
+	Header *TLV
+	Type   uint8
+	Source HardwareAddr
+}
+
+func NewEventNotifyV0(datatype uint8, source HardwareAddr) *EventNotifyV0 {
+	return &EventNotifyV0{
+		Header: &TLV{
+			Type:    ALFRED_EVENT_NOTIFY,
+			Version: 0,
+			Length:  7,
+		},
+		Type:   datatype,
+		Source: source,
+	}
+}
+
+// Read an EventNotifyV0 packet
+// Returns the packet, an error if anything went wrong, and the number
+// of bytes read from the io.Reader
+func ReadEventNotifyV0(r io.Reader, header *TLV) (*EventNotifyV0, error, int) {
+	e := EventNotifyV0{Header: header}
+	data := make([]byte, 7)
+	n, err := io.ReadFull(r, data)
+	if err != nil {
+		return &e, err, n
+	}
+	e.Type = data[0]
+	e.Source = HardwareAddr(data[1:])
+	return &e, nil, n
+}
+
+func (e *EventNotifyV0) Write(w io.Writer) error {
+	if err := e.Header.Write(w); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{e.Type}); err != nil {
+		return err
+	}
+	source := make([]byte, 6)
+	copy(source, e.Source)
+	_, err := w.Write(source)
+	return err
+}
+
+func (e *EventNotifyV0) Size() int {
+	return e.Header.Size() + 1 + 6
+}
+
+// Sent by a server after the data packets of a transaction and
+// before its final status packet, when synchronization with other
+// servers is secured by a shared secret.
+// The MAC is a HMAC-SHA256 over the transaction's data packets and
+// the signing time, see TransactionSigner. Tx.SeqNo is the number of
+// data packets, like in the final status packet.
+type SignatureV0 struct {
+	Header *TLV
+	Tx     *TransactionMgmt
+	// signing time, in nanoseconds since the Unix epoch
+	Time uint64
+	MAC  []byte
+}
+
+func NewSignatureV0(tx *TransactionMgmt, signed uint64, mac []byte) *SignatureV0 {
+	return &SignatureV0{
+		Header: &TLV{
+			Type:    ALFRED_SIGNATURE,
+			Version: 0,
+			Length:  (uint16)(tx.Size() + 8 + len(mac)),
+		},
+		Tx:   tx,
+		Time: signed,
+		MAC:  mac,
+	}
+}
+
+// Read a SignatureV0 packet
+// Returns the packet, an error if anything went wrong, and the number
+// of bytes read from the io.Reader
+func ReadSignatureV0(r io.Reader, header *TLV) (*SignatureV0, error, int) {
+	var err error
+	var n int
+	s := SignatureV0{Header: header}
+	s.Tx, err, n = ReadTransactionMgmt(r)
+	if err != nil {
+		return &s, err, n
+	}
+	if int(header.Length) < s.Tx.Size()+8 {
+		return &s, ErrInvalidLength, n
+	}
+	data := make([]byte, int(header.Length)-s.Tx.Size())
+	m, err := io.ReadFull(r, data)
+	if err != nil {
+		return &s, err, n + m
+	}
+	for _, b := range data[:8] {
+		s.Time = s.Time<<8 + uint64(b)
+	}
+	s.MAC = data[8:]
+	return &s, nil, n + m
+}
+
+func (s *SignatureV0) Write(w io.Writer) error {
+	if err := s.Header.Write(w); err != nil {
+		return err
+	}
+	if err := s.Tx.Write(w); err != nil {
+		return err
+	}
+	signed := make([]byte, 8)
+	for i := range signed {
+		signed[i] = byte(s.Time >> uint(56-8*i))
+	}
+	if _, err := w.Write(signed); err != nil {
+		return err
+	}
+	_, err := w.Write(s.MAC)
+	return err
+}
+
+func (s *SignatureV0) Size() int {
+	return s.Header.Size() + s.Tx.Size() + 8 + len(s.MAC)
+}
+
 // Read a packet and all its contained data from an io.Reader.
+// Exactly the number of bytes given in the packet header are read, so
+// a stream stays usable after a malformed packet. Malformed packets
+// result in a *DecodeError, the end of the stream before a packet
+// starts in io.EOF.
 // Returns the packet, an error if anything went wrong, and the number
 // of bytes read from the io.Reader
 func Read(r io.Reader) (Packet, error, int) {
 	tlv, err, read := ReadTLV(r)
 	if err != nil {
-		return tlv, err, read
+		if err == io.EOF {
+			return tlv, err, read
+		}
+		return tlv, decodeError(-1, read, err), read
+	}
+	body := make([]byte, tlv.Length)
+	n, err := io.ReadFull(r, body)
+	read += n
+	if err != nil {
+		return tlv, decodeError(int(tlv.Type), read, err), read
+	}
+	br := bytes.NewReader(body)
+	p, err := decodeBody(tlv, br)
+	if err == nil && br.Len() > 0 {
+		err = ErrTrailingData
+	}
+	if err == ErrUnknownType {
+		// refers to the header
+		return p, decodeError(int(tlv.Type), 0, err), read
+	}
+	if err != nil {
+		return p, decodeError(int(tlv.Type), tlv.Size()+len(body)-br.Len(), err), read
+	}
+	return p, nil, read
+}
+
+// Decode a single packet from a datagram. Unlike with Read, data
+// following the packet is considered an error.
+func Decode(b []byte) (Packet, error) {
+	r := bytes.NewReader(b)
+	p, err, n := Read(r)
+	if err == io.EOF {
+		return p, decodeError(-1, 0, ErrTruncated)
 	}
+	if err == nil && r.Len() > 0 {
+		return p, decodeError(int(PacketHeader(p).Type), n, ErrTrailingData)
+	}
+	return p, err
+}
+
+// decode the part of a packet following its header
+func decodeBody(tlv *TLV, r io.Reader) (Packet, error) {
+	var p Packet
+	var err error
 	switch {
 	case tlv.Type == ALFRED_PUSH_DATA && tlv.Version == 0:
-		p, err, c := ReadPushDataV0(r, tlv)
-		return p, err, read + c
+		p, err, _ = ReadPushDataV0(r, tlv)
 	case tlv.Type == ALFRED_ANNOUNCE_MASTER && tlv.Version == 0:
-		return &AnnounceMasterV0{Header: tlv}, nil, read
+		p = &AnnounceMasterV0{Header: tlv}
 	case tlv.Type == ALFRED_REQUEST && tlv.Version == 0:
-		p, err, c := ReadRequestV0(r, tlv)
-		return p, err, read + c
+		p, err, _ = ReadRequestV0(r, tlv)
 	case (tlv.Type == ALFRED_STATUS_TXEND || tlv.Type == ALFRED_STATUS_ERROR) && tlv.Version == 0:
-		p, err, c := ReadStatusV0(r, tlv)
-		return p, err, read + c
+		p, err, _ = ReadStatusV0(r, tlv)
 	case tlv.Type == ALFRED_MODESWITCH && tlv.Version == 0:
-		p, err, c := ReadModeSwitchV0(r, tlv)
-		return p, err, read + c
+		p, err, _ = ReadModeSwitchV0(r, tlv)
 	case tlv.Type == ALFRED_CHANGE_INTERFACE && tlv.Version == 0:
-		p, err, c := ReadChangeInterfaceV0(r, tlv)
-		return p, err, read + c
+		p, err, _ = ReadChangeInterfaceV0(r, tlv)
+	case tlv.Type == ALFRED_SERVER_STATUS && tlv.Version == 0:
+		p, err, _ = ReadServerStatusV0(r, tlv)
+	case tlv.Type == ALFRED_EVENT_REGISTER && tlv.Version == 0:
+		p = &EventRegisterV0{Header: tlv}
+	case tlv.Type == ALFRED_EVENT_NOTIFY && tlv.Version == 0:
+		p, err, _ = ReadEventNotifyV0(r, tlv)
+	case tlv.Type == ALFRED_SIGNATURE && tlv.Version == 0:
+		p, err, _ = ReadSignatureV0(r, tlv)
 	default:
-		return tlv, ErrUnknownType, read
+		// the body has been read anyway, so it is not
+		// reported as trailing data
+		return tlv, ErrUnknownType
+	}
+	return p, err
+}
+
+// names for the packet types, e.g. for labels and debug output
+var packetTypeNames = map[uint8]string{
+	ALFRED_PUSH_DATA:        "push_data",
+	ALFRED_ANNOUNCE_MASTER:  "announce_master",
+	ALFRED_REQUEST:          "request",
+	ALFRED_STATUS_TXEND:     "status_txend",
+	ALFRED_STATUS_ERROR:     "status_error",
+	ALFRED_MODESWITCH:       "modeswitch",
+	ALFRED_CHANGE_INTERFACE: "change_interface",
+	ALFRED_CHANGE_BAT_IFACE: "change_bat_iface",
+	ALFRED_SERVER_STATUS:    "server_status",
+	ALFRED_EVENT_REGISTER:   "event_register",
+	ALFRED_EVENT_NOTIFY:     "event_notify",
+	ALFRED_SIGNATURE:        "signature",
+}
+
+// return the TLV header of a packet, nil if it is not one of the
+// packet types known here
+func PacketHeader(p Packet) *TLV {
+	switch p := p.(type) {
+	case *TLV:
+		return p
+	case *PushDataV0:
+		return p.Header
+	case *AnnounceMasterV0:
+		return p.Header
+	case *RequestV0:
+		return p.Header
+	case *StatusV0:
+		return p.Header
+	case *ModeSwitchV0:
+		return p.Header
+	case *ChangeInterfaceV0:
+		return p.Header
+	case *ServerStatusReqV0:
+		return p.Header
+	case *ServerStatusRepV0:
+		return p.Header
+	case *EventRegisterV0:
+		return p.Header
+	case *EventNotifyV0:
+		return p.Header
+	case *SignatureV0:
+		return p.Header
+	}
+	return nil
+}
+
+// return the name of a packet type, or its number if it is unknown
+func PacketTypeName(t uint8) string {
+	if name, known := packetTypeNames[t]; known {
+		return name
 	}
+	return strconv.Itoa(int(t))
 }
 
 // Wrapper for the MAC addresses found as main identifier.
@@ -0,0 +1,157 @@
+package alfred
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// valid packets of every type, for seeding the fuzzers
+func seedPackets() []Packet {
+	warm := true
+	status := NewServerStatusRepV0(&TransactionMgmt{Id: 7, SeqNo: 0}, ALFRED_MODESWITCH_MASTER,
+		[]ServerStatusNetIface{{Name: "bat0", Active: true}, {Name: "eth1", Active: false}}, "bat0")
+	status.Retention = []ServerStatusRetention{{Type: PACKETTYPE_ALL, TTL: 10 * time.Minute}, {Type: 158, TTL: time.Hour}}
+	status.Warm = &warm
+	return []Packet{
+		NewPushDataV0(&TransactionMgmt{Id: 1, SeqNo: 0}, []Data{testData(1, 100, "payload"), testData(2, 158, "")}),
+		NewAnnounceMasterV0(),
+		NewRequestV0(158, 2),
+		NewStatusV0(ALFRED_STATUS_TXEND, &TransactionMgmt{Id: 3, SeqNo: 2}),
+		NewStatusV0(ALFRED_STATUS_ERROR, &TransactionMgmt{Id: 4, SeqNo: 1}),
+		NewModeSwitchV0(ALFRED_MODESWITCH_MASTER),
+		NewChangeInterfaceV0([]byte("bat0,eth1")),
+		NewServerStatusReqV0(&TransactionMgmt{Id: 6, SeqNo: 0}),
+		status,
+		NewEventRegisterV0(),
+		NewEventNotifyV0(158, HardwareAddr{0x02, 0, 0, 0, 0, 1}),
+		NewSignatureV0(&TransactionMgmt{Id: 8, SeqNo: 3}, uint64(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()), bytes.Repeat([]byte{0xab}, 32)),
+	}
+}
+
+// write a packet, which must not fail for decoded packets
+func encode(t *testing.T, p Packet) []byte {
+	buf := new(bytes.Buffer)
+	if err := p.Write(buf); err != nil {
+		t.Fatalf("cannot encode packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Decode a datagram and check that whatever is accepted can be
+// written back again.
+func checkDecode(t *testing.T, data []byte) {
+	p, err := Decode(data)
+	// reading the packet from a stream must come to the same result
+	sp, serr, sn := Read(iotest.OneByteReader(bytes.NewReader(data)))
+	if err != nil {
+		if _, ok := err.(*DecodeError); !ok {
+			t.Fatalf("no DecodeError: %#v", err)
+		}
+		if serr == nil && sn == len(data) {
+			t.Fatalf("stream reading succeeded, but decoding failed: %v", err)
+		}
+		return
+	}
+	if serr != nil {
+		t.Fatalf("decoding succeeded, but stream reading failed: %v", serr)
+	}
+	b := encode(t, p)
+	if !bytes.Equal(b, encode(t, sp)) {
+		t.Fatal("stream reading and decoding result in different packets")
+	}
+	if p.Size() != len(b) {
+		t.Fatalf("packet size %d does not match %d bytes written", p.Size(), len(b))
+	}
+	if _, ok := p.(*ServerStatusRepV0); !ok && !bytes.Equal(b, data) {
+		// status elements are normalized on the way
+		t.Fatalf("packet changed when encoding it again:\n%x\n%x", data, b)
+	}
+	p, err = Decode(b)
+	if err != nil {
+		t.Fatalf("cannot decode encoded packet: %v", err)
+	}
+	if !bytes.Equal(b, encode(t, p)) {
+		t.Fatal("encoding is not stable")
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, p := range seedPackets() {
+		buf := new(bytes.Buffer)
+		p.Write(buf)
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(checkDecode)
+}
+
+// fuzz the body of packets of a given type: the fuzzer's data is put
+// behind a valid header, so the fuzzer does not have to find that out
+// first
+func fuzzPacketType(f *testing.F, packettypes ...uint8) {
+	for _, p := range seedPackets() {
+		buf := new(bytes.Buffer)
+		p.Write(buf)
+		for _, packettype := range packettypes {
+			if PacketHeader(p).Type == packettype {
+				f.Add(packettype, buf.Bytes()[4:])
+			}
+		}
+	}
+	f.Fuzz(func(t *testing.T, packettype uint8, body []byte) {
+		known := false
+		for _, pt := range packettypes {
+			known = known || pt == packettype
+		}
+		if !known || len(body) > 0xFFFF {
+			t.Skip()
+		}
+		tlv := &TLV{Type: packettype, Version: 0, Length: uint16(len(body))}
+		buf := bytes.NewBuffer(make([]byte, 0, tlv.Size()+len(body)))
+		tlv.Write(buf)
+		buf.Write(body)
+		checkDecode(t, buf.Bytes())
+	})
+}
+
+func FuzzPushDataV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_PUSH_DATA)
+}
+
+func FuzzAnnounceMasterV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_ANNOUNCE_MASTER)
+}
+
+func FuzzRequestV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_REQUEST)
+}
+
+func FuzzStatusV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_STATUS_TXEND, ALFRED_STATUS_ERROR)
+}
+
+func FuzzModeSwitchV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_MODESWITCH)
+}
+
+func FuzzChangeInterfaceV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_CHANGE_INTERFACE)
+}
+
+// covers both requests and replies
+func FuzzServerStatusV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_SERVER_STATUS)
+}
+
+func FuzzEventRegisterV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_EVENT_REGISTER)
+}
+
+func FuzzEventNotifyV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_EVENT_NOTIFY)
+}
+
+func FuzzSignatureV0(f *testing.F) {
+	fuzzPacketType(f, ALFRED_SIGNATURE)
+}
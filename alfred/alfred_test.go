@@ -0,0 +1,122 @@
+package alfred
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var (
+	testTx     = []byte{0x00, 0x01, 0x00, 0x00}
+	testSource = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		err   error
+		ptype int
+	}{
+		{"announce", []byte{ALFRED_ANNOUNCE_MASTER, 0, 0, 0}, nil, 0},
+		{"push data", concat([]byte{ALFRED_PUSH_DATA, 0, 0, 17}, testTx, testSource, []byte{100, 0, 0, 3}, []byte("abc")), nil, 0},
+		{"empty", nil, ErrTruncated, -1},
+		{"short header", []byte{ALFRED_ANNOUNCE_MASTER, 0, 0}, ErrTruncated, -1},
+		{"length beyond datagram", []byte{ALFRED_ANNOUNCE_MASTER, 0, 0, 5}, ErrTruncated, ALFRED_ANNOUNCE_MASTER},
+		{"maximum length beyond datagram", []byte{ALFRED_PUSH_DATA, 0, 0xff, 0xff, 0, 1, 0, 0}, ErrTruncated, ALFRED_PUSH_DATA},
+		{"trailing data", []byte{ALFRED_ANNOUNCE_MASTER, 0, 0, 0, 0xff}, ErrTrailingData, ALFRED_ANNOUNCE_MASTER},
+		{"announce with body", []byte{ALFRED_ANNOUNCE_MASTER, 0, 0, 1, 0xff}, ErrTrailingData, ALFRED_ANNOUNCE_MASTER},
+		{"request truncated", []byte{ALFRED_REQUEST, 0, 0, 2, 158, 0}, ErrTruncated, ALFRED_REQUEST},
+		{"request too long", []byte{ALFRED_REQUEST, 0, 0, 4, 158, 0, 2, 0xff}, ErrTrailingData, ALFRED_REQUEST},
+		{"status truncated", []byte{ALFRED_STATUS_TXEND, 0, 0, 3, 0, 1, 0}, ErrTruncated, ALFRED_STATUS_TXEND},
+		{"push data shorter than transaction", []byte{ALFRED_PUSH_DATA, 0, 0, 2, 0, 1}, ErrTruncated, ALFRED_PUSH_DATA},
+		{"push data item header truncated", concat([]byte{ALFRED_PUSH_DATA, 0, 0, 12}, testTx, testSource, []byte{100, 0}), ErrTruncated, ALFRED_PUSH_DATA},
+		{"push data item too large", concat([]byte{ALFRED_PUSH_DATA, 0, 0, 17}, testTx, testSource, []byte{100, 0, 0, 16}, []byte("abc")), ErrTooLarge, ALFRED_PUSH_DATA},
+		{"push data item oversize", concat([]byte{ALFRED_PUSH_DATA, 0, 0, 17}, testTx, testSource, []byte{100, 0, 0xff, 0xff}, []byte("abc")), ErrTooLarge, ALFRED_PUSH_DATA},
+		{"signature without time", concat([]byte{ALFRED_SIGNATURE, 0, 0, 8}, testTx, []byte{0, 0, 0, 0}), ErrInvalidLength, ALFRED_SIGNATURE},
+		{"server status element too large", concat([]byte{ALFRED_SERVER_STATUS, 0, 0, 10}, testTx, []byte{ALFRED_SERVER_OP_MODE, 0, 0, 16, 1, 0}), ErrTooLarge, ALFRED_SERVER_STATUS},
+		{"server status element too short", concat([]byte{ALFRED_SERVER_STATUS, 0, 0, 8}, testTx, []byte{ALFRED_SERVER_OP_MODE, 0, 0, 0}), ErrInvalidLength, ALFRED_SERVER_STATUS},
+		{"server status element truncated", concat([]byte{ALFRED_SERVER_STATUS, 0, 0, 6}, testTx, []byte{ALFRED_SERVER_OP_MODE, 0}), ErrTruncated, ALFRED_SERVER_STATUS},
+		{"unknown type", []byte{7, 0, 0, 2, 0xaa, 0xbb}, ErrUnknownType, 7},
+		{"unknown version", []byte{ALFRED_ANNOUNCE_MASTER, 1, 0, 0}, ErrUnknownType, ALFRED_ANNOUNCE_MASTER},
+	}
+	for _, test := range tests {
+		p, err := Decode(test.data)
+		if test.err == nil {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if !bytes.Equal(encode(t, p), test.data) {
+				t.Errorf("%s: packet changed when encoding it again", test.name)
+			}
+			continue
+		}
+		var derr *DecodeError
+		if !errors.As(err, &derr) {
+			t.Errorf("%s: got %v, want a DecodeError", test.name, err)
+			continue
+		}
+		if !errors.Is(err, test.err) || !errors.Is(err, ErrRead) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if derr.Type != test.ptype {
+			t.Errorf("%s: got type %d, want %d", test.name, derr.Type, test.ptype)
+		}
+		if derr.Offset < 0 || derr.Offset > len(test.data) {
+			t.Errorf("%s: offset %d outside of the packet", test.name, derr.Offset)
+		}
+	}
+}
+
+// malformed packets in a stream must not keep the following ones from
+// being read
+func TestReadStream(t *testing.T) {
+	stream := concat(
+		[]byte{7, 0, 0, 2, 0xaa, 0xbb},
+		[]byte{ALFRED_REQUEST, 0, 0, 2, 158, 0},
+		[]byte{ALFRED_ANNOUNCE_MASTER, 0, 0, 1, 0xff},
+		[]byte{ALFRED_REQUEST, 0, 0, 3, 158, 0, 2},
+		[]byte{ALFRED_PUSH_DATA, 0},
+	)
+	tests := []struct {
+		err  error
+		n    int
+		want uint8
+	}{
+		{ErrUnknownType, 6, 0},
+		{ErrTruncated, 6, 0},
+		{ErrTrailingData, 5, 0},
+		{nil, 7, ALFRED_REQUEST},
+		{ErrTruncated, 2, 0},
+		{io.EOF, 0, 0},
+	}
+	r := bytes.NewReader(stream)
+	for i, test := range tests {
+		p, err, n := Read(r)
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Fatalf("packet %d: got error %v, want %v", i, err, test.err)
+		}
+		if n != test.n {
+			t.Errorf("packet %d: read %d bytes, want %d", i, n, test.n)
+		}
+		if err == nil && PacketHeader(p).Type != test.want {
+			t.Errorf("packet %d: got %T", i, p)
+		}
+	}
+}
+
+// unlike Decode, Read leaves whatever follows the packet alone
+func TestReadTrailing(t *testing.T) {
+	r := bytes.NewReader([]byte{ALFRED_ANNOUNCE_MASTER, 0, 0, 0, 0xff})
+	p, err, n := Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*AnnounceMasterV0); !ok || n != 4 || r.Len() != 1 {
+		t.Errorf("got %T, read %d bytes, %d left", p, n, r.Len())
+	}
+}
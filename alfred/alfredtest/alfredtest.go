@@ -0,0 +1,348 @@
+// Package alfredtest provides a fake A.L.F.R.E.D. server running in the
+// same process, for testing code that talks to a server via
+// alfred.Client.
+//
+// The server listens on a unix socket in a temporary directory and
+// keeps its data in an alfred.Store. Tests can preload data, let
+// operations fail, slow down replies and inspect the data that was
+// pushed to the server.
+package alfredtest
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hwhw/mesh/alfred"
+)
+
+// ways to let operations fail, see Server.Fail
+const (
+	// reply with an ALFRED_STATUS_ERROR status packet
+	FAIL_STATUS_ERROR = iota + 1
+	// close the connection without replying
+	FAIL_CLOSE
+	// reply with data that cannot be parsed
+	FAIL_GARBAGE
+)
+
+// a packet with an unknown type, for FAIL_GARBAGE
+var garbage = []byte{0xFF, 0x00, 0x00, 0x02, 0x00, 0x00}
+
+// A fake A.L.F.R.E.D. server
+type Server struct {
+	// path of the unix socket the server listens on
+	Path string
+	// source address reported for pushed data that came without one,
+	// like a real server uses the address of its interface
+	Source alfred.HardwareAddr
+
+	// operation mode, can be switched by clients
+	mode     int
+	dir      string
+	listener net.Listener
+	store    *alfred.Store
+	wg       sync.WaitGroup
+	failures []*failure
+	delay    time.Duration
+	pushes   []alfred.Data
+	requests []uint8
+	// signalled when a push was recorded
+	pushed *sync.Cond
+	sync.Mutex
+}
+
+// a pending failure of operations
+type failure struct {
+	op    uint8
+	mode  int
+	count int
+}
+
+// Start a new fake server. It must be shut down with Close.
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "alfredtest")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "alfred.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &Server{
+		Path:     path,
+		Source:   alfred.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+		mode:     alfred.SERVER_MODE_MASTER,
+		dir:      dir,
+		listener: listener,
+		store:    alfred.NewStore(time.Minute*10, time.Second*20),
+	}
+	s.pushed = sync.NewCond(&s.Mutex)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serve()
+	}()
+	return s, nil
+}
+
+// Return a client talking to the server
+func (s *Server) Client() *alfred.Client {
+	return alfred.NewClient("unix", s.Path, nil)
+}
+
+// Shut down the server and remove its socket
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+	s.store.Shutdown()
+	os.RemoveAll(s.dir)
+}
+
+// Put data into the server's store, as if it had been received from
+// another server
+func (s *Server) Preload(source alfred.HardwareAddr, packettype uint8, version uint8, payload []byte) {
+	s.store.Request(alfred.ReqPut{
+		Data: alfred.Data{
+			Source: source,
+			Header: &alfred.TLV{
+				Type:    packettype,
+				Version: version,
+				Length:  uint16(len(payload)),
+			},
+			Data: payload,
+		},
+	})
+}
+
+// Put data for a type of content into the server's store, as if it
+// had been received from another server. The packet type is the one
+// of the content. The data is only stored if the content can be read
+// from it, so fixtures are not silently skipped by the code under
+// test; otherwise the error of content.ReadAlfred is returned.
+func (s *Server) PreloadContent(source alfred.HardwareAddr, content alfred.Content, version uint8, payload []byte) error {
+	data := alfred.Data{
+		Source: source,
+		Header: &alfred.TLV{
+			Type:    content.GetPacketType(),
+			Version: version,
+			Length:  uint16(len(payload)),
+		},
+		Data: payload,
+	}
+	if err := content.ReadAlfred(data); err != nil {
+		return err
+	}
+	s.store.Request(alfred.ReqPut{Data: data})
+	return nil
+}
+
+// Let the next count operations of a given kind fail. The kind is the
+// packet type the client starts the operation with, e.g.
+// alfred.ALFRED_REQUEST or alfred.ALFRED_PUSH_DATA. A negative count
+// lets all following operations fail, until ClearFailures is called.
+// Failed pushes are neither stored nor recorded.
+func (s *Server) Fail(op uint8, mode int, count int) {
+	s.Lock()
+	defer s.Unlock()
+	s.failures = append(s.failures, &failure{op: op, mode: mode, count: count})
+}
+
+// Forget about all pending failures
+func (s *Server) ClearFailures() {
+	s.Lock()
+	defer s.Unlock()
+	s.failures = nil
+}
+
+// Wait the given time before handling an operation
+func (s *Server) SetDelay(delay time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.delay = delay
+}
+
+// Return the data items pushed to the server so far, in the order
+// they arrived
+func (s *Server) Pushes() []alfred.Data {
+	s.Lock()
+	defer s.Unlock()
+	return append([]alfred.Data(nil), s.pushes...)
+}
+
+// Wait until at least n data items have been pushed to the server or
+// the timeout has passed, and return the pushed data items
+func (s *Server) WaitForPushes(n int, timeout time.Duration) []alfred.Data {
+	timer := time.AfterFunc(timeout, func() {
+		s.Lock()
+		defer s.Unlock()
+		s.pushed.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	s.Lock()
+	defer s.Unlock()
+	for len(s.pushes) < n && time.Now().Before(deadline) {
+		s.pushed.Wait()
+	}
+	return append([]alfred.Data(nil), s.pushes...)
+}
+
+// Return the data types that were requested so far
+func (s *Server) Requests() []uint8 {
+	s.Lock()
+	defer s.Unlock()
+	return append([]uint8(nil), s.requests...)
+}
+
+// Return the operation mode, a client might have switched it
+func (s *Server) Mode() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.mode
+}
+
+// check if an operation is to fail, returns the failure mode or 0
+func (s *Server) failure(op uint8) int {
+	s.Lock()
+	defer s.Unlock()
+	for i, f := range s.failures {
+		if f.op != op {
+			continue
+		}
+		if f.count > 0 {
+			f.count--
+			if f.count == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f.mode
+	}
+	return 0
+}
+
+func (s *Server) getDelay() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.delay
+}
+
+// accept connections until the listener is closed
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle a single connection
+func (s *Server) handle(conn net.Conn) {
+	pkg, err, _ := alfred.Read(conn)
+	if err != nil {
+		return
+	}
+	var op uint8
+	var tx *alfred.TransactionMgmt
+	switch pkg := pkg.(type) {
+	case *alfred.RequestV0:
+		op = alfred.ALFRED_REQUEST
+		tx = &alfred.TransactionMgmt{Id: pkg.TxId, SeqNo: 0}
+	case *alfred.PushDataV0:
+		op = alfred.ALFRED_PUSH_DATA
+		tx = &alfred.TransactionMgmt{Id: pkg.Tx.Id, SeqNo: 0}
+	case *alfred.ServerStatusReqV0:
+		op = alfred.ALFRED_SERVER_STATUS
+		tx = &alfred.TransactionMgmt{Id: pkg.Tx.Id, SeqNo: 0}
+	case *alfred.ModeSwitchV0:
+		op = alfred.ALFRED_MODESWITCH
+	case *alfred.ChangeInterfaceV0:
+		op = alfred.ALFRED_CHANGE_INTERFACE
+	default:
+		// not supported, just hang up
+		return
+	}
+	if delay := s.getDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+	w := bufio.NewWriter(conn)
+	switch s.failure(op) {
+	case FAIL_STATUS_ERROR:
+		if tx == nil {
+			tx = &alfred.TransactionMgmt{}
+		}
+		if alfred.NewStatusV0(alfred.ALFRED_STATUS_ERROR, tx).Write(w) == nil {
+			w.Flush()
+		}
+		return
+	case FAIL_CLOSE:
+		return
+	case FAIL_GARBAGE:
+		conn.Write(garbage)
+		return
+	}
+	switch pkg := pkg.(type) {
+	case *alfred.RequestV0:
+		s.Lock()
+		s.requests = append(s.requests, pkg.RequestedType)
+		s.Unlock()
+		s.sendData(w, pkg)
+	case *alfred.PushDataV0:
+		s.Lock()
+		for _, d := range pkg.Data {
+			if d.Source.IsUnset() {
+				d.Source = s.Source
+			}
+			s.pushes = append(s.pushes, d)
+			s.store.Request(alfred.ReqPut{IsLocal: true, Data: d})
+		}
+		s.pushed.Broadcast()
+		s.Unlock()
+	case *alfred.ServerStatusReqV0:
+		status := alfred.NewServerStatusRepV0(pkg.Tx, uint8(s.Mode()), nil, "")
+		if status.Write(w) == nil {
+			w.Flush()
+		}
+	case *alfred.ModeSwitchV0:
+		s.Lock()
+		switch pkg.Mode {
+		case alfred.ALFRED_MODESWITCH_SLAVE:
+			s.mode = alfred.SERVER_MODE_SLAVE
+		case alfred.ALFRED_MODESWITCH_MASTER:
+			s.mode = alfred.SERVER_MODE_MASTER
+		}
+		s.Unlock()
+	}
+}
+
+// reply to a request, sending every data item in a packet of its own
+func (s *Server) sendData(w *bufio.Writer, req *alfred.RequestV0) {
+	data := make(chan alfred.Data, 100)
+	s.store.Request(alfred.ReqGetAll{TypeFilter: req.RequestedType, Return: data})
+	// drain the channel when bailing out early
+	defer func() {
+		for _ = range data {
+		}
+	}()
+	tx := &alfred.TransactionMgmt{Id: req.TxId, SeqNo: 0}
+	for d := range data {
+		pd := alfred.NewPushDataV0(tx, []alfred.Data{d})
+		if pd.Write(w) != nil || w.Flush() != nil {
+			return
+		}
+		tx.SeqNo++
+	}
+}
@@ -0,0 +1,208 @@
+package alfredtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hwhw/mesh/alfred"
+)
+
+var testSource = alfred.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+
+// content that needs its payload to start with "ok"
+type testContent struct {
+	payload string
+}
+
+func (c *testContent) GetPacketType() uint8 {
+	return 100
+}
+
+func (c *testContent) ReadAlfred(data alfred.Data) error {
+	if len(data.Data) < 2 || string(data.Data[:2]) != "ok" {
+		return alfred.ErrRead
+	}
+	c.payload = string(data.Data)
+	return nil
+}
+
+func newServer(t *testing.T) *Server {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func client(s *Server, timeout time.Duration) *alfred.Client {
+	return alfred.NewClient("unix", s.Path, &timeout)
+}
+
+// request data of a type, returning the payloads
+func request(c *alfred.Client, packettype uint8) ([]string, error) {
+	payloads := []string{}
+	err := c.Request(packettype, func(d alfred.Data) error {
+		payloads = append(payloads, string(d.Data))
+		return nil
+	})
+	return payloads, err
+}
+
+func TestRequest(t *testing.T) {
+	s := newServer(t)
+	s.Preload(testSource, 100, 0, []byte("ok one"))
+	if err := s.PreloadContent(alfred.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}, &testContent{}, 0, []byte("ok two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PreloadContent(testSource, &testContent{}, 0, []byte("not ok")); err == nil {
+		t.Error("content that cannot be read was preloaded")
+	}
+	s.Preload(testSource, 101, 0, []byte("other type"))
+
+	payloads, err := request(s.Client(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 2 {
+		t.Errorf("got %v, want the two preloaded items", payloads)
+	}
+	content := &testContent{}
+	n := 0
+	err = s.Client().RequestContent(content, func() error {
+		n++
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Errorf("got %d content items, error %v", n, err)
+	}
+	if r := s.Requests(); len(r) != 2 || r[0] != 100 {
+		t.Errorf("recorded requests %v", r)
+	}
+}
+
+func pendingFailures(s *Server) int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.failures)
+}
+
+func TestPushData(t *testing.T) {
+	s := newServer(t)
+	if err := s.Client().PushData(100, []byte("ok pushed")); err != nil {
+		t.Fatal(err)
+	}
+	pushes := s.WaitForPushes(1, time.Second)
+	if len(pushes) != 1 || string(pushes[0].Data) != "ok pushed" || pushes[0].Source.String() != s.Source.String() {
+		t.Fatalf("recorded pushes %+v", pushes)
+	}
+	payloads, err := request(s.Client(), 100)
+	if err != nil || len(payloads) != 1 {
+		t.Errorf("pushed data not stored: %v, %v", payloads, err)
+	}
+}
+
+func TestFailRequest(t *testing.T) {
+	tests := []struct {
+		mode int
+		// nil if the request just returns no data
+		is error
+	}{
+		{FAIL_STATUS_ERROR, alfred.ErrStatus},
+		{FAIL_GARBAGE, alfred.ErrProtocol},
+		// the client cannot tell this from a server without data
+		{FAIL_CLOSE, nil},
+	}
+	for _, test := range tests {
+		s := newServer(t)
+		s.Preload(testSource, 100, 0, []byte("ok"))
+		s.Fail(alfred.ALFRED_REQUEST, test.mode, 1)
+		payloads, err := request(s.Client(), 100)
+		if !errors.Is(err, test.is) || len(payloads) != 0 {
+			t.Errorf("failure mode %d: got %v, error %v, want %v", test.mode, payloads, err, test.is)
+		}
+		// only the first request fails
+		payloads, err = request(s.Client(), 100)
+		if err != nil || len(payloads) != 1 {
+			t.Errorf("failure mode %d: second request got %v, %v", test.mode, payloads, err)
+		}
+	}
+
+	s := newServer(t)
+	s.Fail(alfred.ALFRED_REQUEST, FAIL_STATUS_ERROR, -1)
+	for i := 0; i < 3; i++ {
+		if _, err := request(s.Client(), 100); !errors.Is(err, alfred.ErrStatus) {
+			t.Errorf("request %d: got %v", i, err)
+		}
+	}
+	// other operations are not affected
+	if _, err := s.Client().ServerStatus(); err != nil {
+		t.Errorf("status request failed: %v", err)
+	}
+	s.ClearFailures()
+	if _, err := request(s.Client(), 100); err != nil {
+		t.Errorf("request after clearing failures: %v", err)
+	}
+}
+
+func TestFailPush(t *testing.T) {
+	for _, mode := range []int{FAIL_STATUS_ERROR, FAIL_CLOSE, FAIL_GARBAGE} {
+		s := newServer(t)
+		s.Fail(alfred.ALFRED_PUSH_DATA, mode, 1)
+		// the client does not wait for an answer to pushes
+		if err := s.Client().PushData(100, []byte("ok lost")); err != nil {
+			t.Errorf("failure mode %d: %v", mode, err)
+		}
+		// connections are handled concurrently, make sure the
+		// failing push is handled first
+		for deadline := time.Now().Add(time.Second); pendingFailures(s) > 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		if err := s.Client().PushData(100, []byte("ok stored")); err != nil {
+			t.Errorf("failure mode %d: %v", mode, err)
+		}
+		pushes := s.WaitForPushes(1, time.Second)
+		if len(pushes) != 1 || string(pushes[0].Data) != "ok stored" {
+			t.Errorf("failure mode %d: recorded pushes %+v", mode, pushes)
+		}
+	}
+}
+
+func TestFailStatus(t *testing.T) {
+	s := newServer(t)
+	s.Fail(alfred.ALFRED_SERVER_STATUS, FAIL_STATUS_ERROR, 1)
+	if _, err := s.Client().ServerStatus(); !errors.Is(err, alfred.ErrStatus) {
+		t.Errorf("got %v", err)
+	}
+	status, err := s.Client().ServerStatus()
+	if err != nil || status.Mode != alfred.SERVER_MODE_MASTER {
+		t.Errorf("got %+v, %v", status, err)
+	}
+}
+
+func TestSetDelay(t *testing.T) {
+	s := newServer(t)
+	s.Preload(testSource, 100, 0, []byte("ok"))
+	s.SetDelay(200 * time.Millisecond)
+
+	if _, err := request(client(s, 50*time.Millisecond), 100); !errors.Is(err, alfred.ErrTimeout) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := client(s, time.Minute).RequestContext(ctx, 100, func(alfred.Data) error { return nil })
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want the context's error", err)
+	}
+
+	start := time.Now()
+	payloads, err := request(client(s, time.Second), 100)
+	if err != nil || len(payloads) != 1 {
+		t.Errorf("got %v, %v", payloads, err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("reply after %v, before the delay", d)
+	}
+}
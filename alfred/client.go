@@ -2,26 +2,133 @@ package alfred
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/tv42/topic"
 	"io"
 	"log"
 	"net"
+	"sort"
 	"time"
 )
 
+// Errors returned by the client. Errors reported by the server, bad
+// data and timeouts are returned as *StatusError, *ProtocolError and
+// *TimeoutError, which carry details and match these with errors.Is,
+// so compare with errors.Is(err, ErrStatus) rather than with ==.
 var ErrStatus = errors.New("A.L.F.R.E.D. server reported an error")
 var ErrProtocol = errors.New("Bad data received from A.L.F.R.E.D. server")
+var ErrTimeout = errors.New("timeout talking to A.L.F.R.E.D. server")
+
+// returned when the server reported an error, matches ErrStatus
+type StatusError struct {
+	// transaction information sent along with the error
+	Tx *TransactionMgmt
+}
+
+func (e *StatusError) Error() string {
+	return ErrStatus.Error()
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrStatus
+}
+
+// returned when the server sent something unexpected or unparseable,
+// matches ErrProtocol
+type ProtocolError struct {
+	// the unexpected packet, if any
+	Packet Packet
+	// the parser error, if any
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %v", ErrProtocol, e.Err)
+	}
+	if h := PacketHeader(e.Packet); h != nil {
+		return fmt.Sprintf("%v: unexpected packet type %d", ErrProtocol, h.Type)
+	}
+	return ErrProtocol.Error()
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// returned when the server did not answer in time, matches ErrTimeout
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTimeout, e.Err)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// map an error that occurred while talking to the server to the
+// error types above. Errors of the context are passed through.
+func classifyError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	switch err.(type) {
+	case *StatusError, *ProtocolError, *TimeoutError:
+		return err
+	case *DecodeError:
+		return &ProtocolError{Err: err}
+	}
+	if neterr, ok := err.(net.Error); ok {
+		if neterr.Timeout() {
+			// the connection's deadline may be the one of the
+			// context, and be noticed before the context is
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				return context.DeadlineExceeded
+			}
+			return &TimeoutError{Err: err}
+		}
+		return err
+	}
+	if err == ErrRead || err == ErrUnknownType || err == io.ErrUnexpectedEOF {
+		return &ProtocolError{Err: err}
+	}
+	return err
+}
 
 // An A.L.F.R.E.D. client.
 //
 // It will create a new connection for each request - since the
 // C implementation will close the connection when it has handled
 // a request.
+//
+// The errors its methods return are described at ErrStatus.
 type Client struct {
 	network string
 	address string
 	timeout time.Duration
+	// if set, connections are secured by TLS
+	tlsConfig *tls.Config
 }
 
 var defaultTimeout = time.Second * 10
@@ -35,96 +142,314 @@ func NewClient(network string, address string, timeout *time.Duration) *Client {
 	return &Client{network: network, address: address, timeout: t}
 }
 
+// Return a new client instance that connects to a server's TLS
+// listener at a TCP address, using the given TLS configuration (see
+// NewClientTLSConfig)
+func NewTLSClient(address string, config *tls.Config, timeout *time.Duration) *Client {
+	c := NewClient("tcp", address, timeout)
+	c.tlsConfig = config
+	return c
+}
+
+// open a connection to the server
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	if c.tlsConfig != nil {
+		tlsdialer := &tls.Dialer{NetDialer: dialer, Config: c.tlsConfig}
+		return tlsdialer.DialContext(ctx, c.network, c.address)
+	}
+	return dialer.DialContext(ctx, c.network, c.address)
+}
+
+// open a connection that is closed when the context is done. The
+// deadline for the connection is the one of the context or, if it
+// has none, the client's timeout.
+// The returned function must be called when done with the connection.
+func (c *Client) open(ctx context.Context) (net.Conn, func(), error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, classifyError(ctx, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	conn.SetDeadline(deadline)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks reading and writing
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	closed := false
+	return conn, func() {
+		if !closed {
+			closed = true
+			close(stop)
+			conn.Close()
+		}
+	}, nil
+}
+
 // wrapper for the network connection
 func (c *Client) Connect(handler func(net.Conn, *bufio.Writer) error) error {
-	conn, err := net.Dial(c.network, c.address)
+	return c.ConnectContext(context.Background(), handler)
+}
+
+// wrapper for the network connection, which is closed when the
+// context is done
+func (c *Client) ConnectContext(ctx context.Context, handler func(net.Conn, *bufio.Writer) error) error {
+	conn, done, err := c.open(ctx)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(c.timeout))
+	defer done()
 	buf := bufio.NewWriter(conn)
-	return handler(conn, buf)
+	return classifyError(ctx, handler(conn, buf))
+}
+
+// write a single packet
+func writePacket(buf *bufio.Writer, p Packet) error {
+	err := p.Write(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	return err
 }
 
 // switch server mode
 func (c *Client) ModeSwitch(mode uint8) error {
-	return c.Connect(func(conn net.Conn, buf *bufio.Writer) error {
-		err := NewModeSwitchV0(mode).Write(buf)
-		if err == nil {
-			err = buf.Flush()
-		}
-		return err
+	return c.ModeSwitchContext(context.Background(), mode)
+}
+
+func (c *Client) ModeSwitchContext(ctx context.Context, mode uint8) error {
+	return c.ConnectContext(ctx, func(conn net.Conn, buf *bufio.Writer) error {
+		return writePacket(buf, NewModeSwitchV0(mode))
 	})
 }
 
 // change interface(s) the server listens on for UDP connections
 func (c *Client) ChangeInterface(interfaces []byte) error {
-	return c.Connect(func(conn net.Conn, buf *bufio.Writer) error {
-		err := NewChangeInterfaceV0(interfaces).Write(buf)
-		if err == nil {
-			err = buf.Flush()
+	return c.ChangeInterfaceContext(context.Background(), interfaces)
+}
+
+func (c *Client) ChangeInterfaceContext(ctx context.Context, interfaces []byte) error {
+	return c.ConnectContext(ctx, func(conn net.Conn, buf *bufio.Writer) error {
+		return writePacket(buf, NewChangeInterfaceV0(interfaces))
+	})
+}
+
+// query server status
+func (c *Client) ServerStatus() (*ServerStatusRepV0, error) {
+	return c.ServerStatusContext(context.Background())
+}
+
+func (c *Client) ServerStatusContext(ctx context.Context) (*ServerStatusRepV0, error) {
+	var status *ServerStatusRepV0
+	err := c.ConnectContext(ctx, func(conn net.Conn, buf *bufio.Writer) error {
+		req := NewServerStatusReqV0(&TransactionMgmt{Id: getRandomId(), SeqNo: 0})
+		if err := writePacket(buf, req); err != nil {
+			return err
 		}
-		return err
+		pkg, err, _ := Read(bufio.NewReader(conn))
+		if err != nil {
+			return err
+		}
+		switch pkg := pkg.(type) {
+		case *ServerStatusRepV0:
+			status = pkg
+			return nil
+		case *StatusV0:
+			if pkg.Header.Type == ALFRED_STATUS_ERROR {
+				return &StatusError{Tx: pkg.Tx}
+			}
+		}
+		return &ProtocolError{Packet: pkg}
 	})
+	return status, err
 }
 
 // push data of a given type
 func (c *Client) PushData(packettype uint8, data []byte) error {
-	return c.Connect(func(conn net.Conn, buf *bufio.Writer) error {
+	return c.PushDataContext(context.Background(), packettype, data)
+}
+
+func (c *Client) PushDataContext(ctx context.Context, packettype uint8, data []byte) error {
+	return c.ConnectContext(ctx, func(conn net.Conn, buf *bufio.Writer) error {
 		tm := &TransactionMgmt{Id: getRandomId(), SeqNo: 0}
 		pdata := []Data{Data{Source: NullHardwareAddr, Header: &TLV{Type: packettype}, Data: data}}
-		pd := NewPushDataV0(tm, pdata)
-		err := pd.Write(buf)
-		if err == nil {
-			err = buf.Flush()
-		}
-		return err
+		return writePacket(buf, NewPushDataV0(tm, pdata))
+	})
+}
+
+// push data of several types at once, in a single transaction.
+// Either all of the data is pushed or, if it does not fit into a
+// single packet (ErrTooLarge), none of it.
+func (c *Client) PushDataMulti(data map[uint8][]byte) error {
+	return c.PushDataMultiContext(context.Background(), data)
+}
+
+func (c *Client) PushDataMultiContext(ctx context.Context, data map[uint8][]byte) error {
+	types := make([]int, 0, len(data))
+	for packettype, _ := range data {
+		types = append(types, int(packettype))
+	}
+	sort.Ints(types)
+	pdata := make([]Data, 0, len(data))
+	for _, packettype := range types {
+		pdata = append(pdata, Data{
+			Source: NullHardwareAddr,
+			Header: &TLV{Type: uint8(packettype)},
+			Data:   data[uint8(packettype)],
+		})
+	}
+	tm := &TransactionMgmt{Id: getRandomId(), SeqNo: 0}
+	pd := NewPushDataV0(tm, pdata)
+	if pd.Tx.Size()+pd.SizeData() > 0xFFFF {
+		// fail before connecting
+		return ErrTooLarge
+	}
+	return c.ConnectContext(ctx, func(conn net.Conn, buf *bufio.Writer) error {
+		return writePacket(buf, pd)
 	})
 }
 
 // Request data of a given type
 func (c *Client) Request(packettype uint8, handler func(Data) error) error {
-	return c.Connect(func(conn net.Conn, buf *bufio.Writer) error {
-		req := NewRequestV0(packettype, getRandomId())
-		err := req.Write(buf)
-		if err == nil {
-			err = buf.Flush()
-		}
-		if err != nil {
+	return c.RequestContext(context.Background(), packettype, handler)
+}
+
+func (c *Client) RequestContext(ctx context.Context, packettype uint8, handler func(Data) error) error {
+	it, err := c.RequestIterator(ctx, packettype)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		if err := handler(it.Data()); err != nil {
 			return err
 		}
+	}
+	return it.Err()
+}
+
+// Subscribe to notifications about changed data of a given type
+// (or of all types, when PACKETTYPE_ALL is given).
+// The connection to the server is kept open, each notification
+// is passed via the returned channel. The channel is closed when the
+// connection ends or when a message is broadcast via notifyQuit.
+// This is a wrapper for SubscribeContext.
+func (c *Client) Subscribe(packettype uint8, notifyQuit *topic.Topic) (<-chan *EventNotifyV0, error) {
+	ctx, cancel := topicContext(notifyQuit)
+	events, done, err := c.subscribe(ctx, packettype)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		<-done
+		cancel()
+	}()
+	return events, nil
+}
+
+// return a context that is cancelled when a message is broadcast via
+// notifyQuit (if not nil) or when the returned function is called,
+// which must be done when the context is no longer needed
+func topicContext(notifyQuit *topic.Topic) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if notifyQuit == nil {
+		return ctx, cancel
+	}
+	// buffered, so a broadcast does not block on us when the context
+	// was cancelled and we are about to unregister
+	quit := make(chan interface{}, 1)
+	notifyQuit.Register(quit)
+	go func() {
+		defer notifyQuit.Unregister(quit)
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Subscribe to notifications, see Subscribe. The channel is closed
+// when the connection ends or when the context is done.
+// Unlike other requests, the connection has no deadline unless the
+// context has one.
+func (c *Client) SubscribeContext(ctx context.Context, packettype uint8) (<-chan *EventNotifyV0, error) {
+	events, _, err := c.subscribe(ctx, packettype)
+	return events, err
+}
+
+// subscribe to notifications, additionally returns a channel that is
+// closed when the connection has ended
+func (c *Client) subscribe(ctx context.Context, packettype uint8) (<-chan *EventNotifyV0, <-chan struct{}, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, classifyError(ctx, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := writePacket(bufio.NewWriter(conn), NewEventRegisterV0()); err != nil {
+		conn.Close()
+		return nil, nil, classifyError(ctx, err)
+	}
+
+	events := make(chan *EventNotifyV0, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(events)
+		defer close(done)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
 		for {
-			pkg, err, _ := Read(conn)
-			switch err {
-			case nil:
-				if pd, ok := pkg.(*PushDataV0); ok {
-					for _, d := range pd.Data {
-						err = handler(d)
-						if err != nil {
-							return err
-						}
-					}
-				} else if status, ok := pkg.(*StatusV0); ok && status.Header.Type == ALFRED_STATUS_ERROR {
-					return ErrStatus
-				} else {
-					return ErrProtocol
+			pkg, err, _ := Read(reader)
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					log.Printf("alfred/client: error reading events: %v", err)
+				}
+				return
+			}
+			event, ok := pkg.(*EventNotifyV0)
+			if !ok {
+				log.Printf("alfred/client: unexpected packet while waiting for events: %+v", pkg)
+				return
+			}
+			if packettype == PACKETTYPE_ALL || event.Type == packettype {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
 				}
-			case io.EOF:
-				// don't pass through this error, it is just the
-				// end of the transaction
-				return nil
-			default:
-				// pass through other errors
-				return err
 			}
 		}
-	})
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks the reader
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return events, done, nil
 }
 
 // Request data and put it into structured data conforming to the Content interface
 func (c *Client) RequestContent(contentitem Content, handler func() error) error {
-	return c.Request(contentitem.GetPacketType(), func(data Data) error {
+	return c.RequestContentContext(context.Background(), contentitem, handler)
+}
+
+func (c *Client) RequestContentContext(ctx context.Context, contentitem Content, handler func() error) error {
+	return c.RequestContext(ctx, contentitem.GetPacketType(), func(data Data) error {
 		err := contentitem.ReadAlfred(data)
 		if err != nil {
 			// just skip
@@ -146,14 +471,27 @@ func (c *Client) Updater(
 	notifySuccess *topic.Topic,
 	handler func() error) {
 
-	quit := make(chan interface{})
-	notifyQuit.Register(quit)
-	defer notifyQuit.Unregister(quit)
+	ctx, cancel := topicContext(notifyQuit)
+	defer cancel()
+	c.UpdaterContext(ctx, contentitem, updatewait, retrywait, notifySuccess, handler)
+}
+
+// Run an update client, see Updater, until the context is done.
+// A running update is cancelled then.
+func (c *Client) UpdaterContext(
+	ctx context.Context,
+	contentitem Content,
+	updatewait time.Duration, retrywait time.Duration,
+	notifySuccess *topic.Topic,
+	handler func() error) {
 
 	for {
 		timeout := updatewait
 		log.Printf("UpdateClient: Updating data from alfred server for type %d", contentitem.GetPacketType())
-		err := c.RequestContent(contentitem, handler)
+		err := c.RequestContentContext(ctx, contentitem, handler)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			log.Printf("UpdateClient: type %d, error fetching data: %v", contentitem.GetPacketType(), err)
 			timeout = retrywait
@@ -161,10 +499,9 @@ func (c *Client) Updater(
 			notifySuccess.Broadcast <- struct{}{}
 		}
 		select {
-		case <-quit:
-			break
+		case <-ctx.Done():
+			return
 		case <-time.After(timeout):
-			continue
 		}
 	}
 }
@@ -0,0 +1,230 @@
+package alfred
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a net.Error for testing the classification
+type testNetError struct {
+	timeout bool
+}
+
+func (e *testNetError) Error() string   { return "network error" }
+func (e *testNetError) Timeout() bool   { return e.timeout }
+func (e *testNetError) Temporary() bool { return false }
+
+func TestClassifyError(t *testing.T) {
+	other := errors.New("something else")
+	status := &StatusError{Tx: &TransactionMgmt{Id: 1}}
+	nettimeout := &testNetError{timeout: true}
+	netother := &testNetError{}
+	tests := []struct {
+		err     error
+		is      error
+		wrapped error
+	}{
+		{status, ErrStatus, nil},
+		{&ProtocolError{Err: ErrRead}, ErrProtocol, ErrRead},
+		{ErrRead, ErrProtocol, ErrRead},
+		{ErrUnknownType, ErrProtocol, ErrUnknownType},
+		{io.ErrUnexpectedEOF, ErrProtocol, io.ErrUnexpectedEOF},
+		{nettimeout, ErrTimeout, nettimeout},
+		{netother, netother, nil},
+		{other, other, nil},
+	}
+	for _, test := range tests {
+		err := classifyError(context.Background(), test.err)
+		if !errors.Is(err, test.is) {
+			t.Errorf("%v: classified as %v (%T), want %v", test.err, err, err, test.is)
+		}
+		if test.wrapped != nil && errors.Unwrap(err) != test.wrapped {
+			t.Errorf("%v: classified as %v wrapping %v", test.err, err, errors.Unwrap(err))
+		}
+	}
+	if err := classifyError(context.Background(), nil); err != nil {
+		t.Errorf("nil classified as %v", err)
+	}
+	timeout, ok := classifyError(context.Background(), nettimeout).(interface{ Timeout() bool })
+	if !ok || !timeout.Timeout() {
+		t.Errorf("timeout classified as %v, which is no timeout", timeout)
+	}
+	for _, err := range []error{status, &ProtocolError{}, &TimeoutError{Err: nettimeout}} {
+		if errors.Is(err, other) {
+			t.Errorf("%v matches an unrelated error", err)
+		}
+	}
+
+	// errors of the context take precedence
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := classifyError(ctx, ErrRead); err != context.Canceled {
+		t.Errorf("after cancelling, classified as %v", err)
+	}
+}
+
+// start a fake server on a Unix socket that handles each connection
+// with the given function, returns a client for it
+func fakeServer(t *testing.T, timeout time.Duration, handle func(conn net.Conn)) *Client {
+	address := filepath.Join(t.TempDir(), "alfred.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err, _ := Read(conn); err != nil {
+					return
+				}
+				handle(conn)
+			}()
+		}
+	}()
+	return NewClient("unix", address, &timeout)
+}
+
+func TestDataIterator(t *testing.T) {
+	client := fakeServer(t, time.Second, func(conn net.Conn) {
+		NewPushDataV0(&TransactionMgmt{Id: 1, SeqNo: 0},
+			[]Data{testData(1, 100, "one"), testData(2, 100, "two")}).Write(conn)
+		NewPushDataV0(&TransactionMgmt{Id: 1, SeqNo: 1},
+			[]Data{testData(3, 100, "three")}).Write(conn)
+	})
+	it, err := client.RequestIterator(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := []string{}
+	for it.Next() {
+		received = append(received, string(it.Data().Data))
+	}
+	it.Close()
+	if it.Err() != nil {
+		t.Errorf("iteration ended with %v", it.Err())
+	}
+	if len(received) != 3 || received[0] != "one" || received[2] != "three" {
+		t.Errorf("received %v", received)
+	}
+	if it.Next() {
+		t.Error("Next returned true after the end")
+	}
+
+	// closing early
+	it, err = client.RequestIterator(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatalf("no data: %v", it.Err())
+	}
+	it.Close()
+	if it.Next() || it.Err() != nil {
+		t.Errorf("after closing: got data or error %v", it.Err())
+	}
+}
+
+func TestDataIteratorErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  func(conn net.Conn)
+		is     error
+		status bool
+	}{
+		{"status", func(conn net.Conn) {
+			NewStatusV0(ALFRED_STATUS_ERROR, &TransactionMgmt{Id: 7, SeqNo: 0}).Write(conn)
+		}, ErrStatus, true},
+		{"unexpected packet", func(conn net.Conn) {
+			NewModeSwitchV0(ALFRED_MODESWITCH_MASTER).Write(conn)
+		}, ErrProtocol, false},
+		{"unknown type", func(conn net.Conn) {
+			(&TLV{Type: 200, Version: 0, Length: 0}).Write(conn)
+		}, ErrProtocol, false},
+		{"truncated", func(conn net.Conn) {
+			(&TLV{Type: ALFRED_PUSH_DATA, Version: 0, Length: 100}).Write(conn)
+			conn.Write([]byte{0, 1})
+		}, ErrProtocol, false},
+		{"no reply", func(conn net.Conn) {
+			time.Sleep(time.Second)
+		}, ErrTimeout, false},
+	}
+	for _, test := range tests {
+		client := fakeServer(t, 100*time.Millisecond, test.reply)
+		err := client.Request(100, func(Data) error { return nil })
+		if !errors.Is(err, test.is) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.is)
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) != test.status {
+			t.Errorf("%s: got %T", test.name, err)
+		} else if test.status && statusErr.Tx.Id != 7 {
+			t.Errorf("%s: got transaction %+v", test.name, statusErr.Tx)
+		}
+	}
+
+	// the context's deadline is used, and its error is reported
+	client := fakeServer(t, time.Minute, func(conn net.Conn) {
+		time.Sleep(time.Second)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	it, err := client.RequestIterator(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if it.Next() || it.Err() != context.DeadlineExceeded {
+		t.Errorf("got %v, want the context's error", it.Err())
+	}
+}
+
+func TestSubscribeContext(t *testing.T) {
+	// more events than the channel buffers
+	client := fakeServer(t, time.Second, func(conn net.Conn) {
+		for i := 0; i < 400; i++ {
+			if NewEventNotifyV0(uint8(100+i%2), HardwareAddr{2, 0, 0, 0, 0, 1}).Write(conn) != nil {
+				return
+			}
+		}
+		// wait for the client to hang up
+		conn.Read(make([]byte, 1))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	events, done, err := client.subscribe(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.Type != 100 {
+		t.Errorf("got event for type %d", event.Type)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// not reading events anymore must not keep the subscription
+	// from ending
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription still running after cancelling")
+	}
+	n := 0
+	for event := range events {
+		if event.Type != 100 {
+			t.Errorf("got event for type %d", event.Type)
+		}
+		n++
+	}
+	if n == 0 || n > 199 {
+		t.Errorf("got %d more events", n)
+	}
+}
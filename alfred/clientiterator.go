@@ -0,0 +1,109 @@
+package alfred
+
+// pull-style access to the data a server sends in reply to a request
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+)
+
+// Iterates over the data items received in reply to a request.
+//
+// Call Next to advance to the next item, which is then returned by
+// Data. When Next returns false, Err tells if the transfer ended
+// regularly (nil) or not. Close must be called when done, it can be
+// called early to abort the transfer.
+type DataIterator struct {
+	ctx     context.Context
+	conn    net.Conn
+	reader  *bufio.Reader
+	done    func()
+	pending []Data
+	current Data
+	err     error
+	ended   bool
+}
+
+// Request data of a given type, returning an iterator over the
+// received data items. The connection is closed when the context is
+// done.
+func (c *Client) RequestIterator(ctx context.Context, packettype uint8) (*DataIterator, error) {
+	conn, done, err := c.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := NewRequestV0(packettype, getRandomId())
+	if err := writePacket(bufio.NewWriter(conn), req); err != nil {
+		done()
+		return nil, classifyError(ctx, err)
+	}
+	return &DataIterator{
+		ctx:    ctx,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		done:   done,
+	}, nil
+}
+
+// advance to the next data item, returns false if there is none
+func (it *DataIterator) Next() bool {
+	for len(it.pending) == 0 {
+		if it.ended {
+			return false
+		}
+		pkg, err, _ := Read(it.reader)
+		switch {
+		case err == io.EOF:
+			// the server closes the connection at the end of the
+			// transaction
+			it.end(nil)
+		case err != nil:
+			it.end(err)
+		default:
+			switch pkg := pkg.(type) {
+			case *PushDataV0:
+				it.pending = pkg.Data
+			case *StatusV0:
+				if pkg.Header.Type == ALFRED_STATUS_ERROR {
+					it.end(&StatusError{Tx: pkg.Tx})
+				} else {
+					it.end(&ProtocolError{Packet: pkg})
+				}
+			default:
+				it.end(&ProtocolError{Packet: pkg})
+			}
+		}
+	}
+	it.current = it.pending[0]
+	it.pending = it.pending[1:]
+	return true
+}
+
+// the current data item
+func (it *DataIterator) Data() Data {
+	return it.current
+}
+
+// the error that ended the iteration, if any. A *StatusError if the
+// server reported an error, see ErrStatus for the others.
+func (it *DataIterator) Err() error {
+	return it.err
+}
+
+// close the connection, aborting the transfer if still running
+func (it *DataIterator) Close() error {
+	if !it.ended {
+		it.ended = true
+		it.pending = nil
+	}
+	it.done()
+	return nil
+}
+
+func (it *DataIterator) end(err error) {
+	it.ended = true
+	it.err = classifyError(it.ctx, err)
+	it.done()
+}
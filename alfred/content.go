@@ -0,0 +1,81 @@
+package alfred
+
+// registry of the Content implementations for data types, so that
+// tools can decode data of any type known to the program they are
+// part of
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var ErrUnknownContent = errors.New("no content registered for data type and version")
+
+// returns a new, empty Content item to read data into
+type ContentFactory func() Content
+
+// a data type and version a Content is registered for
+type ContentType struct {
+	Type    uint8
+	Version uint8
+}
+
+var contentRegistry = struct {
+	factories map[ContentType]ContentFactory
+	sync.RWMutex
+}{factories: make(map[ContentType]ContentFactory)}
+
+// Register a Content implementation for data of the given type and
+// version. This is meant to be called from the init function of the
+// package providing the implementation. Registering a type and version
+// twice panics.
+func RegisterContent(packettype uint8, version uint8, factory ContentFactory) {
+	contentRegistry.Lock()
+	defer contentRegistry.Unlock()
+	t := ContentType{Type: packettype, Version: version}
+	if _, exists := contentRegistry.factories[t]; exists {
+		panic(fmt.Sprintf("alfred: content for type %d version %d registered twice", packettype, version))
+	}
+	contentRegistry.factories[t] = factory
+}
+
+// return the factory registered for a data type and version
+func LookupContent(packettype uint8, version uint8) (ContentFactory, bool) {
+	contentRegistry.RLock()
+	defer contentRegistry.RUnlock()
+	factory, exists := contentRegistry.factories[ContentType{Type: packettype, Version: version}]
+	return factory, exists
+}
+
+// return the registered data types and versions, sorted
+func RegisteredContent() []ContentType {
+	contentRegistry.RLock()
+	types := make([]ContentType, 0, len(contentRegistry.factories))
+	for t, _ := range contentRegistry.factories {
+		types = append(types, t)
+	}
+	contentRegistry.RUnlock()
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Type != types[j].Type {
+			return types[i].Type < types[j].Type
+		}
+		return types[i].Version < types[j].Version
+	})
+	return types
+}
+
+// Decode a data item using the Content registered for its type and
+// version. Returns ErrUnknownContent if there is none.
+func DecodeContent(d Data) (Content, error) {
+	factory, exists := LookupContent(d.Header.Type, d.Header.Version)
+	if !exists {
+		return nil, ErrUnknownContent
+	}
+	content := factory()
+	if err := content.ReadAlfred(d); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
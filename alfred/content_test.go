@@ -0,0 +1,103 @@
+package alfred
+
+import (
+	"testing"
+)
+
+// content that keeps the payload as it is
+type testContent struct {
+	Payload string
+}
+
+func (c *testContent) GetPacketType() uint8 {
+	return 200
+}
+
+func (c *testContent) ReadAlfred(d Data) error {
+	if len(d.Data) == 0 {
+		return ErrInvalidLength
+	}
+	c.Payload = string(d.Data)
+	return nil
+}
+
+// register content for the duration of a test
+func registerTestContent(t *testing.T, packettype uint8, version uint8) {
+	RegisterContent(packettype, version, func() Content { return &testContent{} })
+	t.Cleanup(func() {
+		contentRegistry.Lock()
+		delete(contentRegistry.factories, ContentType{Type: packettype, Version: version})
+		contentRegistry.Unlock()
+	})
+}
+
+func TestRegisterContent(t *testing.T) {
+	registerTestContent(t, 200, 0)
+	factory, ok := LookupContent(200, 0)
+	if !ok {
+		t.Fatal("registered content not found")
+	}
+	if _, ok := factory().(*testContent); !ok {
+		t.Errorf("factory returned %T", factory())
+	}
+	if _, ok := LookupContent(200, 1); ok {
+		t.Error("found content for unregistered version")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering twice did not panic")
+		}
+	}()
+	RegisterContent(200, 0, func() Content { return &testContent{} })
+}
+
+func TestRegisteredContent(t *testing.T) {
+	registerTestContent(t, 201, 1)
+	registerTestContent(t, 200, 3)
+	registerTestContent(t, 201, 0)
+	types := RegisteredContent()
+	for i := 1; i < len(types); i++ {
+		a, b := types[i-1], types[i]
+		if a.Type > b.Type || (a.Type == b.Type && a.Version >= b.Version) {
+			t.Errorf("not sorted: %v", types)
+		}
+	}
+	found := []ContentType{}
+	for _, ct := range types {
+		if ct.Type == 200 || ct.Type == 201 {
+			found = append(found, ct)
+		}
+	}
+	want := []ContentType{{200, 3}, {201, 0}, {201, 1}}
+	if len(found) != len(want) {
+		t.Fatalf("got %v, want %v", found, want)
+	}
+	for i := range want {
+		if found[i] != want[i] {
+			t.Errorf("got %v, want %v", found, want)
+		}
+	}
+}
+
+func TestDecodeContent(t *testing.T) {
+	registerTestContent(t, 200, 0)
+	c, err := DecodeContent(testData(1, 200, "payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc, ok := c.(*testContent); !ok || tc.Payload != "payload" {
+		t.Errorf("got %#v", c)
+	}
+	if _, err := DecodeContent(testData(1, 202, "payload")); err != ErrUnknownContent {
+		t.Errorf("unknown type: got %v", err)
+	}
+	d := testData(1, 200, "payload")
+	d.Header.Version = 1
+	if _, err := DecodeContent(d); err != ErrUnknownContent {
+		t.Errorf("unknown version: got %v", err)
+	}
+	if _, err := DecodeContent(testData(1, 200, "")); err != ErrInvalidLength {
+		t.Errorf("invalid data: got %v", err)
+	}
+}
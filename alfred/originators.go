@@ -0,0 +1,223 @@
+package alfred
+
+// batman-adv originator information, used for choosing the nearest
+// master server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The parts of the batman-adv originator and global translation
+// tables that are needed to rate the connection to a given host
+type OriginatorTable struct {
+	// best TQ to the originators, by originator MAC address
+	Originators map[string]uint8
+	// originator MAC addresses, by client MAC address
+	Translations map[string]string
+}
+
+func NewOriginatorTable() *OriginatorTable {
+	return &OriginatorTable{
+		Originators:  make(map[string]uint8),
+		Translations: make(map[string]string),
+	}
+}
+
+// remember an originator's TQ, keeping the best one
+func (t *OriginatorTable) addOriginator(orig string, tq uint8) {
+	if tq > t.Originators[orig] {
+		t.Originators[orig] = tq
+	}
+}
+
+// return the TQ to the originator a MAC address belongs to, which is
+// either the originator itself or a client announced by it.
+// Returns 0 if unknown.
+func (t *OriginatorTable) TQ(mac HardwareAddr) uint8 {
+	addr := mac.String()
+	if tq, exists := t.Originators[addr]; exists {
+		return tq
+	}
+	if orig, exists := t.Translations[addr]; exists {
+		return t.Originators[orig]
+	}
+	return 0
+}
+
+// A source for batman-adv originator information
+type OriginatorSource interface {
+	Originators() (*OriginatorTable, error)
+}
+
+// Read originator information from the JSON output of batctl.
+type BatctlOriginatorSource struct {
+	// batctl command, defaults to "batctl"
+	Command string
+	// arguments for getting the originator table
+	OriginatorsArgs []string
+	// arguments for getting the global translation table, may be
+	// empty
+	TransglobalArgs []string
+}
+
+// return a source for running batctl for the given batman-adv
+// interface
+func NewBatctlOriginatorSource(batiface string) *BatctlOriginatorSource {
+	return &BatctlOriginatorSource{
+		Command:         "batctl",
+		OriginatorsArgs: []string{"meshif", batiface, "originators_json"},
+		TransglobalArgs: []string{"meshif", batiface, "transglobal_json"},
+	}
+}
+
+// entries of batctl's JSON output we're interested in
+type batctlOriginator struct {
+	OrigAddress string `json:"orig_address"`
+	TQ          uint8  `json:"tq"`
+}
+
+type batctlTransglobal struct {
+	Client string `json:"client"`
+	Orig   string `json:"orig"`
+	Best   bool   `json:"best"`
+}
+
+func (b *BatctlOriginatorSource) run(args []string, v interface{}) error {
+	command := b.Command
+	if command == "" {
+		command = "batctl"
+	}
+	out, err := exec.Command(command, args...).Output()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(out, v)
+}
+
+func (b *BatctlOriginatorSource) Originators() (*OriginatorTable, error) {
+	table := NewOriginatorTable()
+	originators := make([]batctlOriginator, 0)
+	if err := b.run(b.OriginatorsArgs, &originators); err != nil {
+		return nil, err
+	}
+	for _, o := range originators {
+		table.addOriginator(o.OrigAddress, o.TQ)
+	}
+	if len(b.TransglobalArgs) > 0 {
+		translations := make([]batctlTransglobal, 0)
+		if err := b.run(b.TransglobalArgs, &translations); err != nil {
+			return nil, err
+		}
+		for _, t := range translations {
+			if t.Best {
+				table.Translations[t.Client] = t.Orig
+			}
+		}
+	}
+	return table, nil
+}
+
+// Read originator information from text files in the format found in
+// batman-adv's debugfs directory (or batctl's non-JSON output).
+type FileOriginatorSource struct {
+	// file containing the originator table
+	OriginatorsFile string
+	// file containing the global translation table, may be empty
+	TransglobalFile string
+}
+
+// return a source for reading from a batman-adv debugfs directory,
+// e.g. /sys/kernel/debug/batman_adv/bat0
+func NewDebugfsOriginatorSource(dir string) *FileOriginatorSource {
+	return &FileOriginatorSource{
+		OriginatorsFile: dir + "/originators",
+		TransglobalFile: dir + "/transtable_global",
+	}
+}
+
+// matches TQ values like "(255)" or "(  1)"
+var tqPattern = regexp.MustCompile(`\(\s*(\d+)\)`)
+
+// return the MAC addresses found in a table line, and the first TQ
+// value, if any (-1 otherwise)
+func parseTableLine(line string) ([]string, int) {
+	macs := make([]string, 0)
+	for _, token := range strings.Fields(line) {
+		if mac, err := net.ParseMAC(token); err == nil && len(mac) == 6 {
+			macs = append(macs, mac.String())
+		}
+	}
+	tq := -1
+	if m := tqPattern.FindStringSubmatch(line); m != nil {
+		if v, err := strconv.Atoi(m[1]); err == nil && v <= 255 {
+			tq = v
+		}
+	}
+	return macs, tq
+}
+
+// parse an originator table
+func parseOriginators(r io.Reader, table *OriginatorTable) error {
+	// lines look like this:
+	// * 02:ba:7a:df:03:01    0.930s   (255) 02:ba:7a:df:03:01 [      eth0]: ...
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		macs, tq := parseTableLine(scanner.Text())
+		if len(macs) < 1 || tq < 0 {
+			// header lines
+			continue
+		}
+		table.addOriginator(macs[0], uint8(tq))
+	}
+	return scanner.Err()
+}
+
+// parse a global translation table
+func parseTransglobal(r io.Reader, table *OriginatorTable) error {
+	// lines look like this, only the ones marked with "*" are the
+	// best routes:
+	// * 02:ba:7a:df:04:01   -1 [....] (  1) 02:ba:7a:df:03:01 (  1) (0x95cb3b33)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "*") {
+			continue
+		}
+		macs, _ := parseTableLine(line)
+		if len(macs) < 2 {
+			continue
+		}
+		table.Translations[macs[0]] = macs[1]
+	}
+	return scanner.Err()
+}
+
+func (f *FileOriginatorSource) Originators() (*OriginatorTable, error) {
+	table := NewOriginatorTable()
+	data, err := ioutil.ReadFile(f.OriginatorsFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseOriginators(bytes.NewReader(data), table); err != nil {
+		return nil, err
+	}
+	if f.TransglobalFile != "" {
+		data, err := ioutil.ReadFile(f.TransglobalFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseTransglobal(bytes.NewReader(data), table); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
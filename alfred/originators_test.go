@@ -0,0 +1,162 @@
+package alfred
+
+import (
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// batman-adv 2019.2 debugfs output
+const debugfsOriginators = `[B.A.T.M.A.N. adv 2019.2, MainIF/MAC: eth0/02:ba:7a:df:01:01 (bat0/8e:4f:51:2a:1c:a7 BATMAN_IV)]
+  Originator        last-seen (#/255) Nexthop           [outgoingIF]
+ * 02:ba:7a:df:03:01    0.930s   (255) 02:ba:7a:df:03:01 [      eth0]
+   02:ba:7a:df:03:01    0.930s   (198) 02:ba:7a:df:02:01 [      eth1]
+ * 02:ba:7a:df:02:01    0.210s   (230) 02:ba:7a:df:02:01 [      eth1]
+   02:ba:7a:df:05:01    3.120s   (  7) 02:ba:7a:df:02:01 [      eth1]
+`
+
+const debugfsTransglobal = `[B.A.T.M.A.N. adv 2019.2, MainIF/MAC: eth0/02:ba:7a:df:01:01 (bat0/8e:4f:51:2a:1c:a7 BATMAN_IV)]
+Globally announced TT entries received via the mesh bat0
+       Client             VID Flags Last ttvn     Via        ttvn  (CRC       )
+ * 02:ba:7a:df:04:01   -1 [....] (  1) 02:ba:7a:df:03:01 (  1) (0x95cb3b33)
+ + 02:ba:7a:df:04:01   -1 [....] (  1) 02:ba:7a:df:02:01 (  1) (0x4f9a0c1d)
+ * 33:33:00:00:00:01   -1 [....] (  3) 02:ba:7a:df:02:01 (  3) (0x4f9a0c1d)
+`
+
+// batctl 2021.0 meshif bat0 originators_json / transglobal_json
+const batctlOriginatorsJSON = `[{"hard_ifindex":3,"hard_ifname":"eth0","orig_address":"02:ba:7a:df:03:01","neigh_address":"02:ba:7a:df:03:01","last_seen_msecs":930,"tq":255,"best":true},
+{"hard_ifindex":4,"hard_ifname":"eth1","orig_address":"02:ba:7a:df:03:01","neigh_address":"02:ba:7a:df:02:01","last_seen_msecs":930,"tq":198},
+{"hard_ifindex":4,"hard_ifname":"eth1","orig_address":"02:ba:7a:df:02:01","neigh_address":"02:ba:7a:df:02:01","last_seen_msecs":210,"tq":230,"best":true},
+{"hard_ifindex":4,"hard_ifname":"eth1","orig_address":"02:ba:7a:df:05:01","neigh_address":"02:ba:7a:df:02:01","last_seen_msecs":3120,"tq":7}]
+`
+
+const batctlTransglobalJSON = `[{"client":"02:ba:7a:df:04:01","orig":"02:ba:7a:df:03:01","vid":-1,"ttvn":1,"last_ttvn":1,"crc32":2513124147,"flags":0,"best":true},
+{"client":"02:ba:7a:df:04:01","orig":"02:ba:7a:df:02:01","vid":-1,"ttvn":1,"last_ttvn":1,"crc32":1335495709,"flags":0},
+{"client":"33:33:00:00:00:01","orig":"02:ba:7a:df:02:01","vid":-1,"ttvn":3,"last_ttvn":3,"crc32":1335495709,"flags":0,"best":true}]
+`
+
+// what both formats above amount to
+var sampleTable = &OriginatorTable{
+	Originators: map[string]uint8{
+		"02:ba:7a:df:03:01": 255,
+		"02:ba:7a:df:02:01": 230,
+		"02:ba:7a:df:05:01": 7,
+	},
+	Translations: map[string]string{
+		"02:ba:7a:df:04:01": "02:ba:7a:df:03:01",
+		"33:33:00:00:00:01": "02:ba:7a:df:02:01",
+	},
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestParseTableLine(t *testing.T) {
+	tests := []struct {
+		line string
+		macs []string
+		tq   int
+	}{
+		{" * 02:ba:7a:df:03:01    0.930s   (255) 02:ba:7a:df:03:01 [      eth0]",
+			[]string{"02:ba:7a:df:03:01", "02:ba:7a:df:03:01"}, 255},
+		{"   02:BA:7A:DF:05:01    3.120s   (  7) 02:ba:7a:df:02:01 [      eth1]",
+			[]string{"02:ba:7a:df:05:01", "02:ba:7a:df:02:01"}, 7},
+		{"  Originator        last-seen (#/255) Nexthop           [outgoingIF]", []string{}, -1},
+		{"[B.A.T.M.A.N. adv 2019.2, MainIF/MAC: eth0/02:ba:7a:df:01:01 (bat0/8e:4f:51:2a:1c:a7 BATMAN_IV)]", []string{}, -1},
+		{" * 02:ba:7a:df:03:01    0.930s   (256) 02:ba:7a:df:03:01", []string{"02:ba:7a:df:03:01", "02:ba:7a:df:03:01"}, -1},
+		{"", []string{}, -1},
+	}
+	for _, test := range tests {
+		macs, tq := parseTableLine(test.line)
+		if !reflect.DeepEqual(macs, test.macs) || tq != test.tq {
+			t.Errorf("%q: got %v %d, want %v %d", test.line, macs, tq, test.macs, test.tq)
+		}
+	}
+}
+
+func TestParseDebugfs(t *testing.T) {
+	table := NewOriginatorTable()
+	if err := parseOriginators(strings.NewReader(debugfsOriginators), table); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseTransglobal(strings.NewReader(debugfsTransglobal), table); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(table, sampleTable) {
+		t.Errorf("got %+v, want %+v", table, sampleTable)
+	}
+}
+
+func TestFileOriginatorSource(t *testing.T) {
+	f := &FileOriginatorSource{
+		OriginatorsFile: writeFile(t, "originators", debugfsOriginators),
+		TransglobalFile: writeFile(t, "transtable_global", debugfsTransglobal),
+	}
+	table, err := f.Originators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(table, sampleTable) {
+		t.Errorf("got %+v, want %+v", table, sampleTable)
+	}
+	f.TransglobalFile = ""
+	if table, err := f.Originators(); err != nil || len(table.Translations) != 0 {
+		t.Errorf("without translation table: %+v, %v", table, err)
+	}
+	f.OriginatorsFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := f.Originators(); err == nil {
+		t.Error("missing file not reported")
+	}
+}
+
+func TestBatctlOriginatorSource(t *testing.T) {
+	// stands in for batctl, printing the files given as arguments
+	cat, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip("no cat command")
+	}
+	b := &BatctlOriginatorSource{
+		Command:         cat,
+		OriginatorsArgs: []string{writeFile(t, "originators.json", batctlOriginatorsJSON)},
+		TransglobalArgs: []string{writeFile(t, "transglobal.json", batctlTransglobalJSON)},
+	}
+	table, err := b.Originators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(table, sampleTable) {
+		t.Errorf("got %+v, want %+v", table, sampleTable)
+	}
+	b.TransglobalArgs = []string{writeFile(t, "broken.json", `[{"client":`)}
+	if _, err := b.Originators(); err == nil {
+		t.Error("broken JSON not reported")
+	}
+}
+
+func TestOriginatorTableTQ(t *testing.T) {
+	tests := []struct {
+		mac string
+		tq  uint8
+	}{
+		{"02:ba:7a:df:03:01", 255},
+		{"02:ba:7a:df:05:01", 7},
+		// a client, via its originator
+		{"02:ba:7a:df:04:01", 255},
+		{"02:ba:7a:df:09:01", 0},
+	}
+	for _, test := range tests {
+		mac, _ := net.ParseMAC(test.mac)
+		if tq := sampleTable.TQ(HardwareAddr(mac)); tq != test.tq {
+			t.Errorf("%v: got TQ %d, want %d", test.mac, tq, test.tq)
+		}
+	}
+}
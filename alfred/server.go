@@ -3,10 +3,9 @@ package alfred
 // an implementation of an A.L.F.R.E.D. server
 
 import (
-	"bufio"
 	"github.com/tv42/topic"
 	"log"
-	"net"
+	"sort"
 	"sync"
 	"time"
 )
@@ -43,46 +42,103 @@ type Server struct {
 	TransactionMaxAge time.Duration
 	// interval between checks
 	TransactionPurgeInterval time.Duration
+	// limits for transactions started by other hosts
+	TransactionLimits TransactionLimits
 	// wait this duration for a reply of a master server
 	// after forwarding a (client) request to it
 	WaitForMasterReply time.Duration
 	// interval between data synchronization pushes to other
 	// master servers
 	SyncInterval time.Duration
+	// consider the server warm after this time, even if other
+	// masters are still being asked for their data
+	WarmUpTime time.Duration
 	// should we drop transactions that are not complete?
 	// defaults to true, and should better be left that way
 	// except your data/network policy mandates differently
 	DropIncompleteTransactions bool
 	// operation mode
 	Mode int
+	// name of the batman-adv interface, only reported in status
+	// information
+	BatInterface string
+	// strategy for choosing the master to sync to and to forward
+	// requests to, defaults to the one seen most recently
+	MasterSelection MasterSelection
+	// event notifications that cannot be written to a stream client
+	// within this time end its connection
+	EventWriteTimeout time.Duration
+	// shared secret for signing the transactions sent to other
+	// servers via UDP. If set, data from other hosts is only
+	// propagated further when it came with a valid signature, and
+	// unsigned data never replaces signed data.
+	SyncSecret []byte
+	// signed transactions are only accepted if they were signed
+	// no more than this time before (or, allowing for clock
+	// differences, after) they are received, and only once
+	SignatureMaxAge time.Duration
+	// packet I/O towards other servers, defaults to the operating
+	// system's UDP sockets. Must be set before adding UDP listeners.
+	Transport Transport
 	// data store
 	store *Store
-	// stores the first handled packet interface's hardware address
-	// which is then used as the source identifier for local packets
-	firstInterface HardwareAddr
+	// file to persist the data store in, if set
+	storeFile string
 	// spawned tasks can register here to get notified upon shutdown
 	notifyQuit *topic.Topic
 	// spawned tasks should register here to be waited for upon shutdown
 	wg sync.WaitGroup
 	// bookkeeping of transactions, masters, listeners
-	transactions    map[uint16]*transaction
-	masters         map[string]*master
-	listenersudp    map[*listenerUDP]struct{}
-	listenersstream map[*listenerStream]struct{}
+	transactions map[transactionKey]*transaction
+	// number of open transactions, by the host that started them
+	transactionSources map[string]int
+	// set on shutdown, once the open transactions have been stopped
+	transactionsClosed bool
+	masters            map[string]*master
+	listenersudp       map[*listenerUDP]struct{}
+	listenersstream    map[*listenerStream]struct{}
+	listenershttp      map[*listenerHTTP]struct{}
+	// signatures of transactions from other hosts seen recently
+	replays replayGuard
+	// counters for monitoring
+	metrics metrics
+	// set when data of other masters has been fetched after start
+	warm bool
+	// warm-up phase: number of masters that are still being asked
+	// for their data, and whether other masters had the time to
+	// announce themselves
+	warmPending int
+	warmSettled bool
 	sync.Mutex
 }
 
+// UDP address used when the server is asked to listen on new
+// interfaces and there is no other address to refer to
+const DEFAULT_UDP_ADDRESS = "[ff02::1]:16962"
+
 var maxDatagramSize = 0xFFFF
 
 // run a new server instance
 // Select an operation mode in "mode"
 func NewServer(mode int) *Server {
+	return NewServerConfig(mode, nil)
+}
+
+// run a new server instance, calling configure (if not nil) before the
+// background tasks are started. This allows e.g. loading a store
+// snapshot with PersistStore, so the server does not answer requests
+// or sync to others with an empty store first, or changing the
+// intervals the tasks run in and the transport, e.g. for simulating a
+// network of servers in a single process.
+func NewServerConfig(mode int, configure func(s *Server)) *Server {
 	server := &Server{
 		store:                    NewStore(time.Minute*10, time.Second*20),
-		transactions:             make(map[uint16]*transaction),
+		transactions:             make(map[transactionKey]*transaction),
+		transactionSources:       make(map[string]int),
 		masters:                  make(map[string]*master),
 		listenersudp:             make(map[*listenerUDP]struct{}),
 		listenersstream:          make(map[*listenerStream]struct{}),
+		listenershttp:            make(map[*listenerHTTP]struct{}),
 		MaxPayload:               maxDatagramSize - 8,
 		AnnouncementInterval:     time.Second * 10,
 		MasterMaxAge:             time.Minute * 2,
@@ -92,15 +148,29 @@ func NewServer(mode int) *Server {
 		TransactionPurgeInterval: time.Second * 3,
 		WaitForMasterReply:       time.Second * 10,
 		SyncInterval:             time.Second * 10,
+		WarmUpTime:               time.Second * 30,
+		SignatureMaxAge:          time.Minute * 2,
+		EventWriteTimeout:        time.Second * 10,
 		Mode:                     mode,
+		MasterSelection:          &LastSeenMasterSelection{},
+		Transport:                &UDPTransport{},
 		DropIncompleteTransactions: true,
 		notifyQuit:                 topic.New(),
+		TransactionLimits: TransactionLimits{
+			MaxOpen:          1024,
+			MaxOpenPerSource: 64,
+			MaxBytes:         16 * 1024 * 1024,
+		},
+	}
+	if configure != nil {
+		configure(server)
 	}
 	// start background tasks:
 	server.purgeMasterTask(server.MasterMaxAge, server.MasterPurgeInterval)
 	server.purgeTransactionTask(server.TransactionMaxAge, server.TransactionPurgeInterval)
 	server.announceMaster(server.AnnouncementInterval)
 	server.syncToMasters(server.SyncInterval)
+	server.warmUpTask(server.AnnouncementInterval, server.WarmUpTime)
 	return server
 }
 
@@ -115,39 +185,94 @@ func (s *Server) Shutdown() {
 	for l, _ := range s.listenersstream {
 		l.quit <- struct{}{}
 	}
+	for l, _ := range s.listenershttp {
+		l.quit <- struct{}{}
+	}
 	s.Unlock()
 	// shutdown all background tasks
 	log.Printf("alfred/server: waiting for tasks to finish")
 	s.notifyQuit.Broadcast <- struct{}{}
-	// shutdown the data store
-	s.store.Shutdown()
-	// wait for everything to finish
 	s.wg.Wait()
+	// persist and shutdown the data store, after the tasks that
+	// use it are gone
+	s.saveStore()
+	s.store.Shutdown()
+}
+
+// Set the time to keep data of a given type, see Store.SetRetention
+func (s *Server) SetRetention(packettype uint8, ttl time.Duration) {
+	s.store.SetRetention(packettype, ttl)
+}
+
+// Set limits for data from other hosts, see Store.SetLimits
+func (s *Server) SetLimits(limits StoreLimits) {
+	s.store.SetLimits(limits)
+}
+
+// compile status information in reply to a status request
+func (s *Server) status(tx *TransactionMgmt) *ServerStatusRepV0 {
+	netifaces := make([]ServerStatusNetIface, 0)
+	for _, l := range s.getListenersUDP() {
+		if l.unicast {
+			continue
+		}
+		netifaces = append(netifaces, ServerStatusNetIface{Name: l.ifname, Active: true})
+	}
+	status := NewServerStatusRepV0(
+		&TransactionMgmt{Id: tx.Id, SeqNo: 0},
+		uint8(s.Mode), netifaces, s.BatInterface)
+	warm := s.IsWarm()
+	status.Warm = &warm
+	for t, ttl := range s.store.Retention() {
+		status.Retention = append(status.Retention, ServerStatusRetention{Type: t, TTL: ttl})
+	}
+	sort.Slice(status.Retention, func(i, j int) bool {
+		return status.Retention[i].Type < status.Retention[j].Type
+	})
+	return status
 }
 
 // generic data sender task
-// this will send data items arriving on a channel over a given connection,
-// setting the transaction ID to a given value.
+// this will send data items arriving on a channel using the given
+// send function, setting the transaction ID to a given value.
 // it will operate in "single data packet" mode for communicating with
 // stream clients and will collect data for sending large packets
 // over packet sockets (UDP).
-func (s *Server) sendData(c net.Conn, txid uint16, data <-chan Data, single bool) {
-	defer c.Close()
-	cbuf := bufio.NewWriter(c)
+// Local data that has no source address set yet will be sent with the
+// given source address. If that is not set either, it is skipped.
+// Replies to requests via UDP are finished with a final packet even if
+// there is no data, so the requesting server knows it has got it all.
+func (s *Server) sendData(send func(Packet) error, txid uint16, data <-chan Data, single bool, reply bool, source HardwareAddr) {
+	// make sure the sending side (i.e. the store) does not block when
+	// we bail out early
+	defer func() {
+		for _ = range data {
+		}
+	}()
 	tm := &TransactionMgmt{Id: txid, SeqNo: 0}
 	pd := NewPushDataV0(tm, make([]Data, 0))
+	var signer *TransactionSigner
+	if !single && s.SyncSecret != nil {
+		signer = NewTransactionSigner(s.SyncSecret)
+	}
 	for d := range data {
+		if d.Source.IsUnset() {
+			if source.IsUnset() {
+				log.Printf("alfred/server: have no interface address for local data, skipping.")
+				continue
+			}
+			d.Source = source
+		}
 		if (single && len(pd.Data) > 0) || (pd.Size()+d.Size() > s.MaxPayload) {
 			// adding this packet would lead to a too large packet, so
 			// first send what we have collected for now
-			err := pd.Write(cbuf)
-			if err == nil {
-				err = cbuf.Flush()
-			}
-			if err != nil {
-				log.Printf("alfred/server: error sending data to %v: %v", c, err)
+			if err := send(pd); err != nil {
+				log.Printf("alfred/server: error sending data: %v", err)
 				return
 			}
+			if signer != nil {
+				signer.Add(pd)
+			}
 			// reset data store
 			pd.Data = make([]Data, 0)
 			// increment sequence number
@@ -163,27 +288,31 @@ func (s *Server) sendData(c net.Conn, txid uint16, data <-chan Data, single bool
 	// check if there's unsent data cached
 	if len(pd.Data) > 0 {
 		// yes, so send it
-		err := pd.Write(cbuf)
-		if err == nil {
-			err = cbuf.Flush()
-		}
-		if err != nil {
-			log.Printf("alfred/server: error sending data to %v: %v", c, err)
+		if err := send(pd); err != nil {
+			log.Printf("alfred/server: error sending data: %v", err)
 			return
 		}
+		if signer != nil {
+			signer.Add(pd)
+		}
 		tm.SeqNo++
 	}
-	if !single && tm.SeqNo > 0 {
+	if signer != nil && tm.SeqNo > 0 {
+		// the signature needs to be there before the final packet
+		// is handled by the receiver
+		sig := signer.Sign(tm)
+		if err := send(sig); err != nil {
+			log.Printf("alfred/server: error sending data: %v", err)
+			return
+		}
+	}
+	if !single && (tm.SeqNo > 0 || reply) {
 		// when in packet transport mode (UDP), send a final
 		// packet that signals completion (and states the number of
 		// sequential packets that were sent)
 		stat := NewStatusV0(ALFRED_STATUS_TXEND, tm)
-		err := stat.Write(cbuf)
-		if err == nil {
-			err = cbuf.Flush()
-		}
-		if err != nil {
-			log.Printf("alfred/server: error sending data to %v: %v", c, err)
+		if err := send(stat); err != nil {
+			log.Printf("alfred/server: error sending data: %v", err)
 			return
 		}
 	}
@@ -0,0 +1,499 @@
+package alfred
+
+// A.L.F.R.E.D. server: HTTP API for inspecting the server's state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// information about a listener of the server
+type ListenerInfo struct {
+	// "udp", "stream" or "http"
+	Kind    string
+	Network string
+	Address string
+	// interface of UDP listeners, empty for those talking to static
+	// peers
+	Interface string
+	// static peers of UDP listeners
+	Peers []string
+	// time a UDP listener was started
+	Since time.Time
+	// stream listener is TLS secured
+	TLS bool
+	// stream listener has an access policy
+	Restricted bool
+	// what a HTTP listener serves
+	Serves string
+}
+
+// return information about the listeners of the server
+func (s *Server) Listeners() []ListenerInfo {
+	s.Lock()
+	defer s.Unlock()
+	infos := make([]ListenerInfo, 0)
+	for l, _ := range s.listenersudp {
+		info := ListenerInfo{
+			Kind:      "udp",
+			Network:   "udp6",
+			Address:   l.address,
+			Interface: l.ifname,
+			Since:     l.since,
+		}
+		if l.listen != nil {
+			info.Address = l.listen.LocalAddr().String()
+		}
+		for _, p := range l.peers {
+			info.Peers = append(info.Peers, p.String())
+		}
+		infos = append(infos, info)
+	}
+	for l, _ := range s.listenersstream {
+		infos = append(infos, ListenerInfo{
+			Kind:       "stream",
+			Network:    l.listener.Addr().Network(),
+			Address:    l.listener.Addr().String(),
+			TLS:        l.secure,
+			Restricted: l.policy != nil,
+		})
+	}
+	for l, _ := range s.listenershttp {
+		infos = append(infos, ListenerInfo{
+			Kind:    "http",
+			Network: l.listener.Addr().Network(),
+			Address: l.listener.Addr().String(),
+			Serves:  l.name,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Kind != infos[j].Kind {
+			return infos[i].Kind < infos[j].Kind
+		}
+		return infos[i].Address < infos[j].Address
+	})
+	return infos
+}
+
+// return a view of the data store contents
+func (s *Server) StoreView() *StoreView {
+	return s.store.View()
+}
+
+// store entry as reported by the admin API
+type adminStoreEntry struct {
+	Source      HardwareAddr      `json:"source"`
+	Type        uint8             `json:"type"`
+	Version     uint8             `json:"version"`
+	Size        int               `json:"size"`
+	Local       bool              `json:"local"`
+	Unverified  bool              `json:"unverified"`
+	Expires     time.Time         `json:"expires"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Payload     []byte            `json:"payload,omitempty"`
+	// payload decoded by the Content registered for its type
+	Content      Content `json:"content,omitempty"`
+	ContentError string  `json:"content_error,omitempty"`
+}
+
+type adminMaster struct {
+	Address   string    `json:"address"`
+	Interface string    `json:"interface,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type adminTransaction struct {
+	Id     uint16    `json:"id"`
+	Source string    `json:"source,omitempty"`
+	Local  bool      `json:"local"`
+	Start  time.Time `json:"start"`
+	SeqNos []uint16  `json:"seqnos"`
+	Bytes  int       `json:"bytes"`
+	// only known when the final packet has arrived
+	FinalSeqNo *int     `json:"final_seqno,omitempty"`
+	Missing    []uint16 `json:"missing,omitempty"`
+	Signed     bool     `json:"signed"`
+}
+
+type adminListener struct {
+	Kind       string     `json:"kind"`
+	Network    string     `json:"network"`
+	Address    string     `json:"address"`
+	Interface  string     `json:"interface,omitempty"`
+	Peers      []string   `json:"peers,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+	TLS        bool       `json:"tls,omitempty"`
+	Restricted bool       `json:"restricted,omitempty"`
+	Serves     string     `json:"serves,omitempty"`
+}
+
+// return a HTTP handler that serves the admin API.
+// It offers read-only access to the server's state, but that
+// includes all data, so it should not be exposed to untrusted
+// networks. Lists are returned as text tables, or as JSON when
+// the "format=json" query parameter is given or JSON is accepted.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.adminIndex)
+	mux.HandleFunc("/store", s.adminStore)
+	mux.HandleFunc("/store/", s.adminPayload)
+	mux.HandleFunc("/masters", s.adminMasters)
+	mux.HandleFunc("/transactions", s.adminTransactions)
+	mux.HandleFunc("/listeners", s.adminListeners)
+	return allowRead(mux)
+}
+
+// start a task serving the admin API via HTTP on a TCP address,
+// see AdminHandler
+func (s *Server) NewListenerAdmin(address string) error {
+	return s.newListenerHTTP("admin", address, s.AdminHandler())
+}
+
+// only allow GET and HEAD requests
+func allowRead(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// check if JSON output is requested
+func wantJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// return a tabwriter for writing a text table
+func textTable(w http.ResponseWriter) *tabwriter.Writer {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	return tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+}
+
+// format a time for text output, relative to now
+func adminTime(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := t.Sub(now).Round(time.Second)
+	if d <= 0 {
+		return fmt.Sprintf("%s (%v ago)", t.Format(time.RFC3339), -d)
+	}
+	return fmt.Sprintf("%s (in %v)", t.Format(time.RFC3339), d)
+}
+
+func yesno(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// format annotations as a sorted list of key=value pairs
+func notes(annotations map[string]string) string {
+	if len(annotations) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(annotations))
+	for k, v := range annotations {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// format a sorted list of sequence numbers as ranges, e.g. "0-3,5"
+func seqRanges(seqnos []uint16) string {
+	if len(seqnos) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0)
+	for i := 0; i < len(seqnos); {
+		j := i
+		for j+1 < len(seqnos) && seqnos[j+1] == seqnos[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(int(seqnos[i])))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", seqnos[i], seqnos[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *Server) adminIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, `A.L.F.R.E.D. server
+
+/store                  data store entries, filter with ?type=<type>&source=<mac>
+/store/<source>/<type>  raw payload of a store entry, as JSON along with
+                        its metadata and the decoded content if the
+                        data type is known
+/masters                known master servers
+/transactions           open transactions
+/listeners              listeners of the server
+
+Add ?format=json for JSON output.
+`)
+}
+
+func (s *Server) adminStore(w http.ResponseWriter, r *http.Request) {
+	var source *HardwareAddr
+	typefilter := -1
+	if v := r.URL.Query().Get("source"); v != "" {
+		source = &HardwareAddr{}
+		if err := source.Parse(v); err != nil {
+			http.Error(w, "invalid source address", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("type"); v != "" {
+		t, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			http.Error(w, "invalid data type", http.StatusBadRequest)
+			return
+		}
+		typefilter = int(t)
+	}
+	view := s.store.View()
+	entries := make([]adminStoreEntry, 0)
+	view.ForEach(func(e StoreEntry) bool {
+		if source != nil && !bytes.Equal(*source, e.Source) {
+			return true
+		}
+		if typefilter >= 0 && int(e.Header.Type) != typefilter {
+			return true
+		}
+		entries = append(entries, adminStoreEntry{
+			Source:      e.Source,
+			Type:        e.Header.Type,
+			Version:     e.Header.Version,
+			Size:        len(e.Data.Data),
+			Local:       e.Local,
+			Unverified:  e.Unverified,
+			Expires:     e.Expires,
+			Annotations: e.Annotations,
+		})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if c := bytes.Compare(entries[i].Source, entries[j].Source); c != 0 {
+			return c < 0
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	if wantJSON(r) {
+		writeJSON(w, entries)
+		return
+	}
+	tw := textTable(w)
+	fmt.Fprintln(tw, "SOURCE\tTYPE\tVERSION\tSIZE\tLOCAL\tUNVERIFIED\tEXPIRES\tNOTES")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%v\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", e.Source, e.Type, e.Version,
+			e.Size, yesno(e.Local), yesno(e.Unverified), adminTime(e.Expires, view.Time),
+			notes(e.Annotations))
+	}
+	tw.Flush()
+}
+
+// serve the payload of a store entry at /store/<source>/<type>
+func (s *Server) adminPayload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/store/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	var source HardwareAddr
+	if err := source.Parse(parts[0]); err != nil {
+		http.Error(w, "invalid source address", http.StatusBadRequest)
+		return
+	}
+	t, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		http.Error(w, "invalid data type", http.StatusBadRequest)
+		return
+	}
+	e, exists := s.store.View().Get(source, uint8(t))
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	if wantJSON(r) {
+		entry := adminStoreEntry{
+			Source:      e.Source,
+			Type:        e.Header.Type,
+			Version:     e.Header.Version,
+			Size:        len(e.Data.Data),
+			Local:       e.Local,
+			Unverified:  e.Unverified,
+			Expires:     e.Expires,
+			Annotations: e.Annotations,
+			Payload:     e.Data.Data,
+		}
+		content, err := DecodeContent(e.Data)
+		if err == nil {
+			entry.Content = content
+		} else if err != ErrUnknownContent {
+			entry.ContentError = err.Error()
+		}
+		writeJSON(w, entry)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.Data.Data)))
+	w.Header().Set("X-Alfred-Version", strconv.Itoa(int(e.Header.Version)))
+	w.Write(e.Data.Data)
+}
+
+func (s *Server) adminMasters(w http.ResponseWriter, r *http.Request) {
+	masters := make([]adminMaster, 0)
+	for _, m := range s.Masters() {
+		masters = append(masters, adminMaster{
+			Address:   m.Address.String(),
+			Interface: m.Interface,
+			FirstSeen: m.FirstSeen,
+			LastSeen:  m.LastSeen,
+		})
+	}
+	if wantJSON(r) {
+		writeJSON(w, masters)
+		return
+	}
+	now := time.Now()
+	tw := textTable(w)
+	fmt.Fprintln(tw, "ADDRESS\tINTERFACE\tFIRST SEEN\tLAST SEEN")
+	for _, m := range masters {
+		iface := m.Interface
+		if iface == "" {
+			iface = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Address, iface,
+			adminTime(m.FirstSeen, now), adminTime(m.LastSeen, now))
+	}
+	tw.Flush()
+}
+
+func (s *Server) adminTransactions(w http.ResponseWriter, r *http.Request) {
+	transactions := make([]adminTransaction, 0)
+	for _, t := range s.Transactions() {
+		at := adminTransaction{
+			Id:     t.Id,
+			Source: t.Source,
+			Local:  t.Local,
+			Start:  t.Start,
+			SeqNos: t.SeqNos,
+			Bytes:  t.Bytes,
+			Signed: t.Signed,
+		}
+		if t.FinalSeqNo >= 0 {
+			final := t.FinalSeqNo
+			at.FinalSeqNo = &final
+			received := make(map[uint16]struct{}, len(t.SeqNos))
+			for _, seqno := range t.SeqNos {
+				received[seqno] = struct{}{}
+			}
+			for i := 0; i < final; i++ {
+				if _, exists := received[uint16(i)]; !exists {
+					at.Missing = append(at.Missing, uint16(i))
+				}
+			}
+		}
+		transactions = append(transactions, at)
+	}
+	if wantJSON(r) {
+		writeJSON(w, transactions)
+		return
+	}
+	now := time.Now()
+	tw := textTable(w)
+	fmt.Fprintln(tw, "ID\tSOURCE\tLOCAL\tSTARTED\tRECEIVED\tBYTES\tFINAL\tMISSING\tSIGNED")
+	for _, t := range transactions {
+		source, final := t.Source, "-"
+		if source == "" {
+			source = "-"
+		}
+		if t.FinalSeqNo != nil {
+			final = strconv.Itoa(*t.FinalSeqNo)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", t.Id, source, yesno(t.Local),
+			adminTime(t.Start, now), seqRanges(t.SeqNos), t.Bytes, final,
+			seqRanges(t.Missing), yesno(t.Signed))
+	}
+	tw.Flush()
+}
+
+func (s *Server) adminListeners(w http.ResponseWriter, r *http.Request) {
+	listeners := make([]adminListener, 0)
+	for _, l := range s.Listeners() {
+		al := adminListener{
+			Kind:       l.Kind,
+			Network:    l.Network,
+			Address:    l.Address,
+			Interface:  l.Interface,
+			Peers:      l.Peers,
+			TLS:        l.TLS,
+			Restricted: l.Restricted,
+			Serves:     l.Serves,
+		}
+		if !l.Since.IsZero() {
+			since := l.Since
+			al.Since = &since
+		}
+		listeners = append(listeners, al)
+	}
+	if wantJSON(r) {
+		writeJSON(w, listeners)
+		return
+	}
+	now := time.Now()
+	tw := textTable(w)
+	fmt.Fprintln(tw, "KIND\tNETWORK\tADDRESS\tDETAILS")
+	for _, l := range listeners {
+		details := make([]string, 0)
+		if l.Interface != "" {
+			details = append(details, "interface "+l.Interface)
+		}
+		if len(l.Peers) > 0 {
+			details = append(details, "peers "+strings.Join(l.Peers, ","))
+		}
+		if l.Since != nil {
+			details = append(details, "since "+adminTime(*l.Since, now))
+		}
+		if l.TLS {
+			details = append(details, "TLS")
+		}
+		if l.Restricted {
+			details = append(details, "restricted by policy")
+		}
+		if l.Serves != "" {
+			details = append(details, "serves "+l.Serves)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", l.Kind, l.Network, l.Address, strings.Join(details, ", "))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,203 @@
+package alfred
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a master with data from two sources and another master next to it
+func adminServer(t *testing.T) *Server {
+	bus := NewMemoryBus(1)
+	s := memoryServer(t, bus, SERVER_MODE_MASTER, 1, func(s *Server) {
+		s.TransactionMaxAge = time.Minute
+		// long enough for inspecting an incomplete transaction
+		s.TransactionWaitComplete = time.Second
+	})
+	memoryServer(t, bus, SERVER_MODE_MASTER, 2, nil)
+	putLocal(s, testData(1, 100, "local data"))
+	s.store.Request(ReqPut{Data: testData(3, 101, "remote")})
+	if !waitFor(2*time.Second, func() bool { return knowsMaster(s, 2) }) {
+		t.Fatal("other master not seen")
+	}
+	return s
+}
+
+func adminGet(s *Server, path string, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, r)
+	return w
+}
+
+// get a list as JSON
+func adminList(t *testing.T, s *Server, path string, v interface{}) {
+	w := adminGet(s, path, "application/json")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("%s: status %d, content type %q", path, w.Code, w.Header().Get("Content-Type"))
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+func TestAdminStore(t *testing.T) {
+	s := adminServer(t)
+	entries := []adminStoreEntry{}
+	adminList(t, s, "/store", &entries)
+	if len(entries) != 2 {
+		t.Fatalf("got %+v", entries)
+	}
+	if e := entries[0]; e.Source.String() != "02:00:00:00:00:01" || e.Type != 100 || e.Size != 10 || !e.Local || e.Payload != nil {
+		t.Errorf("got %+v", e)
+	}
+	if e := entries[1]; e.Source.String() != "02:00:00:00:00:03" || e.Local || e.Expires.IsZero() {
+		t.Errorf("got %+v", e)
+	}
+
+	tests := []struct {
+		query   string
+		sources []string
+	}{
+		{"type=101", []string{"02:00:00:00:00:03"}},
+		{"type=102", []string{}},
+		{"source=02:00:00:00:00:01", []string{"02:00:00:00:00:01"}},
+		{"source=02:00:00:00:00:01&type=101", []string{}},
+	}
+	for _, test := range tests {
+		entries := []adminStoreEntry{}
+		adminList(t, s, "/store?format=json&"+test.query, &entries)
+		sources := make([]string, 0)
+		for _, e := range entries {
+			sources = append(sources, e.Source.String())
+		}
+		if strings.Join(sources, " ") != strings.Join(test.sources, " ") {
+			t.Errorf("%s: got %v, want %v", test.query, sources, test.sources)
+		}
+	}
+
+	w := adminGet(s, "/store?type=100", "")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || len(lines) != 2 || !strings.HasPrefix(lines[0], "SOURCE") ||
+		!strings.HasPrefix(lines[1], "02:00:00:00:00:01  100") {
+		t.Errorf("got text table %q", w.Body)
+	}
+	for _, query := range []string{"type=256", "type=x", "source=02:00"} {
+		if w := adminGet(s, "/store?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, w.Code)
+		}
+	}
+}
+
+func TestAdminPayload(t *testing.T) {
+	s := adminServer(t)
+	w := adminGet(s, "/store/02:00:00:00:00:03/101", "")
+	if w.Code != http.StatusOK || w.Body.String() != "remote" {
+		t.Fatalf("status %d, payload %q", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != "application/octet-stream" || w.Header().Get("X-Alfred-Version") != "0" {
+		t.Errorf("headers %v", w.Header())
+	}
+
+	e := adminStoreEntry{}
+	adminList(t, s, "/store/02-00-00-00-00-01/100", &e)
+	if !bytes.Equal(e.Payload, []byte("local data")) || !e.Local {
+		t.Errorf("got %+v", e)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/store/02:00:00:00:00:09/101", http.StatusNotFound},
+		{"/store/02:00:00:00:00:03/100", http.StatusNotFound},
+		{"/store/02:00:00:00:00:03", http.StatusNotFound},
+		{"/store/02:00:00:00:00:03/101/x", http.StatusNotFound},
+		{"/store/02:00/101", http.StatusBadRequest},
+		{"/store/02:00:00:00:00:03/x", http.StatusBadRequest},
+		{"/unknown", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w := adminGet(s, test.path, ""); w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.path, w.Code, test.status)
+		}
+	}
+}
+
+func TestAdminMasters(t *testing.T) {
+	s := adminServer(t)
+	masters := []adminMaster{}
+	adminList(t, s, "/masters?format=json", &masters)
+	if len(masters) != 1 || !strings.Contains(masters[0].Address, "fe80::2") ||
+		masters[0].Interface != "mem0" || masters[0].LastSeen.Before(masters[0].FirstSeen) {
+		t.Errorf("got %+v", masters)
+	}
+	w := adminGet(s, "/masters", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "fe80::2") {
+		t.Errorf("got text table %q", w.Body)
+	}
+}
+
+func TestAdminTransactions(t *testing.T) {
+	s := adminServer(t)
+	tx, ok := s.getTransaction(7, &net.UDPAddr{IP: net.ParseIP("fe80::8"), Port: 16962}, false)
+	if !ok {
+		t.Fatal("transaction rejected")
+	}
+	tx.push(NewPushDataV0(&TransactionMgmt{Id: 7, SeqNo: 2}, []Data{testData(8, 100, "two")}))
+	tx.push(NewPushDataV0(&TransactionMgmt{Id: 7, SeqNo: 0}, []Data{testData(8, 101, "zero")}))
+	tx.end(3)
+
+	var transactions []adminTransaction
+	finished := func() bool {
+		transactions = []adminTransaction{}
+		adminList(t, s, "/transactions?format=json", &transactions)
+		return len(transactions) == 1 && transactions[0].FinalSeqNo != nil
+	}
+	if !waitFor(time.Second, finished) {
+		t.Fatalf("got %+v", transactions)
+	}
+	tr := transactions[0]
+	// the data items' headers are counted as well
+	if tr.Id != 7 || tr.Source != "fe80::8" || tr.Local || tr.Bytes != 27 || *tr.FinalSeqNo != 3 || tr.Signed {
+		t.Errorf("got %+v", tr)
+	}
+	if len(tr.SeqNos) != 2 || tr.SeqNos[0] != 0 || tr.SeqNos[1] != 2 || len(tr.Missing) != 1 || tr.Missing[0] != 1 {
+		t.Errorf("received %v, missing %v", tr.SeqNos, tr.Missing)
+	}
+
+	w := adminGet(s, "/transactions", "")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got text table %q", w.Body)
+	}
+	fields := strings.Fields(lines[1])
+	if fields[0] != "7" || fields[1] != "fe80::8" || !strings.Contains(lines[1], " 0,2 ") || !strings.Contains(lines[1], " 3  ") {
+		t.Errorf("got line %q", lines[1])
+	}
+}
+
+func TestAdminRequests(t *testing.T) {
+	s := adminServer(t)
+	if w := adminGet(s, "/", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/transactions") {
+		t.Errorf("index: status %d, %q", w.Code, w.Body)
+	}
+	listeners := []adminListener{}
+	adminList(t, s, "/listeners", &listeners)
+	if len(listeners) != 1 || listeners[0].Kind != "udp" || listeners[0].Interface != "mem0" {
+		t.Errorf("got %+v", listeners)
+	}
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, httptest.NewRequest("POST", "/store", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == "" {
+		t.Errorf("POST: status %d", w.Code)
+	}
+}
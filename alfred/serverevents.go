@@ -0,0 +1,68 @@
+package alfred
+
+// A.L.F.R.E.D. server: event notifications for stream clients
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+// send notifications about changed data over a stream connection
+// until either the client closes the connection or the server or
+// listener is shut down.
+func (s *Server) serveEvents(l *listenerStream, conn net.Conn) {
+	// buffered, so a shutdown does not block on us when the client
+	// went away and we are about to unregister
+	quit := make(chan interface{}, 1)
+	s.notifyQuit.Register(quit)
+	defer s.notifyQuit.Unregister(quit)
+
+	// notifications are dropped while the buffer is full
+	updates := make(chan Data, 100)
+	s.store.Subscribe(updates)
+	defer s.store.Unsubscribe(updates)
+
+	// the client is not expected to send anything, so reading
+	// will only return when the connection is closed
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+
+	cbuf := bufio.NewWriter(conn)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-l.closing:
+			return
+		case <-gone:
+			log.Printf("alfred/server: event client went away")
+			return
+		case d := <-updates:
+			source := d.Source
+			if source.IsUnset() {
+				source = s.primaryHardwareAddr()
+			}
+			event := NewEventNotifyV0(d.Header.Type, source)
+			// a client that does not read must not pile up
+			// notifications forever
+			conn.SetWriteDeadline(time.Now().Add(s.EventWriteTimeout))
+			err := event.Write(cbuf)
+			if err == nil {
+				err = cbuf.Flush()
+			}
+			if err == nil {
+				s.metrics.sent(event)
+			} else {
+				log.Printf("alfred/server: error sending event notification: %v", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package alfred
+
+// A.L.F.R.E.D. server: HTTP listeners for monitoring and administration
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+// this is for HTTP listeners' state
+type listenerHTTP struct {
+	// what is served, e.g. "metrics"
+	name     string
+	listener net.Listener
+	quit     chan struct{}
+}
+
+// start a task serving HTTP requests on a TCP address
+func (s *Server) newListenerHTTP(name string, address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	l := &listenerHTTP{
+		name:     name,
+		listener: listener,
+		quit:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			err := http.Serve(l.listener, handler)
+			log.Printf("alfred/server: stop serving HTTP on %v: %v", l.listener.Addr(), err)
+		}()
+		<-l.quit
+		l.listener.Close()
+		s.Lock()
+		defer s.Unlock()
+		delete(s.listenershttp, l)
+	}()
+	s.Lock()
+	defer s.Unlock()
+	s.listenershttp[l] = struct{}{}
+	return nil
+}
@@ -0,0 +1,54 @@
+package alfred
+
+// A.L.F.R.E.D. server: hooks for checking and transforming data
+// before it is stored
+
+// data on its way into the store
+type IngestData struct {
+	// the data item. Hooks may modify it: the header is a copy of
+	// its own and its length is set from the payload afterwards.
+	// The payload may be shared with the sender, so replace it
+	// rather than changing it in place.
+	Data
+	// data has its origin locally
+	Local bool
+	// data came from another host without a valid signature
+	Unverified bool
+	// notes stored along with the data, e.g. for the admin API
+	Annotations map[string]string
+}
+
+// Annotate the data with a note
+func (d *IngestData) Annotate(key string, value string) {
+	if d.Annotations == nil {
+		d.Annotations = make(map[string]string)
+	}
+	d.Annotations[key] = value
+}
+
+// A hook that inspects data before it is put into the store.
+// It may modify or annotate the data. Returning an error rejects
+// the data, it is neither stored nor propagated to other servers.
+// Hooks are called concurrently for different data items.
+type IngestHook interface {
+	Ingest(d *IngestData) error
+}
+
+// adapter for using an ordinary function as IngestHook
+type IngestHookFunc func(d *IngestData) error
+
+func (f IngestHookFunc) Ingest(d *IngestData) error {
+	return f(d)
+}
+
+// a hook along with the data type it is registered for
+type ingestHook struct {
+	packettype uint8
+	hook       IngestHook
+}
+
+// Add a hook that is run for data of the given type before it is put
+// into the store, see Store.AddHook
+func (s *Server) AddIngestHook(packettype uint8, hook IngestHook) {
+	s.store.AddHook(packettype, hook)
+}
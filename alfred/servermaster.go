@@ -5,6 +5,7 @@ package alfred
 import (
 	"log"
 	"net"
+	"sort"
 	"time"
 )
 
@@ -51,29 +52,99 @@ func (s *Server) purgeMasterTask(age time.Duration, interval time.Duration) {
 func (s *Server) addMaster(listener *listenerUDP, masteraddr *net.UDPAddr) {
 	s.Lock()
 	defer s.Unlock()
-	_, exists := s.masters[masteraddr.String()]
-	s.masters[masteraddr.String()] = &master{
-		address:     masteraddr,
-		listenerudp: listener,
-		lastseen:    time.Now(),
+	if _, active := s.listenersudp[listener]; !active {
+		// listener has been shut down in the meantime
+		return
 	}
+	if listener.isOwnAddress(masteraddr) {
+		// our own announcement, looped back
+		return
+	}
+	now := time.Now()
+	m, exists := s.masters[masteraddr.String()]
 	if !exists {
 		log.Printf("alfred/server: new master: %v", masteraddr)
+		m = &master{firstseen: now}
+		s.masters[masteraddr.String()] = m
+		if s.Mode != SERVER_MODE_SLAVE && !s.warm {
+			s.warmUp(listener, masteraddr)
+		}
 	}
+	m.address = masteraddr
+	m.listenerudp = listener
+	m.lastseen = now
 }
 
-// return one master from the list
-// for now, we return the one that we know the longest
-func (s *Server) getPreferredMaster() *master {
+// return one master from the list, as chosen by the configured
+// MasterSelection strategy.
+// If a listener is given, only masters that were learned via that
+// listener are considered.
+func (s *Server) getPreferredMaster(l *listenerUDP) *master {
 	s.Lock()
-	defer s.Unlock()
-	m := master{}
+	candidates := make([]master, 0, len(s.masters))
 	for _, master := range s.masters {
-		// most currently seen one wins
-		if m.address == nil || m.lastseen.Before(master.lastseen) {
-			// make a copy
-			m = *master
+		if l != nil && master.listenerudp != l {
+			continue
 		}
+		// make a copy
+		candidates = append(candidates, *master)
+	}
+	selection := s.MasterSelection
+	s.Unlock()
+	if len(candidates) == 0 {
+		return &master{}
+	}
+	if selection == nil {
+		selection = &LastSeenMasterSelection{}
+	}
+	// selection might take a while, so do it without holding the lock
+	infos := make([]MasterInfo, len(candidates))
+	for i, m := range candidates {
+		infos[i] = m.info()
+	}
+	selected := selection.SelectMaster(infos)
+	if selected < 0 || selected >= len(candidates) {
+		return &master{}
+	}
+	return &candidates[selected]
+}
+
+// return copies of the masters that were learned via a listener
+func (s *Server) getMasters(l *listenerUDP) []master {
+	s.Lock()
+	defer s.Unlock()
+	masters := make([]master, 0)
+	for _, m := range s.masters {
+		if m.listenerudp == l {
+			masters = append(masters, *m)
+		}
+	}
+	return masters
+}
+
+// return public information about a master
+func (m *master) info() MasterInfo {
+	info := MasterInfo{
+		Address:   m.address,
+		FirstSeen: m.firstseen,
+		LastSeen:  m.lastseen,
+	}
+	if m.listenerudp != nil {
+		info.Interface = m.listenerudp.ifname
+	}
+	return info
+}
+
+// return information about the known masters, ordered by address
+func (s *Server) Masters() []MasterInfo {
+	s.Lock()
+	infos := make([]MasterInfo, 0, len(s.masters))
+	for _, m := range s.masters {
+		infos = append(infos, m.info())
 	}
-	return &m
+	s.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Address.String() < infos[j].Address.String()
+	})
+	return infos
 }
@@ -0,0 +1,133 @@
+package alfred
+
+// A.L.F.R.E.D. server: strategies for choosing a master server
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// information about a known master server
+type MasterInfo struct {
+	// address the master is reachable at
+	Address *net.UDPAddr
+	// name of the interface the master was learned on, empty for
+	// static peers
+	Interface string
+	// time of the first and the latest announcement
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// A strategy for choosing the master server that slaves and stealth
+// masters sync their data to and forward requests to
+type MasterSelection interface {
+	// return the index of the preferred master in the given
+	// list, or -1 if none of them should be used
+	SelectMaster(masters []MasterInfo) int
+}
+
+// Default strategy: choose the master that was seen most recently
+type LastSeenMasterSelection struct{}
+
+func (l *LastSeenMasterSelection) SelectMaster(masters []MasterInfo) int {
+	selected := -1
+	for i, m := range masters {
+		if selected == -1 || masters[selected].LastSeen.Before(m.LastSeen) {
+			selected = i
+		}
+	}
+	return selected
+}
+
+// Choose the master that has the best batman-adv transmit quality
+// (TQ) to its originator, like the reference implementation does.
+// When no TQ can be determined for any of the masters, the fallback
+// strategy is used.
+type TQMasterSelection struct {
+	// where to read the originator table from
+	Source OriginatorSource
+	// used if no TQ information is available, defaults to
+	// LastSeenMasterSelection if nil
+	Fallback MasterSelection
+	// time to reuse an originator table (or the error reading it)
+	// for, as reading it can be expensive, e.g. running batctl.
+	// Defaults to DefaultOriginatorCacheTime if 0.
+	CacheTime time.Duration
+	// cached originator table
+	table   *OriginatorTable
+	err     error
+	expires time.Time
+	sync.Mutex
+}
+
+const DefaultOriginatorCacheTime = 10 * time.Second
+
+// return the originator table, reading it only if the cached one is
+// too old
+func (t *TQMasterSelection) originators() (*OriginatorTable, error) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	if now.Before(t.expires) {
+		return t.table, t.err
+	}
+	t.table, t.err = t.Source.Originators()
+	cachetime := t.CacheTime
+	if cachetime == 0 {
+		cachetime = DefaultOriginatorCacheTime
+	}
+	t.expires = now.Add(cachetime)
+	return t.table, t.err
+}
+
+func (t *TQMasterSelection) fallback(masters []MasterInfo) int {
+	if t.Fallback == nil {
+		return (&LastSeenMasterSelection{}).SelectMaster(masters)
+	}
+	return t.Fallback.SelectMaster(masters)
+}
+
+func (t *TQMasterSelection) SelectMaster(masters []MasterInfo) int {
+	table, err := t.originators()
+	if err != nil {
+		log.Printf("alfred/server: cannot read originator table: %v", err)
+		return t.fallback(masters)
+	}
+	selected := -1
+	var best uint8
+	for i, m := range masters {
+		mac := LinkLocalHardwareAddr(m.Address.IP)
+		if mac == nil {
+			continue
+		}
+		tq := table.TQ(mac)
+		if tq == 0 {
+			continue
+		}
+		if selected == -1 || tq > best ||
+			(tq == best && masters[selected].LastSeen.Before(m.LastSeen)) {
+			selected = i
+			best = tq
+		}
+	}
+	if selected == -1 {
+		return t.fallback(masters)
+	}
+	return selected
+}
+
+// Derive the MAC address from an IPv6 link-local address that was
+// built from it (modified EUI-64). Returns nil if this is not possible.
+func LinkLocalHardwareAddr(ip net.IP) HardwareAddr {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return nil
+	}
+	if ip[11] != 0xff || ip[12] != 0xfe {
+		return nil
+	}
+	return HardwareAddr{ip[8] ^ 0x02, ip[9], ip[10], ip[13], ip[14], ip[15]}
+}
@@ -0,0 +1,107 @@
+package alfred
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// an originator source returning a fixed table, counting how often it
+// is asked
+type testOriginatorSource struct {
+	table *OriginatorTable
+	err   error
+	calls int
+}
+
+func (s *testOriginatorSource) Originators() (*OriginatorTable, error) {
+	s.calls++
+	return s.table, s.err
+}
+
+func masterInfo(ip string, lastseen time.Time) MasterInfo {
+	return MasterInfo{
+		Address:  &net.UDPAddr{IP: net.ParseIP(ip), Port: 16962},
+		LastSeen: lastseen,
+	}
+}
+
+func TestLinkLocalHardwareAddr(t *testing.T) {
+	tests := []struct {
+		ip  string
+		mac string
+	}{
+		{"fe80::ba:7aff:fedf:301", "02:ba:7a:df:03:01"},
+		{"fe80::200:5eff:fe00:5301", "00:00:5e:00:53:01"},
+		{"fe80::ff:fe00:1", "02:00:00:00:00:01"},
+		// not derived from a MAC address
+		{"fe80::1", ""},
+		{"fe80::ba:7a00:dfdf:301", ""},
+		// not link-local
+		{"2001:db8::ba:7aff:fedf:301", ""},
+		{"10.0.0.1", ""},
+	}
+	for _, test := range tests {
+		mac := LinkLocalHardwareAddr(net.ParseIP(test.ip))
+		if test.mac == "" {
+			if mac != nil {
+				t.Errorf("%v: got %v, want none", test.ip, mac)
+			}
+		} else if mac.String() != test.mac {
+			t.Errorf("%v: got %v, want %v", test.ip, mac, test.mac)
+		}
+	}
+}
+
+func TestTQMasterSelection(t *testing.T) {
+	now := time.Now()
+	masters := []MasterInfo{
+		// 02:ba:7a:df:02:01, TQ 230
+		masterInfo("fe80::ba:7aff:fedf:201", now),
+		// client 02:ba:7a:df:04:01 of 02:ba:7a:df:03:01, TQ 255
+		masterInfo("fe80::ba:7aff:fedf:401", now.Add(-time.Minute)),
+		// unknown
+		masterInfo("fe80::ba:7aff:fedf:901", now.Add(time.Minute)),
+	}
+	source := &testOriginatorSource{table: sampleTable}
+	sel := &TQMasterSelection{Source: source}
+	if i := sel.SelectMaster(masters); i != 1 {
+		t.Errorf("selected %d, want the one with the best TQ", i)
+	}
+
+	// same TQ, the one seen more recently wins
+	tie := []MasterInfo{
+		masterInfo("fe80::ba:7aff:fedf:301", now.Add(-time.Minute)),
+		masterInfo("fe80::ba:7aff:fedf:401", now),
+	}
+	if i := sel.SelectMaster(tie); i != 1 {
+		t.Errorf("selected %d of equal TQ, want the one seen last", i)
+	}
+
+	// no TQ known for any master, the one seen last is used
+	unknown := []MasterInfo{
+		masterInfo("fe80::ba:7aff:fedf:901", now),
+		masterInfo("2001:db8::1", now.Add(time.Minute)),
+	}
+	if i := sel.SelectMaster(unknown); i != 1 {
+		t.Errorf("selected %d without TQ, want the fallback's choice", i)
+	}
+	if i := sel.SelectMaster(nil); i != -1 {
+		t.Errorf("selected %d of no masters", i)
+	}
+	if source.calls != 1 {
+		t.Errorf("originator table read %d times, want 1", source.calls)
+	}
+
+	failing := &testOriginatorSource{err: errors.New("no batctl")}
+	sel = &TQMasterSelection{Source: failing, CacheTime: time.Nanosecond}
+	if i := sel.SelectMaster(masters); i != 2 {
+		t.Errorf("selected %d without table, want the fallback's choice", i)
+	}
+	time.Sleep(time.Millisecond)
+	sel.SelectMaster(masters)
+	if failing.calls != 2 {
+		t.Errorf("originator table read %d times after cache expired, want 2", failing.calls)
+	}
+}
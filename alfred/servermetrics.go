@@ -0,0 +1,208 @@
+package alfred
+
+// A.L.F.R.E.D. server: metrics for monitoring
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// counters that are updated while the server is running.
+// All of them are to be accessed atomically.
+type metrics struct {
+	// packets, by packet type
+	packetsReceived [256]uint64
+	packetsSent     [256]uint64
+	// packets that could not be decoded
+	packetsInvalid uint64
+	// transactions
+	transactionsStarted   uint64
+	transactionsCompleted uint64
+	transactionsDropped   uint64
+	transactionsTimedOut  uint64
+	// transactions stored without a valid signature
+	transactionsUnverified uint64
+	// signed transactions dropped for being stale or replayed
+	transactionsReplayed uint64
+	// transactions of other hosts not started because of limits,
+	// by REJECT_TX_* reason
+	transactionsRejectedOpen   uint64
+	transactionsRejectedSource uint64
+	// transactions aborted to make room for new ones
+	transactionsEvicted uint64
+	// transactions dropped because of too much buffered data
+	transactionsOversize uint64
+	// stream client operations denied by policy
+	streamDenied uint64
+}
+
+// count a received packet
+func (m *metrics) received(p Packet) {
+	if h := PacketHeader(p); h != nil {
+		atomic.AddUint64(&m.packetsReceived[h.Type], 1)
+	}
+}
+
+// count a sent packet
+func (m *metrics) sent(p Packet) {
+	if h := PacketHeader(p); h != nil {
+		atomic.AddUint64(&m.packetsSent[h.Type], 1)
+	}
+}
+
+// count a transaction rejected for the given REJECT_TX_* reason
+func (m *metrics) rejectedTransaction(reason string) {
+	switch reason {
+	case REJECT_TX_OPEN:
+		atomic.AddUint64(&m.transactionsRejectedOpen, 1)
+	case REJECT_TX_SOURCE:
+		atomic.AddUint64(&m.transactionsRejectedSource, 1)
+	}
+}
+
+// write a single metric in Prometheus text format
+func writeMetric(w io.Writer, name string, kind string, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	labels := make([]string, 0, len(values))
+	for label, _ := range values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if label == "" {
+			fmt.Fprintf(w, "%s %d\n", name, values[label])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, label, values[label])
+		}
+	}
+}
+
+// return the label for a packet type
+func packetTypeLabel(t uint8) string {
+	if name, known := packetTypeNames[t]; known {
+		return fmt.Sprintf("type=%q", name)
+	}
+	return fmt.Sprintf("type=\"%d\"", t)
+}
+
+// return the label for a data type
+func dataTypeLabel(t uint8) string {
+	return fmt.Sprintf("type=\"%d\"", t)
+}
+
+// Write the server's metrics in Prometheus text format
+func (s *Server) WriteMetrics(w io.Writer) {
+	received := make(map[string]uint64)
+	sent := make(map[string]uint64)
+	for t := 0; t < 256; t++ {
+		if c := atomic.LoadUint64(&s.metrics.packetsReceived[t]); c > 0 {
+			received[packetTypeLabel(uint8(t))] = c
+		}
+		if c := atomic.LoadUint64(&s.metrics.packetsSent[t]); c > 0 {
+			sent[packetTypeLabel(uint8(t))] = c
+		}
+	}
+	writeMetric(w, "alfred_packets_received_total", "counter",
+		"Packets received, by packet type.", received)
+	writeMetric(w, "alfred_packets_sent_total", "counter",
+		"Packets sent, by packet type.", sent)
+	writeMetric(w, "alfred_packets_invalid_total", "counter",
+		"Packets received that could not be decoded.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.packetsInvalid)})
+
+	writeMetric(w, "alfred_transactions_started_total", "counter",
+		"Transactions started.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.transactionsStarted)})
+	writeMetric(w, "alfred_transactions_completed_total", "counter",
+		"Transactions completed and stored.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.transactionsCompleted)})
+	writeMetric(w, "alfred_transactions_dropped_total", "counter",
+		"Transactions dropped because they were incomplete or aborted.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.transactionsDropped)})
+	writeMetric(w, "alfred_transactions_timedout_total", "counter",
+		"Transactions purged unfinished after their maximum age.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.transactionsTimedOut)})
+	writeMetric(w, "alfred_transactions_unverified_total", "counter",
+		"Transactions from other hosts stored without a valid signature.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.transactionsUnverified)})
+	writeMetric(w, "alfred_transactions_replayed_total", "counter",
+		"Signed transactions from other hosts dropped for being stale or replayed.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.transactionsReplayed)})
+	writeMetric(w, "alfred_transactions_rejected_total", "counter",
+		"Transactions from other hosts not started because of limits, by limit.",
+		map[string]uint64{
+			fmt.Sprintf("reason=%q", REJECT_TX_OPEN):   atomic.LoadUint64(&s.metrics.transactionsRejectedOpen),
+			fmt.Sprintf("reason=%q", REJECT_TX_SOURCE): atomic.LoadUint64(&s.metrics.transactionsRejectedSource),
+		})
+	writeMetric(w, "alfred_transactions_evicted_total", "counter",
+		"Open transactions aborted to make room for new ones.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.transactionsEvicted)})
+	writeMetric(w, "alfred_transactions_oversize_total", "counter",
+		"Transactions dropped because they buffered more data than allowed.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.transactionsOversize)})
+
+	writeMetric(w, "alfred_stream_denied_total", "counter",
+		"Operations of stream clients denied by the listener's policy.",
+		map[string]uint64{"": atomic.LoadUint64(&s.metrics.streamDenied)})
+
+	s.Lock()
+	masters := len(s.masters)
+	transactions := len(s.transactions)
+	s.Unlock()
+	writeMetric(w, "alfred_masters", "gauge",
+		"Currently known master servers.",
+		map[string]uint64{"": uint64(masters)})
+	writeMetric(w, "alfred_transactions_open", "gauge",
+		"Currently open transactions.",
+		map[string]uint64{"": uint64(transactions)})
+	warm := uint64(0)
+	if s.IsWarm() {
+		warm = 1
+	}
+	writeMetric(w, "alfred_warm", "gauge",
+		"1 if data of other masters has been fetched after starting up.",
+		map[string]uint64{"": warm})
+
+	stats := s.store.Stats()
+	entries := make(map[string]uint64)
+	bytes := make(map[string]uint64)
+	for t, c := range stats.Entries {
+		entries[dataTypeLabel(t)] = uint64(c)
+	}
+	for t, c := range stats.Bytes {
+		bytes[dataTypeLabel(t)] = uint64(c)
+	}
+	writeMetric(w, "alfred_store_entries", "gauge",
+		"Entries in the data store, by data type.", entries)
+	writeMetric(w, "alfred_store_bytes", "gauge",
+		"Payload bytes in the data store, by data type.", bytes)
+	rejected := make(map[string]uint64)
+	for reason, c := range stats.Rejected {
+		rejected[fmt.Sprintf("reason=%q", reason)] = c
+	}
+	writeMetric(w, "alfred_store_rejected_total", "counter",
+		"Data items rejected because of limits, missing signatures or ingest hooks, by reason.", rejected)
+	writeMetric(w, "alfred_store_notifications_dropped_total", "counter",
+		"Update notifications dropped because event clients did not keep up.",
+		map[string]uint64{"": stats.NotificationsDropped})
+}
+
+// return a HTTP handler that serves the server's metrics
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.WriteMetrics(w)
+	})
+}
+
+// start a task serving the server's metrics via HTTP on a
+// TCP address, at the "/metrics" path
+func (s *Server) NewListenerMetrics(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	return s.newListenerHTTP("metrics", address, mux)
+}
@@ -0,0 +1,59 @@
+package alfred
+
+// A.L.F.R.E.D. server: keep the store contents across restarts
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Persist the data store in the given file.
+// If the file exists, its contents are loaded into the store right
+// away. Afterwards, the store is written to the file in the given
+// interval and upon shutdown.
+// Call this from the configure function passed to NewServerConfig,
+// so the data is there before the server starts talking to others.
+func (s *Server) PersistStore(filename string, interval time.Duration) error {
+	if err := s.store.Load(filename); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("alfred/server: no store snapshot found at %v, starting empty", filename)
+	} else {
+		log.Printf("alfred/server: loaded store snapshot from %v", filename)
+	}
+	s.Lock()
+	s.storeFile = filename
+	s.Unlock()
+
+	quit := make(chan interface{})
+	s.notifyQuit.Register(quit)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			select {
+			case <-quit:
+				// final snapshot is written in Shutdown()
+				return
+			case <-time.After(interval):
+				s.saveStore()
+			}
+		}
+	}()
+	return nil
+}
+
+// write the store contents to the configured file, if any
+func (s *Server) saveStore() {
+	s.Lock()
+	filename := s.storeFile
+	s.Unlock()
+	if filename == "" {
+		return
+	}
+	if err := s.store.Save(filename); err != nil {
+		log.Printf("alfred/server: error writing store snapshot to %v: %v", filename, err)
+	}
+}
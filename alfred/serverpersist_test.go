@@ -0,0 +1,116 @@
+package alfred
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testData(source byte, packettype uint8, payload string) Data {
+	return Data{
+		Source: HardwareAddr{0x02, 0, 0, 0, 0, source},
+		Header: &TLV{Type: packettype, Version: 0, Length: uint16(len(payload))},
+		Data:   []byte(payload),
+	}
+}
+
+// return the entry stored for a data item, if any
+func storedEntity(s *Server, d Data) (StoreEntry, bool) {
+	return s.store.View().Get(d.Source, d.Header.Type)
+}
+
+// start a server persisting its store in a file
+func persistentServer(t *testing.T, filename string) *Server {
+	var err error
+	s := NewServerConfig(SERVER_MODE_MASTER, func(s *Server) {
+		err = s.PersistStore(filename, time.Hour)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPersistStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store")
+	local := testData(1, 100, "local")
+	remote := testData(2, 100, "remote")
+	expired := testData(3, 100, "expired")
+
+	s := persistentServer(t, filename)
+	s.store.Request(ReqPut{IsLocal: true, Data: local})
+	s.store.Request(ReqPut{Data: remote})
+	s.store.Request(ReqPut{Data: expired})
+	before, _ := storedEntity(s, local)
+	s.Shutdown()
+
+	// let one of the entities expire in the snapshot
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := storeSnapshot{}
+	err = gob.NewDecoder(f).Decode(&snapshot)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Entities) != 3 {
+		t.Fatalf("%d entities saved, want 3", len(snapshot.Entities))
+	}
+	for i, e := range snapshot.Entities {
+		if e.Data.Source.String() == expired.Source.String() {
+			snapshot.Entities[i].Invalid = time.Now().Add(-time.Second)
+		}
+	}
+	f, err = os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(f).Encode(&snapshot)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot is loaded before the server starts its tasks
+	var loaded bool
+	s = NewServerConfig(SERVER_MODE_MASTER, func(s *Server) {
+		if err := s.PersistStore(filename, time.Hour); err != nil {
+			t.Error(err)
+		}
+		_, loaded = storedEntity(s, local)
+	})
+	defer s.Shutdown()
+	if !loaded {
+		t.Error("snapshot not loaded in time")
+	}
+	after, ok := storedEntity(s, local)
+	if !ok || string(after.Data.Data) != "local" {
+		t.Fatalf("local data not restored: %+v", after)
+	}
+	if !after.Local {
+		t.Error("local flag lost")
+	}
+	if !after.Expires.Equal(before.Expires) {
+		t.Errorf("expiry changed from %v to %v", before.Expires, after.Expires)
+	}
+	if e, ok := storedEntity(s, remote); !ok || e.Local {
+		t.Errorf("remote data not restored as it was: %+v", e)
+	}
+	if _, ok := storedEntity(s, expired); ok {
+		t.Error("expired data restored")
+	}
+}
+
+func TestPersistStoreMissingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store")
+	s := persistentServer(t, filename)
+	s.store.Request(ReqPut{IsLocal: true, Data: testData(1, 100, "data")})
+	s.Shutdown()
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("no snapshot written on shutdown: %v", err)
+	}
+}
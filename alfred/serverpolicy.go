@@ -0,0 +1,207 @@
+package alfred
+
+// A.L.F.R.E.D. server: access control for stream (TCP, Unix) listeners
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// operations that stream clients can be allowed to do
+const (
+	STREAM_OP_REQUEST = 1 << iota
+	STREAM_OP_PUSH
+	STREAM_OP_MODESWITCH
+	STREAM_OP_CHANGE_INTERFACE
+	STREAM_OP_STATUS
+	STREAM_OP_EVENTS
+	// operations that do not change anything
+	STREAM_OP_READ = STREAM_OP_REQUEST | STREAM_OP_STATUS | STREAM_OP_EVENTS
+	STREAM_OP_ALL  = STREAM_OP_READ | STREAM_OP_PUSH | STREAM_OP_MODESWITCH | STREAM_OP_CHANGE_INTERFACE
+)
+
+// names of operations, as used in policy descriptions
+var streamOpNames = map[string]int{
+	"request":         STREAM_OP_REQUEST,
+	"push":            STREAM_OP_PUSH,
+	"modeswitch":      STREAM_OP_MODESWITCH,
+	"changeinterface": STREAM_OP_CHANGE_INTERFACE,
+	"status":          STREAM_OP_STATUS,
+	"events":          STREAM_OP_EVENTS,
+	"read":            STREAM_OP_READ,
+	"all":             STREAM_OP_ALL,
+}
+
+// information about the peer of a stream connection
+type StreamPeer struct {
+	// remote IP address for TCP connections, nil otherwise
+	IP net.IP
+	// set if the peer's credentials are known, which is the case
+	// for Unix socket connections on Linux
+	HasCredentials bool
+	UID            uint32
+	GID            uint32
+}
+
+// A rule grants operations to peers. All given criteria must match
+// for the rule to apply, a rule without criteria applies to all peers.
+type StreamPolicyRule struct {
+	// operations allowed (STREAM_OP_*)
+	Allow int
+	// peer must have an address within one of these networks
+	Networks []*net.IPNet
+	// peer must have one of these user IDs
+	UIDs []uint32
+	// peer must have one of these group IDs
+	GIDs []uint32
+}
+
+// An access control policy for a stream listener. A peer is allowed
+// the operations of all rules that apply to it, and nothing else.
+type StreamPolicy struct {
+	Rules []StreamPolicyRule
+}
+
+// check if a rule applies to a peer
+func (r *StreamPolicyRule) matches(peer *StreamPeer) bool {
+	if len(r.Networks) > 0 {
+		found := false
+		for _, n := range r.Networks {
+			if peer.IP != nil && n.Contains(peer.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.UIDs) > 0 && !(peer.HasCredentials && containsID(r.UIDs, peer.UID)) {
+		return false
+	}
+	if len(r.GIDs) > 0 && !(peer.HasCredentials && containsID(r.GIDs, peer.GID)) {
+		return false
+	}
+	return true
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// return the operations a peer is allowed to do
+func (p *StreamPolicy) Allowed(peer *StreamPeer) int {
+	allowed := 0
+	for i, _ := range p.Rules {
+		if p.Rules[i].matches(peer) {
+			allowed |= p.Rules[i].Allow
+		}
+	}
+	return allowed
+}
+
+// check if a peer may do an operation. Packets that do not ask for
+// any known operation (op 0) are only accepted from peers that are
+// allowed everything.
+func (p *StreamPolicy) Permits(peer *StreamPeer, op int) bool {
+	allowed := p.Allowed(peer)
+	if op == 0 {
+		return allowed == STREAM_OP_ALL
+	}
+	return allowed&op != 0
+}
+
+// Parse a policy description. Rules are separated by ";" and consist
+// of a comma separated list of operations (request, push, modeswitch,
+// changeinterface, status, events, or the groups read and all),
+// optionally followed by criteria: "net=" for networks, "uid=" and
+// "gid=" for peer credentials, each taking a comma separated list.
+// An empty description results in a policy that allows nothing.
+func ParseStreamPolicy(description string) (*StreamPolicy, error) {
+	// example:
+	// "read; push net=10.0.0.0/8,fd00::/8; all uid=0"
+	p := &StreamPolicy{Rules: make([]StreamPolicyRule, 0)}
+	for _, rule := range strings.Split(description, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		r := StreamPolicyRule{}
+		for _, op := range strings.Split(fields[0], ",") {
+			o, known := streamOpNames[op]
+			if !known {
+				return nil, fmt.Errorf("invalid stream policy: unknown operation %q", op)
+			}
+			r.Allow |= o
+		}
+		for _, criterion := range fields[1:] {
+			kv := strings.SplitN(criterion, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid stream policy: invalid criterion %q", criterion)
+			}
+			for _, value := range strings.Split(kv[1], ",") {
+				switch kv[0] {
+				case "net":
+					_, n, err := net.ParseCIDR(value)
+					if err != nil {
+						return nil, fmt.Errorf("invalid stream policy: %v", err)
+					}
+					r.Networks = append(r.Networks, n)
+				case "uid", "gid":
+					id, err := strconv.ParseUint(value, 10, 32)
+					if err != nil {
+						return nil, fmt.Errorf("invalid stream policy: invalid ID %q", value)
+					}
+					if kv[0] == "uid" {
+						r.UIDs = append(r.UIDs, uint32(id))
+					} else {
+						r.GIDs = append(r.GIDs, uint32(id))
+					}
+				default:
+					return nil, fmt.Errorf("invalid stream policy: unknown criterion %q", kv[0])
+				}
+			}
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	return p, nil
+}
+
+// return information about the peer of a connection
+func newStreamPeer(conn net.Conn) *StreamPeer {
+	peer := &StreamPeer{}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer.IP = addr.IP
+	}
+	if uconn, ok := conn.(*net.UnixConn); ok {
+		peer.UID, peer.GID, peer.HasCredentials = peerCredentials(uconn)
+	}
+	return peer
+}
+
+// return the operation a packet received from a stream client asks
+// for, 0 if not applicable
+func streamOperation(p Packet) int {
+	switch p.(type) {
+	case *RequestV0:
+		return STREAM_OP_REQUEST
+	case *PushDataV0:
+		return STREAM_OP_PUSH
+	case *ModeSwitchV0:
+		return STREAM_OP_MODESWITCH
+	case *ChangeInterfaceV0:
+		return STREAM_OP_CHANGE_INTERFACE
+	case *ServerStatusReqV0:
+		return STREAM_OP_STATUS
+	case *EventRegisterV0:
+		return STREAM_OP_EVENTS
+	}
+	return 0
+}
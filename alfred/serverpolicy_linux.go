@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package alfred
+
+import (
+	"net"
+	"syscall"
+)
+
+// return the credentials of the process on the other end of a Unix
+// socket connection
+func peerCredentials(conn *net.UnixConn) (uint32, uint32, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return 0, 0, false
+	}
+	return cred.Uid, cred.Gid, true
+}
@@ -0,0 +1,47 @@
+package alfred
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamPeerCredentials(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "peer.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	peer := newStreamPeer(conn)
+	if !peer.HasCredentials || peer.UID != uint32(os.Getuid()) || peer.GID != uint32(os.Getgid()) {
+		t.Fatalf("got peer %+v, want uid %d gid %d", peer, os.Getuid(), os.Getgid())
+	}
+	if peer.IP != nil {
+		t.Errorf("got IP %v for Unix socket peer", peer.IP)
+	}
+
+	p, err := ParseStreamPolicy(fmt.Sprintf("read; push uid=%d; modeswitch gid=%d", os.Getuid()+1, os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Permits(peer, STREAM_OP_PUSH) {
+		t.Error("push permitted for another user ID")
+	}
+	if !p.Permits(peer, STREAM_OP_MODESWITCH) {
+		t.Error("modeswitch not permitted for the peer's group ID")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package alfred
+
+import (
+	"net"
+)
+
+// peer credentials are only supported on Linux
+func peerCredentials(conn *net.UnixConn) (uint32, uint32, bool) {
+	return 0, 0, false
+}
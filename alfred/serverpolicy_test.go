@@ -0,0 +1,165 @@
+package alfred
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseStreamPolicy(t *testing.T) {
+	_, net10, _ := net.ParseCIDR("10.0.0.0/8")
+	_, netfd, _ := net.ParseCIDR("fd00::/8")
+	tests := []struct {
+		description string
+		rules       []StreamPolicyRule
+	}{
+		{"", []StreamPolicyRule{}},
+		{" ; ", []StreamPolicyRule{}},
+		{"read", []StreamPolicyRule{{Allow: STREAM_OP_READ}}},
+		{"read; push net=10.0.0.0/8", []StreamPolicyRule{
+			{Allow: STREAM_OP_READ},
+			{Allow: STREAM_OP_PUSH, Networks: []*net.IPNet{net10}},
+		}},
+		{"request,push net=10.0.0.0/8,fd00::/8 uid=0,1000; all gid=27", []StreamPolicyRule{
+			{Allow: STREAM_OP_REQUEST | STREAM_OP_PUSH, Networks: []*net.IPNet{net10, netfd}, UIDs: []uint32{0, 1000}},
+			{Allow: STREAM_OP_ALL, GIDs: []uint32{27}},
+		}},
+	}
+	for _, test := range tests {
+		p, err := ParseStreamPolicy(test.description)
+		if err != nil {
+			t.Errorf("%q: %v", test.description, err)
+			continue
+		}
+		if !reflect.DeepEqual(p.Rules, test.rules) {
+			t.Errorf("%q: got %+v, want %+v", test.description, p.Rules, test.rules)
+		}
+	}
+
+	invalid := []string{
+		"write",
+		"read,",
+		"push net",
+		"push net=10.0.0.0",
+		"push uid=root",
+		"push gid=-1",
+		"push uid=4294967296",
+		"push user=0",
+	}
+	for _, description := range invalid {
+		if _, err := ParseStreamPolicy(description); err == nil {
+			t.Errorf("%q: invalid policy accepted", description)
+		}
+	}
+}
+
+func TestStreamPolicyPermits(t *testing.T) {
+	p, err := ParseStreamPolicy("read; push net=10.0.0.0/8; all uid=0; changeinterface gid=27")
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &StreamPeer{}
+	local := &StreamPeer{IP: net.ParseIP("10.1.2.3")}
+	remote := &StreamPeer{IP: net.ParseIP("192.0.2.1")}
+	root := &StreamPeer{HasCredentials: true, UID: 0, GID: 0}
+	user := &StreamPeer{HasCredentials: true, UID: 1000, GID: 27}
+	tests := []struct {
+		peer    *StreamPeer
+		op      int
+		permits bool
+	}{
+		{anonymous, STREAM_OP_REQUEST, true},
+		{anonymous, STREAM_OP_STATUS, true},
+		{anonymous, STREAM_OP_PUSH, false},
+		{local, STREAM_OP_PUSH, true},
+		{remote, STREAM_OP_PUSH, false},
+		{remote, STREAM_OP_EVENTS, true},
+		// the user ID is only known with credentials
+		{anonymous, STREAM_OP_MODESWITCH, false},
+		{root, STREAM_OP_MODESWITCH, true},
+		{user, STREAM_OP_MODESWITCH, false},
+		{user, STREAM_OP_CHANGE_INTERFACE, true},
+		// unknown operations need everything to be allowed
+		{anonymous, 0, false},
+		{local, 0, false},
+		{user, 0, false},
+		{root, 0, true},
+	}
+	for _, test := range tests {
+		if permits := p.Permits(test.peer, test.op); permits != test.permits {
+			t.Errorf("%+v, operation %d: got %v, want %v", test.peer, test.op, permits, test.permits)
+		}
+	}
+}
+
+// start a server with a Unix socket listener using the given policy
+func policyServer(t *testing.T, description string) (*Server, string) {
+	p, err := ParseStreamPolicy(description)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(SERVER_MODE_MASTER)
+	t.Cleanup(s.Shutdown)
+	address := filepath.Join(t.TempDir(), "alfred.sock")
+	if err := s.NewListenerStreamPolicy("unix", address, p); err != nil {
+		t.Fatal(err)
+	}
+	return s, address
+}
+
+// send a packet to a stream listener, return the reply if there is
+// one (nil otherwise) when the server closed the connection
+func streamExchange(t *testing.T, address string, p Packet) Packet {
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := p.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reply, err, _ := Read(conn)
+	if err != nil {
+		return nil
+	}
+	return reply
+}
+
+func TestStreamPolicyEnforcement(t *testing.T) {
+	s, address := policyServer(t, "read")
+
+	reply := streamExchange(t, address, NewServerStatusReqV0(&TransactionMgmt{Id: 1}))
+	if _, ok := reply.(*ServerStatusRepV0); !ok {
+		t.Errorf("allowed status request: got %+v", reply)
+	}
+	if n := atomic.LoadUint64(&s.metrics.streamDenied); n != 0 {
+		t.Errorf("%d operations denied, want none", n)
+	}
+
+	// denied
+	streamExchange(t, address, NewModeSwitchV0(ALFRED_MODESWITCH_SLAVE))
+	if s.Mode != SERVER_MODE_MASTER {
+		t.Errorf("mode switched to %d by denied request", s.Mode)
+	}
+	// not a request for any known operation
+	streamExchange(t, address, NewStatusV0(ALFRED_STATUS_TXEND, &TransactionMgmt{Id: 2, SeqNo: 0}))
+	if n := atomic.LoadUint64(&s.metrics.streamDenied); n != 2 {
+		t.Errorf("%d operations denied, want 2", n)
+	}
+
+	s, address = policyServer(t, "status")
+	reply = streamExchange(t, address, NewRequestV0(100, 3))
+	if status, ok := reply.(*StatusV0); !ok || status.Header.Type != ALFRED_STATUS_ERROR || status.Tx.Id != 3 {
+		t.Errorf("denied request: got %+v, want an error status", reply)
+	}
+
+	s, address = policyServer(t, "all")
+	streamExchange(t, address, NewStatusV0(ALFRED_STATUS_TXEND, &TransactionMgmt{Id: 4, SeqNo: 0}))
+	if n := atomic.LoadUint64(&s.metrics.streamDenied); n != 0 {
+		t.Errorf("%d operations denied when everything is allowed", n)
+	}
+}
@@ -4,34 +4,113 @@ package alfred
 // A.L.F.R.E.D. server
 
 import (
+	"container/heap"
+	"encoding/gob"
+	"errors"
 	"github.com/tv42/topic"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // for requests, this means to return data of all packettypes
 const PACKETTYPE_ALL = 0
 
-// a single entity in our store
+var ErrSnapshotVersion = errors.New("unsupported store snapshot version")
+
+// a single entity in our store.
+// Entities are never modified once they are part of the store, an
+// update replaces them, so they can be shared with readers.
 type storeEntity struct {
-	Invalid time.Time
-	Local   bool
+	Invalid    time.Time
+	Local      bool
+	Unverified bool
+	// notes added by ingest hooks
+	Annotations map[string]string
 	*Data
 }
 
-// the state of the data storage used by an A.L.F.R.E.D. server
+// number of shards the store contents are split into. Updates copy
+// the shard they touch, so more shards make updates cheaper.
+const storeShards = 256
+
+// the store contents at one point in time. Published views and the
+// maps they refer to are never modified.
+type storeView struct {
+	shards [storeShards]map[string]map[uint8]*storeEntity
+}
+
+// the state of the data storage used by an A.L.F.R.E.D. server.
+// Readers work on the view that was current when they started, so
+// they never block writers. Writers are serialized and publish a new
+// view that shares all unchanged parts with the previous one.
 type Store struct {
-	req           chan interface{}
-	db            map[string]map[uint8]*storeEntity
+	// *storeView, the current contents
+	view          atomic.Value
 	purgeInterval time.Duration
 	purgeAfter    time.Duration
+	// expiry times of the entities, for purging
+	expiry expiryHeap
+	// number of entities in the current view
+	entities int
+	// data type specific retention times
+	retention map[uint8]time.Duration
+	// limits for data from other hosts
+	limits StoreLimits
+	// rejected data, by reason
+	rejected map[string]uint64
+	// hooks run on data that is put into the store, replaced as a
+	// whole when a hook is added
+	hooks []ingestHook
+	quit  chan struct{}
+	// channels notified about changed data, see Subscribe
+	subscribers map[chan<- Data]struct{}
+	// notifications dropped because a subscriber did not keep up
+	notificationsDropped uint64
+	// guards the subscribers, kept apart from the writer lock
+	notifyLock sync.Mutex
+	// Deprecated: use Subscribe. Changed data is still broadcast
+	// here for existing users, fed from a subscription of its own,
+	// so slow receivers miss notifications instead of holding up
+	// writers.
 	NotifyUpdates *topic.Topic
+	// serializes writers
+	sync.Mutex
+}
+
+// limits for data that is put into the store.
+// They apply to data from other hosts only, not to local data.
+// A value of 0 means no limit.
+type StoreLimits struct {
+	// maximum payload bytes stored per source
+	MaxBytesPerSource int
+	// maximum number of data types stored per source
+	MaxTypesPerSource int
+	// maximum payload bytes of a single data item, by data type.
+	// PACKETTYPE_ALL sets the default for all other types.
+	MaxPayload map[uint8]int
 }
 
+// reasons for rejecting data
+const (
+	REJECT_PAYLOAD      = "payload"
+	REJECT_SOURCE_TYPES = "source_types"
+	REJECT_SOURCE_BYTES = "source_bytes"
+	REJECT_UNVERIFIED   = "unverified"
+	REJECT_HOOK         = "hook"
+)
+
 // send this to the store to put data into it (or update data)
 type ReqPut struct {
 	// flag that tells if the data origin is the local server
 	// instance (i.e. not propagated by another master server)
 	IsLocal bool
+	// flag that tells if the data came from another host without
+	// a valid signature. Such data does not replace data that was
+	// received with a valid signature (or locally).
+	Unverified bool
 	// actual data item
 	Data
 }
@@ -44,109 +123,612 @@ type ReqGetAll struct {
 	// if set to true, return only data that has its origin
 	// locally, i.e. was not propagated by another master server
 	LocalOnly bool
+	// if set to true, skip data that was received unverified
+	VerifiedOnly bool
 	// data will be sent back via this channel, it will get
 	// closed as soon as all data has been sent
 	Return chan<- Data
 }
 
-// used internally for purging runs
-type reqPurge struct{}
+// check if an entity is to be returned for the request
+func (r *ReqGetAll) matches(entity *storeEntity) bool {
+	if r.LocalOnly && !entity.Local {
+		return false
+	}
+	if r.VerifiedOnly && entity.Unverified {
+		return false
+	}
+	return true
+}
+
+// A read-only view of the store contents at one point in time.
+// It stays consistent no matter how the store changes afterwards.
+type StoreView struct {
+	// time the view was taken, data that had expired by then is
+	// left out even if it has not been purged yet
+	Time time.Time
+	view *storeView
+}
+
+// a data item in a StoreView, along with its metadata
+type StoreEntry struct {
+	Data
+	// time the data will be purged unless it is updated
+	Expires time.Time
+	// data has been put into the store locally
+	Local bool
+	// data came from another host without a valid signature
+	Unverified bool
+	// notes added by ingest hooks
+	Annotations map[string]string
+}
+
+// statistics about the store contents
+type StoreStats struct {
+	// number of entries, by packet type
+	Entries map[uint8]int
+	// bytes of payload stored, by packet type
+	Bytes map[uint8]int
+	// number of rejected data items, by reason (REJECT_*)
+	Rejected map[string]uint64
+	// number of update notifications dropped for subscribers that
+	// did not keep up
+	NotificationsDropped uint64
+}
+
+// on-disk format of the store contents
+type storeSnapshot struct {
+	Version  int
+	Entities []storeEntity
+}
+
+const storeSnapshotVersion = 1
+
+// maximum number of expiry index entries handled while holding the
+// lock, purging continues after letting writers in
+const purgeBatch = 1024
 
 // return a new store instance
 func NewStore(purgeAfter time.Duration, purgeInterval time.Duration) *Store {
 	s := &Store{
-		req:           make(chan interface{}),
-		db:            make(map[string]map[uint8]*storeEntity),
 		purgeAfter:    purgeAfter,
 		purgeInterval: purgeInterval,
+		retention:     make(map[uint8]time.Duration),
+		rejected:      make(map[string]uint64),
+		quit:          make(chan struct{}),
+		subscribers:   make(map[chan<- Data]struct{}),
 		NotifyUpdates: topic.New(),
 	}
-	go s.dispatch()
+	s.view.Store(&storeView{})
+	updates := make(chan Data, 100)
+	s.Subscribe(updates)
+	go s.purger()
+	go s.broadcaster(updates)
 	return s
 }
 
-// background task that will regularly trigger purge runs
-func (s *Store) purge(quit <-chan struct{}) {
-	select {
-	case <-quit:
-		return
-	case <-time.After(s.purgeInterval):
-		s.req <- reqPurge{}
-	}
-}
-
-// background task that does the actual data storage
-// and is fully synchronized by using channels
-func (s *Store) dispatch() {
-	quitPurge := make(chan struct{})
-	go s.purge(quitPurge)
-	for r := range s.req {
-		switch r := r.(type) {
-		case ReqPut:
-			source := r.Data.Source.String()
-			_, exists := s.db[source]
-			if !exists {
-				s.db[source] = make(map[uint8]*storeEntity)
-			}
-			t := r.Data.Header.Type
-			i, exists := s.db[source][t]
-			if !exists {
-				i = &storeEntity{}
-				s.db[source][t] = i
+// background task that passes notifications on to NotifyUpdates
+func (s *Store) broadcaster(updates chan Data) {
+	defer s.Unsubscribe(updates)
+	for {
+		select {
+		case <-s.quit:
+			return
+		case d := <-updates:
+			select {
+			case s.NotifyUpdates.Broadcast <- d:
+			case <-s.quit:
+				return
 			}
-			// can be set from false to true, but not the other
-			// way around:
-			if !i.Local {
-				i.Local = r.IsLocal
-			}
-			i.Invalid = time.Now().Add(s.purgeAfter)
-			if i.Data == nil || !i.Data.Equals(&r.Data) {
-				s.NotifyUpdates.Broadcast <- r.Data
+		}
+	}
+}
+
+// background task that regularly triggers purge runs
+func (s *Store) purger() {
+	ticker := time.NewTicker(s.purgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			s.purge()
+		}
+	}
+}
+
+// pick the shard for a source
+func storeShard(source string) int {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(source); i++ {
+		h ^= uint32(source[i])
+		h *= 16777619
+	}
+	return int(h % storeShards)
+}
+
+// return the entities of a source in a view, nil if there are none
+func (v *storeView) source(source string) map[uint8]*storeEntity {
+	return v.shards[storeShard(source)][source]
+}
+
+// changes to a view that are published at once. Shards are copied
+// when they are changed for the first time.
+type viewEdit struct {
+	view   storeView
+	copied [storeShards]bool
+}
+
+func newViewEdit(v *storeView) *viewEdit {
+	return &viewEdit{view: *v}
+}
+
+// replace the entities of a source, an empty map removes the source
+func (e *viewEdit) set(source string, types map[uint8]*storeEntity) {
+	i := storeShard(source)
+	if !e.copied[i] {
+		shard := make(map[string]map[uint8]*storeEntity, len(e.view.shards[i])+1)
+		for k, t := range e.view.shards[i] {
+			shard[k] = t
+		}
+		e.view.shards[i] = shard
+		e.copied[i] = true
+	}
+	if len(types) == 0 {
+		delete(e.view.shards[i], source)
+	} else {
+		e.view.shards[i][source] = types
+	}
+}
+
+// return a copy of the entities of a source with one of them replaced,
+// or removed if entity is nil
+func withEntity(types map[uint8]*storeEntity, packettype uint8, entity *storeEntity) map[uint8]*storeEntity {
+	n := make(map[uint8]*storeEntity, len(types)+1)
+	for t, e := range types {
+		n[t] = e
+	}
+	if entity == nil {
+		delete(n, packettype)
+	} else {
+		n[packettype] = entity
+	}
+	return n
+}
+
+// return the current contents, only to be modified while holding the
+// lock
+func (s *Store) current() *storeView {
+	return s.view.Load().(*storeView)
+}
+
+// return the time to keep data of a given type
+func (s *Store) retentionFor(packettype uint8) time.Duration {
+	if ttl, exists := s.retention[packettype]; exists {
+		return ttl
+	}
+	return s.purgeAfter
+}
+
+// check if data is within the configured limits.
+// Returns an empty string if so, the reason for rejection otherwise.
+func (s *Store) checkLimits(d *Data) string {
+	t := d.Header.Type
+	maxpayload, exists := s.limits.MaxPayload[t]
+	if !exists {
+		maxpayload = s.limits.MaxPayload[PACKETTYPE_ALL]
+	}
+	if maxpayload > 0 && len(d.Data) > maxpayload {
+		return REJECT_PAYLOAD
+	}
+	if s.limits.MaxTypesPerSource == 0 && s.limits.MaxBytesPerSource == 0 {
+		return ""
+	}
+	types := 0
+	bytes := len(d.Data)
+	for othertype, entity := range s.current().source(d.Source.String()) {
+		if othertype == t {
+			// will be replaced
+			continue
+		}
+		types++
+		bytes += len(entity.Data.Data)
+	}
+	if s.limits.MaxTypesPerSource > 0 && types+1 > s.limits.MaxTypesPerSource {
+		return REJECT_SOURCE_TYPES
+	}
+	if s.limits.MaxBytesPerSource > 0 && bytes > s.limits.MaxBytesPerSource {
+		return REJECT_SOURCE_BYTES
+	}
+	return ""
+}
+
+// Add a hook that is run for data of the given type before it is put
+// into the store, PACKETTYPE_ALL runs it for all data. Hooks are run
+// in the order they were added. Data restored from a file does not
+// pass the hooks.
+func (s *Store) AddHook(packettype uint8, hook IngestHook) {
+	s.Lock()
+	defer s.Unlock()
+	hooks := make([]ingestHook, len(s.hooks), len(s.hooks)+1)
+	copy(hooks, s.hooks)
+	s.hooks = append(hooks, ingestHook{packettype: packettype, hook: hook})
+}
+
+// run the ingest hooks on data, replacing it with what the hooks made
+// of it. Returns the annotations, or an error if a hook rejected it.
+func (s *Store) ingest(r *ReqPut) (map[string]string, error) {
+	s.Lock()
+	hooks := s.hooks
+	s.Unlock()
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	header := *r.Data.Header
+	d := &IngestData{
+		Data:       Data{Source: r.Data.Source, Header: &header, Data: r.Data.Data},
+		Local:      r.IsLocal,
+		Unverified: r.Unverified,
+	}
+	for _, h := range hooks {
+		if h.packettype != PACKETTYPE_ALL && h.packettype != d.Header.Type {
+			continue
+		}
+		if err := h.hook.Ingest(d); err != nil {
+			return nil, err
+		}
+	}
+	if d.Header == nil {
+		d.Header = &header
+	}
+	if len(d.Data.Data) > 0xFFFF {
+		return nil, errors.New("payload too large after ingest hooks")
+	}
+	d.Header.Length = uint16(len(d.Data.Data))
+	r.Data = d.Data
+	return d.Annotations, nil
+}
+
+// put data into the store
+func (s *Store) put(r ReqPut) {
+	// entities are shared, so the store keeps a header of its own
+	header := *r.Data.Header
+	header.Length = uint16(len(r.Data.Data))
+	r.Data.Header = &header
+	annotations, err := s.ingest(&r)
+	if err != nil {
+		s.Lock()
+		s.rejected[REJECT_HOOK]++
+		s.Unlock()
+		log.Printf("alfred/store: rejecting data type %d from %v: %v", r.Data.Header.Type, r.Data.Source, err)
+		return
+	}
+	s.Lock()
+	if !r.IsLocal {
+		if reason := s.checkLimits(&r.Data); reason != "" {
+			s.rejected[reason]++
+			s.Unlock()
+			log.Printf("alfred/store: rejecting data type %d from %v, over limit (%s)", r.Data.Header.Type, r.Data.Source, reason)
+			return
+		}
+	}
+	now := time.Now()
+	source := r.Data.Source.String()
+	t := r.Data.Header.Type
+	v := s.current()
+	types := v.source(source)
+	old, exists := types[t]
+	if exists && r.Unverified && !old.Unverified && old.Invalid.After(now) {
+		s.rejected[REJECT_UNVERIFIED]++
+		s.Unlock()
+		log.Printf("alfred/store: not replacing data type %d from %v with unverified data", t, r.Data.Source)
+		return
+	}
+	entity := &storeEntity{
+		Invalid:    now.Add(s.retentionFor(t)),
+		Unverified: r.Unverified,
+		// can be set from false to true, but not the other
+		// way around:
+		Local:       r.IsLocal || (exists && old.Local),
+		Annotations: annotations,
+		Data:        &r.Data,
+	}
+	edit := newViewEdit(v)
+	edit.set(source, withEntity(types, t, entity))
+	s.view.Store(&edit.view)
+	if !exists {
+		s.entities++
+	}
+	s.expiry.add(source, t, entity)
+	if s.expiry.Len() > 2*s.entities+purgeBatch {
+		s.expiry.rebuild(&edit.view)
+	}
+	s.Unlock()
+	if !exists || !old.Data.Equals(&r.Data) {
+		s.notify(r.Data)
+	}
+}
+
+// Register a channel to be notified about changed data. The store
+// never waits for subscribers: when the channel is full, the
+// notification is dropped (and counted in the stats), so the
+// channel should be buffered.
+func (s *Store) Subscribe(updates chan<- Data) {
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	s.subscribers[updates] = struct{}{}
+}
+
+// Stop notifying a channel registered with Subscribe. Nothing is sent
+// to it after this returns.
+func (s *Store) Unsubscribe(updates chan<- Data) {
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	delete(s.subscribers, updates)
+}
+
+// notify the subscribers about changed data, dropping the
+// notification for those that are not ready
+func (s *Store) notify(d Data) {
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	for updates := range s.subscribers {
+		select {
+		case updates <- d:
+		default:
+			s.notificationsDropped++
+		}
+	}
+}
+
+// remove expired data. This is done in batches, so writers are not
+// held up for long even if a lot of data expires at once.
+func (s *Store) purge() {
+	for {
+		s.Lock()
+		now := time.Now()
+		edit := newViewEdit(s.current())
+		removed := 0
+		for i := 0; i < purgeBatch && s.expiry.Len() > 0 && s.expiry.next().Before(now); i++ {
+			item := heap.Pop(&s.expiry).(expiryItem)
+			types := edit.view.source(item.source)
+			if entity, exists := types[item.packettype]; !exists || entity != item.entity {
+				// updated in the meantime
+				continue
 			}
-			i.Data = &r.Data
-		case ReqGetAll:
-			for _, types := range s.db {
-				if r.TypeFilter == PACKETTYPE_ALL {
-					for _, entity := range types {
-						if !r.LocalOnly || entity.Local {
-							r.Return <- *entity.Data
-						}
-					}
-				} else {
-					entity, exists := types[r.TypeFilter]
-					if exists {
-						if !r.LocalOnly || entity.Local {
-							r.Return <- *entity.Data
-						}
-					}
+			edit.set(item.source, withEntity(types, item.packettype, nil))
+			s.entities--
+			removed++
+		}
+		if removed > 0 {
+			s.view.Store(&edit.view)
+		}
+		more := s.expiry.Len() > 0 && s.expiry.next().Before(now)
+		s.Unlock()
+		if !more {
+			return
+		}
+	}
+}
+
+// Return a view of the current store contents. Taking a view is
+// cheap and does not block writers, the view can be held on to for as
+// long as needed.
+func (s *Store) View() *StoreView {
+	return &StoreView{Time: time.Now(), view: s.current()}
+}
+
+// call fn for every entity that was valid when the view was taken,
+// until fn returns false
+func (v *StoreView) each(fn func(source string, entity *storeEntity) bool) {
+	for _, shard := range v.view.shards {
+		for source, types := range shard {
+			for _, entity := range types {
+				if entity.Invalid.Before(v.Time) {
+					continue
 				}
-			}
-			close(r.Return)
-		case reqPurge:
-			now := time.Now()
-		restart:
-			for source, types := range s.db {
-				for t, entity := range types {
-					if entity.Invalid.Before(now) {
-						delete(s.db[source], t)
-						if len(s.db[source]) == 0 {
-							delete(s.db, source)
-						}
-						goto restart
-					}
+				if !fn(source, entity) {
+					return
 				}
 			}
 		}
 	}
-	quitPurge <- struct{}{}
+}
+
+func (e *storeEntity) entry() StoreEntry {
+	return StoreEntry{
+		Data:        *e.Data,
+		Expires:     e.Invalid,
+		Local:       e.Local,
+		Unverified:  e.Unverified,
+		Annotations: e.Annotations,
+	}
+}
+
+// Call fn for every data item in the view, in no particular order,
+// until it returns false
+func (v *StoreView) ForEach(fn func(StoreEntry) bool) {
+	v.each(func(_ string, entity *storeEntity) bool {
+		return fn(entity.entry())
+	})
+}
+
+// Look up the data of a given type from a given source
+func (v *StoreView) Get(source HardwareAddr, packettype uint8) (StoreEntry, bool) {
+	entity, exists := v.view.source(source.String())[packettype]
+	if !exists || entity.Invalid.Before(v.Time) {
+		return StoreEntry{}, false
+	}
+	return entity.entry(), true
+}
+
+// answer a ReqGetAll from the view
+func (v *StoreView) send(r ReqGetAll) {
+	defer close(r.Return)
+	if r.TypeFilter == PACKETTYPE_ALL {
+		v.each(func(_ string, entity *storeEntity) bool {
+			if r.matches(entity) {
+				r.Return <- *entity.Data
+			}
+			return true
+		})
+		return
+	}
+	for _, shard := range v.view.shards {
+		for _, types := range shard {
+			entity, exists := types[r.TypeFilter]
+			if exists && !entity.Invalid.Before(v.Time) && r.matches(entity) {
+				r.Return <- *entity.Data
+			}
+		}
+	}
+}
+
+// Set the time to keep data of a given type after it was last
+// updated. PACKETTYPE_ALL sets the default for all types that have
+// no specific setting. A TTL of 0 removes a type specific setting.
+// Data already in the store keeps its expiry time until it is updated.
+func (s *Store) SetRetention(packettype uint8, ttl time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if packettype == PACKETTYPE_ALL {
+		s.purgeAfter = ttl
+	} else if ttl == 0 {
+		delete(s.retention, packettype)
+	} else {
+		s.retention[packettype] = ttl
+	}
+}
+
+// Set limits for data from other hosts. Data already in the store
+// is not affected.
+func (s *Store) SetLimits(limits StoreLimits) {
+	s.Lock()
+	defer s.Unlock()
+	s.limits = limits
+}
+
+// return the effective retention times: the default (for
+// PACKETTYPE_ALL) and the type specific ones
+func (s *Store) Retention() map[uint8]time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	retention := map[uint8]time.Duration{PACKETTYPE_ALL: s.purgeAfter}
+	for t, ttl := range s.retention {
+		retention[t] = ttl
+	}
+	return retention
+}
+
+// return statistics about the store contents
+func (s *Store) Stats() StoreStats {
+	stats := StoreStats{
+		Entries:  make(map[uint8]int),
+		Bytes:    make(map[uint8]int),
+		Rejected: make(map[string]uint64),
+	}
+	s.View().each(func(_ string, entity *storeEntity) bool {
+		stats.Entries[entity.Header.Type]++
+		stats.Bytes[entity.Header.Type] += len(entity.Data.Data)
+		return true
+	})
+	s.Lock()
+	for reason, c := range s.rejected {
+		stats.Rejected[reason] = c
+	}
+	s.Unlock()
+	s.notifyLock.Lock()
+	stats.NotificationsDropped = s.notificationsDropped
+	s.notifyLock.Unlock()
+	return stats
+}
+
+// write the store contents to a file.
+// The data is written to a temporary file first which then replaces
+// the given file.
+func (s *Store) Save(filename string) error {
+	snapshot := storeSnapshot{Version: storeSnapshotVersion, Entities: make([]storeEntity, 0)}
+	s.View().each(func(_ string, entity *storeEntity) bool {
+		snapshot.Entities = append(snapshot.Entities, *entity)
+		return true
+	})
+	tmpfile := filename + ".tmp"
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&snapshot)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return os.Rename(tmpfile, filename)
+}
+
+// read store contents from a file written by Save.
+// Data that has expired in the meantime is skipped, and so is data
+// that is already present in the store.
+func (s *Store) Load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	snapshot := storeSnapshot{}
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != storeSnapshotVersion {
+		return ErrSnapshotVersion
+	}
+	s.restore(snapshot.Entities)
+	return nil
+}
+
+// put entities read from a file into the store
+func (s *Store) restore(entities []storeEntity) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	edit := newViewEdit(s.current())
+	for i, _ := range entities {
+		entity := &entities[i]
+		if entity.Data == nil || entity.Data.Header == nil || entity.Invalid.Before(now) {
+			continue
+		}
+		source := entity.Data.Source.String()
+		t := entity.Data.Header.Type
+		types := edit.view.source(source)
+		if _, exists := types[t]; exists {
+			// do not overwrite data we already got
+			continue
+		}
+		edit.set(source, withEntity(types, t, entity))
+		s.entities++
+		s.expiry.add(source, t, entity)
+	}
+	s.view.Store(&edit.view)
 }
 
 // shutdown data store and spawned tasks
 func (s *Store) Shutdown() {
-	close(s.req)
+	close(s.quit)
 }
 
-// send a request to the store
+// Send a request to the store. ReqPut is done when this returns.
+// For ReqGetAll, the data is sent from a goroutine of its own, taken
+// from a view of the store contents at the time of the request, so a
+// slow receiver holds up nobody but itself.
 func (s *Store) Request(req interface{}) {
-	s.req <- req
+	switch r := req.(type) {
+	case ReqPut:
+		s.put(r)
+	case ReqGetAll:
+		go s.View().send(r)
+	}
 }
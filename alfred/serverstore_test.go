@@ -0,0 +1,441 @@
+package alfred
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a store that is not purged during a test
+func testStore(t testing.TB) *Store {
+	s := NewStore(time.Hour, time.Hour)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func storeGet(s *Store, source byte, packettype uint8) (StoreEntry, bool) {
+	return s.View().Get(HardwareAddr{0x02, 0, 0, 0, 0, source}, packettype)
+}
+
+func TestStoreReplace(t *testing.T) {
+	s := testStore(t)
+	s.Request(ReqPut{Data: testData(1, 100, "first"), IsLocal: true})
+	s.Request(ReqPut{Data: testData(1, 100, "second")})
+	e, ok := storeGet(s, 1, 100)
+	if !ok || string(e.Data.Data) != "second" {
+		t.Fatalf("got %q, want the replacement", e.Data.Data)
+	}
+	if !e.Local {
+		t.Error("data put locally is no longer marked as local")
+	}
+	if e.Header.Length != uint16(len("second")) {
+		t.Errorf("header length %d", e.Header.Length)
+	}
+
+	// unverified data does not replace verified data
+	s.Request(ReqPut{Data: testData(1, 100, "unverified"), Unverified: true})
+	if e, _ := storeGet(s, 1, 100); string(e.Data.Data) != "second" {
+		t.Errorf("verified data replaced by %q", e.Data.Data)
+	}
+	if c := s.Stats().Rejected[REJECT_UNVERIFIED]; c != 1 {
+		t.Errorf("%d rejected as unverified, want 1", c)
+	}
+	// but unverified data may be replaced
+	s.Request(ReqPut{Data: testData(2, 100, "unverified"), Unverified: true})
+	s.Request(ReqPut{Data: testData(2, 100, "verified")})
+	if e, _ := storeGet(s, 2, 100); string(e.Data.Data) != "verified" || e.Unverified {
+		t.Errorf("unverified data not replaced: %+v", e)
+	}
+	if n := s.Stats().Entries[100]; n != 2 {
+		t.Errorf("%d entries, want 2", n)
+	}
+}
+
+// the store must not keep references to the data it was given
+func TestStorePutCopiesHeader(t *testing.T) {
+	s := testStore(t)
+	d := testData(1, 100, "payload")
+	d.Header.Length = 1
+	s.Request(ReqPut{Data: d})
+	d.Header.Type = 101
+	e, ok := storeGet(s, 1, 100)
+	if !ok || e.Header.Type != 100 || e.Header.Length != uint16(len("payload")) {
+		t.Errorf("stored header %+v", e.Header)
+	}
+}
+
+func TestStoreViewConsistency(t *testing.T) {
+	s := testStore(t)
+	for i := 0; i < 100; i++ {
+		s.Request(ReqPut{Data: testData(byte(i), 100, "old")})
+	}
+	view := s.View()
+	for i := 0; i < 100; i++ {
+		s.Request(ReqPut{Data: testData(byte(i), 100, "new")})
+		s.Request(ReqPut{Data: testData(byte(i), 101, "new")})
+	}
+	n := 0
+	view.ForEach(func(e StoreEntry) bool {
+		n++
+		if string(e.Data.Data) != "old" {
+			t.Errorf("view changed: %v has %q", e.Source, e.Data.Data)
+		}
+		return true
+	})
+	if n != 100 {
+		t.Errorf("view has %d entries, want 100", n)
+	}
+	if n := len(s.Stats().Entries); n != 2 {
+		t.Errorf("store has %d types, want 2", n)
+	}
+}
+
+// readers see either the old or the new state of a data item while
+// it is replaced concurrently, never anything in between
+func TestStoreConcurrentViews(t *testing.T) {
+	s := testStore(t)
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				payload := "even"
+				if j%2 == 1 {
+					payload = "odd"
+				}
+				s.Request(ReqPut{Data: testData(byte(i), uint8(100+j%3), payload)})
+			}
+		}(i)
+	}
+	for i := 0; i < 200; i++ {
+		data := make(chan Data)
+		s.Request(ReqGetAll{TypeFilter: PACKETTYPE_ALL, Return: data})
+		for d := range data {
+			if p := string(d.Data); p != "even" && p != "odd" || int(d.Header.Length) != len(p) {
+				t.Fatalf("inconsistent data %+v %q", d.Header, p)
+			}
+		}
+	}
+	close(quit)
+	wg.Wait()
+}
+
+func TestStorePurge(t *testing.T) {
+	s := testStore(t)
+	s.SetRetention(100, time.Millisecond)
+	s.Request(ReqPut{Data: testData(1, 100, "expires")})
+	s.Request(ReqPut{Data: testData(1, 101, "stays")})
+	s.Request(ReqPut{Data: testData(2, 100, "expires")})
+	view := s.View()
+	time.Sleep(10 * time.Millisecond)
+
+	// expired data is left out before it is purged
+	if _, ok := storeGet(s, 1, 100); ok {
+		t.Error("expired data returned")
+	}
+	s.purge()
+	if n := s.entities; n != 1 {
+		t.Errorf("%d entities after purging, want 1", n)
+	}
+	if _, ok := storeGet(s, 1, 101); !ok {
+		t.Error("data purged before it expired")
+	}
+	if _, ok := view.view.source(HardwareAddr{0x02, 0, 0, 0, 0, 2}.String())[100]; !ok {
+		t.Error("purging changed an older view")
+	}
+
+	// data that is updated in time is not purged
+	s.SetRetention(101, 20*time.Millisecond)
+	s.Request(ReqPut{Data: testData(3, 101, "updated")})
+	time.Sleep(10 * time.Millisecond)
+	s.Request(ReqPut{Data: testData(3, 101, "updated again")})
+	time.Sleep(15 * time.Millisecond)
+	s.purge()
+	if _, ok := storeGet(s, 3, 101); !ok {
+		t.Error("updated data purged")
+	}
+}
+
+func TestStoreSaveLoad(t *testing.T) {
+	s := testStore(t)
+	s.Request(ReqPut{Data: testData(1, 100, "saved"), IsLocal: true})
+	s.Request(ReqPut{Data: testData(2, 101, "saved")})
+	filename := filepath.Join(t.TempDir(), "store")
+	if err := s.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded := testStore(t)
+	loaded.Request(ReqPut{Data: testData(2, 101, "newer")})
+	if err := loaded.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := storeGet(loaded, 1, 100); !ok || string(e.Data.Data) != "saved" || !e.Local {
+		t.Errorf("data not restored: %+v", e)
+	}
+	if e, _ := storeGet(loaded, 2, 101); string(e.Data.Data) != "newer" {
+		t.Errorf("restored data replaced newer data: %q", e.Data.Data)
+	}
+}
+
+func TestStoreNotify(t *testing.T) {
+	s := testStore(t)
+	updates := make(chan Data, 1)
+	s.Subscribe(updates)
+	s.Request(ReqPut{Data: testData(1, 100, "first")})
+	// nobody reads, so this must not block
+	s.Request(ReqPut{Data: testData(1, 100, "second")})
+	// unchanged data is not notified
+	s.Request(ReqPut{Data: testData(1, 100, "second")})
+	if d := <-updates; string(d.Data) != "first" {
+		t.Errorf("got notification for %q", d.Data)
+	}
+	if n := s.Stats().NotificationsDropped; n != 1 {
+		t.Errorf("%d notifications dropped, want 1", n)
+	}
+	s.Unsubscribe(updates)
+	s.Request(ReqPut{Data: testData(1, 100, "third")})
+	select {
+	case d := <-updates:
+		t.Errorf("notified after unsubscribing: %q", d.Data)
+	default:
+	}
+}
+
+func TestStoreNotifyUpdates(t *testing.T) {
+	s := testStore(t)
+	// never read until all data is put
+	updates := make(chan interface{})
+	s.NotifyUpdates.Register(updates)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 500; i++ {
+			s.Request(ReqPut{Data: testData(1, 100, fmt.Sprintf("item %d", i))})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writers held up by a receiver of NotifyUpdates")
+	}
+	if d, ok := (<-updates).(Data); !ok || string(d.Data) != "item 0" {
+		t.Errorf("got notification %+v", d)
+	}
+	go func() {
+		for range updates {
+		}
+	}()
+	s.NotifyUpdates.Unregister(updates)
+}
+
+// benchmarks for the store filled with data of many sources
+
+const (
+	benchSources = 5000
+	benchTypes   = 3
+	benchPayload = 512
+	// readers fetching all data while data is put
+	benchReaders = 32
+	// time the slow readers take per data item
+	benchSlowness = 100 * time.Microsecond
+)
+
+// data items put into the stores, indexed by source and type
+var benchItems [][]Data
+
+func makeBenchItems() {
+	if benchItems != nil {
+		return
+	}
+	benchItems = make([][]Data, benchSources)
+	for i := range benchItems {
+		source := HardwareAddr{0x02, 0, byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}
+		benchItems[i] = make([]Data, benchTypes)
+		for t := range benchItems[i] {
+			benchItems[i][t] = Data{
+				Source: source,
+				Header: &TLV{
+					Type:    uint8(ALFRED_MAX_RESERVED_TYPE + t),
+					Version: 0,
+					Length:  benchPayload,
+				},
+				Data: make([]byte, benchPayload),
+			}
+		}
+	}
+}
+
+// return a store filled with all data items, along with a subscriber
+// to its update notifications
+func benchStore(b *testing.B) *Store {
+	makeBenchItems()
+	store := testStore(b)
+	for i := range benchItems {
+		for _, d := range benchItems[i] {
+			store.Request(ReqPut{Data: d})
+		}
+	}
+	updates := make(chan Data, 100)
+	store.Subscribe(updates)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case <-updates:
+			}
+		}
+	}()
+	b.Cleanup(func() { close(quit) })
+	return store
+}
+
+// put a random data item
+func benchPut(store *Store, rnd *rand.Rand) {
+	d := benchItems[rnd.Intn(len(benchItems))][rnd.Intn(benchTypes)]
+	store.Request(ReqPut{Data: d})
+}
+
+// fetch data from the store, returns the number of items
+func benchGetAll(store *Store, typefilter uint8) int {
+	data := make(chan Data)
+	store.Request(ReqGetAll{TypeFilter: typefilter, Return: data})
+	n := 0
+	for _ = range data {
+		n++
+	}
+	return n
+}
+
+// run a task in the background until the benchmark is done
+func benchBackground(b *testing.B, task func(quit <-chan struct{})) {
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		task(quit)
+	}()
+	b.Cleanup(func() {
+		close(quit)
+		wg.Wait()
+	})
+}
+
+// continuously put data
+func benchWriter(store *Store) func(quit <-chan struct{}) {
+	return func(quit <-chan struct{}) {
+		rnd := rand.New(rand.NewSource(1))
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+				benchPut(store, rnd)
+			}
+		}
+	}
+}
+
+// fetch all data, slowly
+func benchSlowReader(store *Store) func(quit <-chan struct{}) {
+	return func(quit <-chan struct{}) {
+		data := make(chan Data)
+		store.Request(ReqGetAll{TypeFilter: PACKETTYPE_ALL, Return: data})
+		for {
+			select {
+			case <-quit:
+				// let the store finish sending
+				for _ = range data {
+				}
+				return
+			case _, ok := <-data:
+				if !ok {
+					data = make(chan Data)
+					store.Request(ReqGetAll{TypeFilter: PACKETTYPE_ALL, Return: data})
+					continue
+				}
+				time.Sleep(benchSlowness)
+			}
+		}
+	}
+}
+
+func BenchmarkStorePut(b *testing.B) {
+	store := benchStore(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			benchPut(store, rnd)
+		}
+	})
+}
+
+func BenchmarkStorePutSlowReaders(b *testing.B) {
+	store := benchStore(b)
+	for i := 0; i < benchReaders; i++ {
+		benchBackground(b, benchSlowReader(store))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			benchPut(store, rnd)
+		}
+	})
+	b.StopTimer()
+}
+
+func benchmarkStoreGet(b *testing.B, typefilter uint8) {
+	store := benchStore(b)
+	benchBackground(b, benchWriter(store))
+	b.ResetTimer()
+	var mutex sync.Mutex
+	total := 0
+	b.RunParallel(func(pb *testing.PB) {
+		n := 0
+		for pb.Next() {
+			n += benchGetAll(store, typefilter)
+		}
+		mutex.Lock()
+		total += n
+		mutex.Unlock()
+	})
+	b.ReportMetric(float64(total)/float64(b.N), "items/op")
+}
+
+func BenchmarkStoreGetAll(b *testing.B) {
+	benchmarkStoreGet(b, PACKETTYPE_ALL)
+}
+
+func BenchmarkStoreGetType(b *testing.B) {
+	benchmarkStoreGet(b, ALFRED_MAX_RESERVED_TYPE)
+}
+
+func BenchmarkStoreView(b *testing.B) {
+	store := benchStore(b)
+	benchBackground(b, benchWriter(store))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			d := benchItems[rnd.Intn(len(benchItems))][rnd.Intn(benchTypes)]
+			if _, exists := store.View().Get(d.Source, d.Header.Type); !exists {
+				b.Error("data item not found")
+				return
+			}
+		}
+	})
+}
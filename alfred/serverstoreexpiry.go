@@ -0,0 +1,73 @@
+package alfred
+
+// index of the expiry times of the data in the store, so purging
+// does not need to look at data that is still valid
+
+import (
+	"container/heap"
+	"time"
+)
+
+// an entity in the expiry index. Updating data does not remove the
+// entry for the old entity, it is skipped when it turns up.
+type expiryItem struct {
+	invalid    time.Time
+	source     string
+	packettype uint8
+	entity     *storeEntity
+}
+
+// min-heap of expiry times, see container/heap
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].invalid.Before(h[j].invalid) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiryItem))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	// do not keep the entity alive
+	old[len(old)-1] = expiryItem{}
+	*h = old[:len(old)-1]
+	return item
+}
+
+// add an entity to the index
+func (h *expiryHeap) add(source string, packettype uint8, entity *storeEntity) {
+	heap.Push(h, expiryItem{
+		invalid:    entity.Invalid,
+		source:     source,
+		packettype: packettype,
+		entity:     entity,
+	})
+}
+
+// return the earliest expiry time, the index must not be empty
+func (h expiryHeap) next() time.Time {
+	return h[0].invalid
+}
+
+// rebuild the index from the entities in a view, dropping the entries
+// of replaced entities
+func (h *expiryHeap) rebuild(v *storeView) {
+	items := make(expiryHeap, 0, len(*h)/2)
+	for _, shard := range v.shards {
+		for source, types := range shard {
+			for t, entity := range types {
+				items = append(items, expiryItem{
+					invalid:    entity.Invalid,
+					source:     source,
+					packettype: t,
+					entity:     entity,
+				})
+			}
+		}
+	}
+	heap.Init(&items)
+	*h = items
+}
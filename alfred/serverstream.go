@@ -4,17 +4,26 @@ package alfred
 
 import (
 	"bufio"
+	"crypto/tls"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // this is for stream (TCP, Unix) sockets' state
 type listenerStream struct {
 	listener net.Listener
-	wg       sync.WaitGroup
-	quit     chan struct{}
+	// access control, nil if everything is allowed
+	policy *StreamPolicy
+	// set for TLS secured listeners
+	secure bool
+	wg     sync.WaitGroup
+	quit   chan struct{}
+	// will be closed when the listener shuts down, for signalling
+	// long running connection handlers
+	closing chan struct{}
 }
 
 // passes a connection to the data sender, returns
@@ -24,7 +33,18 @@ func (s *Server) dataSenderStream(c net.Conn, txid uint16) (chan<- Data, error)
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		s.sendData(c, txid, data, true)
+		defer c.Close()
+		cbuf := bufio.NewWriter(c)
+		s.sendData(func(p Packet) error {
+			err := p.Write(cbuf)
+			if err == nil {
+				err = cbuf.Flush()
+			}
+			if err == nil {
+				s.metrics.sent(p)
+			}
+			return err
+		}, txid, data, true, false, s.primaryHardwareAddr())
 	}()
 	return data, nil
 }
@@ -41,27 +61,52 @@ func (s *Server) listenStream(l *listenerStream) {
 		l.wg.Add(1)
 		go func() {
 			defer l.wg.Done()
-			s.readStream(conn)
+			s.readStream(l, conn)
 		}()
 	}
 }
 
 // handle a single connection
-func (s *Server) readStream(conn net.Conn) {
+func (s *Server) readStream(l *listenerStream, conn net.Conn) {
 	pkg, err, _ := Read(conn)
 	if err != nil {
-		log.Printf("alfred/server: cannot parse data just received: %v (%+v)", err, pkg)
+		if _, ok := err.(*DecodeError); ok {
+			atomic.AddUint64(&s.metrics.packetsInvalid, 1)
+		}
+		log.Printf("alfred/server: cannot parse data just received: %v", err)
+		conn.Close()
 		return
 	}
+	s.metrics.received(pkg)
+	if l.policy != nil {
+		op := streamOperation(pkg)
+		peer := newStreamPeer(conn)
+		if !l.policy.Permits(peer, op) {
+			log.Printf("alfred/server: denied operation %d for peer %+v on %v", op, peer, l.listener.Addr())
+			atomic.AddUint64(&s.metrics.streamDenied, 1)
+			if req, ok := pkg.(*RequestV0); ok {
+				// let the client know instead of just hanging up
+				stat := NewStatusV0(ALFRED_STATUS_ERROR, &TransactionMgmt{Id: req.TxId, SeqNo: 0})
+				cbuf := bufio.NewWriter(conn)
+				if stat.Write(cbuf) == nil && cbuf.Flush() == nil {
+					s.metrics.sent(stat)
+				}
+			}
+			conn.Close()
+			return
+		}
+	}
 	switch pkg := pkg.(type) {
 	case *RequestV0:
 		log.Printf("alfred/server: got a request!")
 		if s.Mode == SERVER_MODE_SLAVE {
-			if m := s.getPreferredMaster(); m.address != nil {
+			if m := s.getPreferredMaster(nil); m.address != nil {
 				// forward request to master
-				done := make(chan struct{})
-				id := s.initiateTransaction(done)
-				request(m.address, NewRequestV0(pkg.RequestedType, id))
+				// buffered, a reply after the timeout must not
+				// keep the transaction from finishing
+				done := make(chan struct{}, 1)
+				id := s.initiateTransaction(done, m.address)
+				request(m.listenerudp, m.address, NewRequestV0(pkg.RequestedType, id))
 				select {
 				case <-time.After(s.WaitForMasterReply):
 					log.Printf("alfred/server: timeout when waiting for reply to forwarded request")
@@ -76,8 +121,9 @@ func (s *Server) readStream(conn net.Conn) {
 		reporterror:
 			stat := NewStatusV0(ALFRED_STATUS_ERROR, &TransactionMgmt{Id: pkg.TxId, SeqNo: 0})
 			cbuf := bufio.NewWriter(conn)
-			stat.Write(cbuf)
-			cbuf.Flush()
+			if stat.Write(cbuf) == nil && cbuf.Flush() == nil {
+				s.metrics.sent(stat)
+			}
 			conn.Close()
 			return
 		}
@@ -90,19 +136,17 @@ func (s *Server) readStream(conn net.Conn) {
 	case *PushDataV0:
 		defer conn.Close()
 		log.Printf("alfred/server: got data")
+		// local data without source address is stored as it is,
+		// the address of the interface the data is sent out on
+		// will be filled in when sending it
 		for i, _ := range pkg.Data {
 			if pkg.Data[i].Source.IsUnset() {
-				if s.firstInterface == nil {
-					log.Printf("alfred/server: want to store data but don't have an interface address, skipping.")
-					return
-				} else {
-					pkg.Data[i].Source = s.firstInterface
-				}
+				pkg.Data[i].Source = NullHardwareAddr
 			}
 		}
-		t := s.getTransaction(pkg.Tx.Id, true)
-		t.feed <- pkg
-		t.complete <- pkg.Tx.SeqNo + 1
+		t, _ := s.getTransaction(pkg.Tx.Id, nil, true)
+		t.push(pkg)
+		t.end(pkg.Tx.SeqNo + 1)
 	case *ModeSwitchV0:
 		defer conn.Close()
 		switch pkg.Mode {
@@ -116,21 +160,79 @@ func (s *Server) readStream(conn net.Conn) {
 			log.Printf("alfred/server: switching mode to stealth master mode")
 			s.Mode = SERVER_MODE_STEALTH_MASTER
 		}
+	case *ServerStatusReqV0:
+		defer conn.Close()
+		log.Printf("alfred/server: got a status request")
+		cbuf := bufio.NewWriter(conn)
+		status := s.status(pkg.Tx)
+		err := status.Write(cbuf)
+		if err == nil {
+			err = cbuf.Flush()
+		}
+		if err == nil {
+			s.metrics.sent(status)
+		} else {
+			log.Printf("alfred/server: error sending status: %v", err)
+		}
+	case *EventRegisterV0:
+		defer conn.Close()
+		log.Printf("alfred/server: got an event registration")
+		s.serveEvents(l, conn)
 	case *ChangeInterfaceV0:
 		defer conn.Close()
-		log.Printf("alfred/server: got a request to change interfaces - unimplemented!")
+		ifaces := pkg.Interfaces()
+		log.Printf("alfred/server: got a request to change interfaces to %v", ifaces)
+		if len(ifaces) == 0 {
+			log.Printf("alfred/server: no interfaces given, ignoring request")
+			return
+		}
+		if err := s.ChangeInterfaces(ifaces); err != nil {
+			log.Printf("alfred/server: error changing interfaces: %v", err)
+		}
+	default:
+		// nothing to do for other packets
+		conn.Close()
 	}
 }
 
 // start a task for listening on a TCP or Unix socket
 func (s *Server) NewListenerStream(network string, address string) error {
+	return s.NewListenerStreamPolicy(network, address, nil)
+}
+
+// start a task for listening on a TCP or Unix socket, allowing only
+// the operations granted by the given policy to clients. A nil policy
+// allows everything.
+func (s *Server) NewListenerStreamPolicy(network string, address string, policy *StreamPolicy) error {
 	listener, err := net.Listen(network, address)
 	if err != nil {
 		return err
 	}
+	s.newListenerStream(listener, policy, false)
+	return nil
+}
+
+// start a task for listening on a TCP socket for TLS connections,
+// using the given TLS configuration (see NewServerTLSConfig), and
+// allowing only the operations granted by the given policy to
+// clients. A nil policy allows everything.
+func (s *Server) NewListenerStreamTLS(address string, config *tls.Config, policy *StreamPolicy) error {
+	listener, err := tls.Listen("tcp", address, config)
+	if err != nil {
+		return err
+	}
+	s.newListenerStream(listener, policy, true)
+	return nil
+}
+
+// spawn the tasks serving a stream listener
+func (s *Server) newListenerStream(listener net.Listener, policy *StreamPolicy, secure bool) {
 	l := &listenerStream{
 		listener: listener,
+		policy:   policy,
+		secure:   secure,
 		quit:     make(chan struct{}),
+		closing:  make(chan struct{}),
 	}
 	s.wg.Add(1)
 	go func() {
@@ -142,6 +244,7 @@ func (s *Server) NewListenerStream(network string, address string) error {
 		}()
 		<-l.quit
 		l.listener.Close()
+		close(l.closing)
 		l.wg.Wait()
 		s.Lock()
 		defer s.Unlock()
@@ -150,5 +253,4 @@ func (s *Server) NewListenerStream(network string, address string) error {
 	s.Lock()
 	defer s.Unlock()
 	s.listenersstream[l] = struct{}{}
-	return nil
 }
@@ -2,6 +2,10 @@ package alfred
 
 import (
 	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,10 +14,118 @@ import (
 // we keep track of open transactions. Every transaction's state data
 // is stored in a struct like this
 type transaction struct {
-	start    time.Time
-	feed     chan<- *PushDataV0
-	abort    chan<- interface{}
-	complete chan<- uint16 // the final sequence number
+	start time.Time
+	// address of the host that started the transaction, empty for
+	// transactions started locally
+	source string
+	local  bool
+	feed   chan<- *PushDataV0
+	abort  chan<- interface{}
+	// the final sequence number
+	complete chan<- uint16
+	// signature, when synchronization is secured by a shared secret
+	signature chan<- *SignatureV0
+	// closed when the transaction has stopped, nobody receives
+	// from the channels above after that
+	done <-chan struct{}
+	// what has arrived so far, for inspection
+	progress *transactionProgress
+}
+
+// transactions are told apart by the host sending the data and their
+// ID, so other hosts cannot meddle with a transaction by using its ID
+type transactionKey struct {
+	// IP address of the host the data comes from, empty for data
+	// from local clients
+	peer string
+	id   uint16
+}
+
+// the state of a transaction as seen from the outside, updated by the
+// task handling the transaction
+type transactionProgress struct {
+	seqnos   []uint16
+	bytes    int
+	finalseq int
+	signed   bool
+	sync.Mutex
+}
+
+// information about an open transaction
+type TransactionInfo struct {
+	Id uint16
+	// address of the host that started the transaction, empty for
+	// transactions started locally
+	Source string
+	// data has its origin locally
+	Local bool
+	Start time.Time
+	// sequence numbers of the data packets received so far
+	SeqNos []uint16
+	// data bytes received so far
+	Bytes int
+	// the number of data packets announced by the final packet, -1
+	// if it has not arrived yet
+	FinalSeqNo int
+	// a signature has arrived
+	Signed bool
+}
+
+// limits for transactions started by other hosts. They protect
+// against floods of packets with made up transaction IDs, which
+// would otherwise have the server buffer data for each of them.
+// A value of 0 means no limit.
+type TransactionLimits struct {
+	// maximum number of open transactions. When it is reached, the
+	// oldest transaction of the host with the most open transactions
+	// is evicted to make room.
+	MaxOpen int
+	// maximum number of open transactions per host, further
+	// transactions are rejected
+	MaxOpenPerSource int
+	// maximum number of data bytes buffered for a transaction until
+	// it is complete, larger transactions are dropped
+	MaxBytes int
+}
+
+// reasons for rejecting transactions
+const (
+	REJECT_TX_OPEN   = "open"
+	REJECT_TX_SOURCE = "source"
+)
+
+// stop a transaction, never blocks
+func (t *transaction) stop() {
+	select {
+	case t.abort <- struct{}{}:
+	default:
+		// already stopping
+	}
+}
+
+// The following hand packets to a transaction. They block until the
+// transaction has taken the packet, or has stopped, in which case the
+// packet is dropped.
+
+func (t *transaction) push(pd *PushDataV0) {
+	select {
+	case t.feed <- pd:
+	case <-t.done:
+	}
+}
+
+func (t *transaction) end(finalseq uint16) {
+	select {
+	case t.complete <- finalseq:
+	case <-t.done:
+	}
+}
+
+func (t *transaction) sign(sig *SignatureV0) {
+	select {
+	case t.signature <- sig:
+	case <-t.done:
+	}
 }
 
 // start a transaction with a given ID
@@ -26,46 +138,95 @@ type transaction struct {
 // collect data until signaled that the final packet has arrived.
 // then it will check if the transaction was fully received and if so,
 // it will store the data to the database.
-func (s *Server) startTransaction(id uint16, done chan<- struct{}, islocal bool) *transaction {
+// Only to be called while holding the lock.
+func (s *Server) startTransaction(key transactionKey, done chan<- struct{}, islocal bool, source string) *transaction {
+	id := key.id
 	feed := make(chan *PushDataV0, 1)
 	abort := make(chan interface{}, 1)
 	complete := make(chan uint16, 1)
 	reallycomplete := make(chan uint16, 1)
+	signature := make(chan *SignatureV0, 1)
+	stopped := make(chan struct{})
 	t := &transaction{
-		start:    time.Now(),
-		feed:     feed,
-		abort:    abort,
-		complete: complete,
+		start:     time.Now(),
+		source:    source,
+		local:     islocal,
+		feed:      feed,
+		abort:     abort,
+		complete:  complete,
+		signature: signature,
+		done:      stopped,
+		progress:  &transactionProgress{finalseq: -1},
+	}
+	if s.transactionsClosed {
+		// packets still being handled during shutdown must not
+		// start a task that nobody stops anymore, the transaction
+		// drops whatever is handed to it
+		close(stopped)
+		return t
+	}
+	atomic.AddUint64(&s.metrics.transactionsStarted, 1)
+	maxbytes := 0
+	if source != "" {
+		maxbytes = s.TransactionLimits.MaxBytes
 	}
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
 		// keep track of the individual sequence parts
 		seqmap := make(map[uint16]*PushDataV0)
+		// data bytes buffered in seqmap
+		buffered := 0
+		var sig *SignatureV0
+		// set when the final packet has arrived, but parts of
+		// the transaction are still missing
+		waiting := false
+		var waitseq uint16
+		// check if everything has arrived
+		ready := func(finalseq uint16) bool {
+			for i := uint16(0); i < finalseq; i++ {
+				if _, exists := seqmap[i]; !exists {
+					return false
+				}
+			}
+			// the signature might still be on its way, there
+			// is none without data
+			return finalseq == 0 || s.SyncSecret == nil || islocal || sig != nil
+		}
+		// never blocks, it is fine to drop duplicate signals
+		finish := func(finalseq uint16) {
+			select {
+			case reallycomplete <- finalseq:
+			default:
+			}
+		}
 		for {
 			select {
 			case <-abort:
 				goto stop
 			case finalseq := <-complete:
-				// first, check if we got all packets
-				for i := uint16(0); i < finalseq; i++ {
-					_, exists := seqmap[i]
-					if !exists {
-						goto wait
-					}
+				if waiting && finalseq == waitseq {
+					// repeated final packet
+					break
+				}
+				t.progress.Lock()
+				t.progress.finalseq = int(finalseq)
+				t.progress.Unlock()
+				if ready(finalseq) {
+					finish(finalseq)
+					break
 				}
-				reallycomplete <- finalseq
-				break
-			wait:
 				// wait some time even after being marked as complete
 				// to really finish things up -- we might get the
 				// packets back in mixed order, which holds true for
 				// the final packet, too.
+				waiting = true
+				waitseq = finalseq
 				s.wg.Add(1)
 				go func() {
 					defer s.wg.Done()
 					<-time.After(s.TransactionWaitComplete)
-					reallycomplete <- finalseq
+					finish(finalseq)
 				}()
 			case finalseq := <-reallycomplete:
 				// now, everything should have been arrived.
@@ -74,33 +235,83 @@ func (s *Server) startTransaction(id uint16, done chan<- struct{}, islocal bool)
 						_, exists := seqmap[i]
 						if !exists {
 							log.Printf("alfred/server: dropping incomplete transaction %v", id)
+							atomic.AddUint64(&s.metrics.transactionsDropped, 1)
 							goto stop
 						}
 					}
 				}
+				unverified := false
+				if s.SyncSecret != nil && !islocal && finalseq > 0 {
+					if !VerifyTransaction(s.SyncSecret, sig, seqmap) {
+						log.Printf("alfred/server: transaction %v is not signed properly, will not propagate its data", id)
+						atomic.AddUint64(&s.metrics.transactionsUnverified, 1)
+						unverified = true
+					} else if err := s.replays.check(sig, time.Now(), s.SignatureMaxAge); err != nil {
+						log.Printf("alfred/server: dropping transaction %v: %v", id, err)
+						atomic.AddUint64(&s.metrics.transactionsReplayed, 1)
+						goto stop
+					}
+				}
 				// put data into store
 				for _, pd := range seqmap {
 					for _, d := range pd.Data {
 						s.store.Request(ReqPut{
-							IsLocal: islocal,
-							Data:    d,
+							IsLocal:    islocal,
+							Unverified: unverified,
+							Data:       d,
 						})
 					}
 				}
+				atomic.AddUint64(&s.metrics.transactionsCompleted, 1)
 				if done != nil {
-					// send signal that transaction is done
-					done <- struct{}{}
+					// send signal that transaction is done, nobody
+					// might be waiting for it anymore
+					select {
+					case done <- struct{}{}:
+					default:
+					}
 				}
 				goto stop
 			case pd := <-feed:
 				// cache data for further handling as soon completion
 				// is signaled
+				old, exists := seqmap[pd.Tx.SeqNo]
+				if exists {
+					buffered -= old.SizeData()
+				}
 				seqmap[pd.Tx.SeqNo] = pd
+				buffered += pd.SizeData()
+				t.progress.Lock()
+				if !exists {
+					t.progress.seqnos = append(t.progress.seqnos, pd.Tx.SeqNo)
+				}
+				t.progress.bytes = buffered
+				t.progress.Unlock()
+				if maxbytes > 0 && buffered > maxbytes {
+					log.Printf("alfred/server: dropping transaction %v from %v, more than %d bytes of data", id, source, maxbytes)
+					atomic.AddUint64(&s.metrics.transactionsOversize, 1)
+					goto stop
+				}
+				if waiting && ready(waitseq) {
+					finish(waitseq)
+				}
+			case sig = <-signature:
+				t.progress.Lock()
+				t.progress.signed = true
+				t.progress.Unlock()
+				if waiting && ready(waitseq) {
+					finish(waitseq)
+				}
 			}
 		}
 	stop:
+		close(stopped)
 		s.Lock()
-		delete(s.transactions, id)
+		// the ID might have been taken over by a new transaction
+		// after this one was purged or evicted
+		if s.transactions[key] == t {
+			s.removeTransaction(key)
+		}
 		s.Unlock()
 		log.Printf("alfred/server: finished transaction %v", id)
 	}()
@@ -108,36 +319,116 @@ func (s *Server) startTransaction(id uint16, done chan<- struct{}, islocal bool)
 }
 
 // scan the list of known/running transactions for a given transaction
-// id and return a matching transaction if found. If not found,
-// start a new transaction for that id and return it
-func (s *Server) getTransaction(id uint16, islocal bool) transaction {
+// id and the host sending the data (src, nil for local clients) and
+// return a matching transaction if found. If not found, start a new
+// transaction and return it.
+// Transactions started by other hosts (src is set) are subject to the
+// transaction limits, returns false if the transaction is rejected.
+func (s *Server) getTransaction(id uint16, src *net.UDPAddr, islocal bool) (transaction, bool) {
 	s.Lock()
 	defer s.Unlock()
-	t, exists := s.transactions[id]
+	key := transactionKey{id: id}
+	if src != nil {
+		key.peer = src.IP.String()
+	}
+	t, exists := s.transactions[key]
+	if !exists {
+		source := key.peer
+		if source != "" {
+			if reason := s.makeRoomForTransaction(source); reason != "" {
+				log.Printf("alfred/server: rejecting transaction %v from %v, too many open transactions (%s)", id, source, reason)
+				s.metrics.rejectedTransaction(reason)
+				return transaction{}, false
+			}
+		}
+		t = s.startTransaction(key, nil, islocal, source)
+		s.addTransaction(key, t)
+	}
+	return *t, true
+}
+
+// check the limits before starting a transaction for a host, evicting
+// another transaction if needed. Returns an empty string if the
+// transaction can be started, the reason for rejecting it otherwise.
+// Only to be called while holding the lock.
+func (s *Server) makeRoomForTransaction(source string) string {
+	limits := s.TransactionLimits
+	if limits.MaxOpenPerSource > 0 && s.transactionSources[source] >= limits.MaxOpenPerSource {
+		return REJECT_TX_SOURCE
+	}
+	if limits.MaxOpen == 0 || len(s.transactions) < limits.MaxOpen {
+		return ""
+	}
+	// punish the host with the most open transactions, transactions
+	// started locally are never evicted
+	busiest, max := "", 0
+	for other, count := range s.transactionSources {
+		if count > max {
+			busiest, max = other, count
+		}
+	}
+	if busiest == "" {
+		return REJECT_TX_OPEN
+	}
+	var oldest *transaction
+	var oldestkey transactionKey
+	for key, t := range s.transactions {
+		if t.source == busiest && (oldest == nil || t.start.Before(oldest.start)) {
+			oldest, oldestkey = t, key
+		}
+	}
+	log.Printf("alfred/server: evicting transaction %v from %v to make room", oldestkey.id, busiest)
+	atomic.AddUint64(&s.metrics.transactionsEvicted, 1)
+	oldest.stop()
+	s.removeTransaction(oldestkey)
+	return ""
+}
+
+// add a transaction to the list, only to be called while holding the
+// lock
+func (s *Server) addTransaction(key transactionKey, t *transaction) {
+	s.transactions[key] = t
+	if t.source != "" {
+		s.transactionSources[t.source]++
+	}
+}
+
+// remove a transaction from the list, only to be called while holding
+// the lock
+func (s *Server) removeTransaction(key transactionKey) {
+	t, exists := s.transactions[key]
 	if !exists {
-		t = s.startTransaction(id, nil, islocal)
-		s.transactions[id] = t
+		return
+	}
+	delete(s.transactions, key)
+	if t.source != "" {
+		if s.transactionSources[t.source] <= 1 {
+			delete(s.transactionSources, t.source)
+		} else {
+			s.transactionSources[t.source]--
+		}
 	}
-	return *t
 }
 
 // create a new transaction that is locally initiated (before sending
-// a request to another server). Ensure that we get a non-colliding
-// transaction ID.
-func (s *Server) initiateTransaction(done chan<- struct{}) uint16 {
+// a request to another server, the peer that is to send the data).
+// Ensure that we get a non-colliding transaction ID. The transaction
+// does not wait for done to be received from, so it should be
+// buffered.
+func (s *Server) initiateTransaction(done chan<- struct{}, peer *net.UDPAddr) uint16 {
 	s.Lock()
 	defer s.Unlock()
-	var id uint16
+	key := transactionKey{peer: peer.IP.String()}
 	for {
-		id = getRandomId()
-		_, exists := s.transactions[id]
+		key.id = getRandomId()
+		_, exists := s.transactions[key]
 		if !exists {
 			break
 		}
 	}
-	t := s.startTransaction(id, done, false)
-	s.transactions[id] = t
-	return id
+	t := s.startTransaction(key, done, false, "")
+	s.addTransaction(key, t)
+	return key.id
 }
 
 // background task for cleaning up old and stale transactions
@@ -152,9 +443,11 @@ func (s *Server) purgeTransactionTask(age time.Duration, interval time.Duration)
 			case <-quit:
 				s.Lock()
 				for _, t := range s.transactions {
-					t.abort <- struct{}{}
+					t.stop()
 				}
-				s.transactions = make(map[uint16]*transaction)
+				s.transactions = make(map[transactionKey]*transaction)
+				s.transactionSources = make(map[string]int)
+				s.transactionsClosed = true
 				s.Unlock()
 				return
 			case <-time.After(interval):
@@ -163,9 +456,10 @@ func (s *Server) purgeTransactionTask(age time.Duration, interval time.Duration)
 			restart:
 				for k, t := range s.transactions {
 					if t.start.Before(maxage) {
-						log.Printf("alfred/server: transaction %v timed out unfinished.", k)
-						t.abort <- struct{}{}
-						delete(s.transactions, k)
+						log.Printf("alfred/server: transaction %v timed out unfinished.", k.id)
+						atomic.AddUint64(&s.metrics.transactionsTimedOut, 1)
+						t.stop()
+						s.removeTransaction(k)
 						goto restart
 					}
 				}
@@ -174,3 +468,29 @@ func (s *Server) purgeTransactionTask(age time.Duration, interval time.Duration)
 		}
 	}()
 }
+
+// return information about the open transactions, ordered by their
+// start time
+func (s *Server) Transactions() []TransactionInfo {
+	s.Lock()
+	infos := make([]TransactionInfo, 0, len(s.transactions))
+	for key, t := range s.transactions {
+		info := TransactionInfo{
+			Id:     key.id,
+			Source: t.source,
+			Local:  t.local,
+			Start:  t.start,
+		}
+		t.progress.Lock()
+		info.SeqNos = append([]uint16{}, t.progress.seqnos...)
+		info.Bytes = t.progress.bytes
+		info.FinalSeqNo = t.progress.finalseq
+		info.Signed = t.progress.signed
+		t.progress.Unlock()
+		sort.Slice(info.SeqNos, func(i, j int) bool { return info.SeqNos[i] < info.SeqNos[j] })
+		infos = append(infos, info)
+	}
+	s.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
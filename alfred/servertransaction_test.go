@@ -0,0 +1,155 @@
+package alfred
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// a host on the memory bus that sends packets made up by the test
+func memoryHost(t *testing.T, bus *MemoryBus, n byte) PacketConn {
+	ip := net.ParseIP(fmt.Sprintf("fe80::%d", n))
+	c, err := bus.Transport(ip, HardwareAddr{0x02, 0, 0, 0, 0, n}).ListenUnicast(&net.UDPAddr{IP: ip, Port: 16962})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func sendPacket(t *testing.T, c PacketConn, p Packet) {
+	buf := new(bytes.Buffer)
+	if err := p.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := &net.UDPAddr{IP: net.ParseIP("ff02::1"), Port: 16962}
+	if _, err := c.WriteToUDP(buf.Bytes(), dst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openTransactions(s *Server, id uint16) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for key := range s.transactions {
+		if key.id == id {
+			n++
+		}
+	}
+	return n
+}
+
+// packets for a transaction that has stopped must not block the
+// listener
+func TestTransactionStopped(t *testing.T) {
+	s := memoryServer(t, NewMemoryBus(1), SERVER_MODE_MASTER, 1, nil)
+	tx, ok := s.getTransaction(1, &net.UDPAddr{IP: net.ParseIP("fe80::8"), Port: 16962}, false)
+	if !ok {
+		t.Fatal("transaction rejected")
+	}
+	tx.stop()
+	returned := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			tx.end(1)
+			tx.push(NewPushDataV0(&TransactionMgmt{Id: 1, SeqNo: 0}, nil))
+			tx.sign(NewSignatureV0(&TransactionMgmt{Id: 1, SeqNo: 1}, 0, nil))
+		}
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("sending to a stopped transaction blocks")
+	}
+}
+
+func TestTransactionDuplicateEnd(t *testing.T) {
+	bus := NewMemoryBus(1)
+	s := memoryServer(t, bus, SERVER_MODE_MASTER, 1, nil)
+	host := memoryHost(t, bus, 8)
+	for i := uint16(0); i < 20; i++ {
+		d := testData(8, 100+uint8(i), "data")
+		sendPacket(t, host, NewPushDataV0(&TransactionMgmt{Id: i, SeqNo: 0}, []Data{d}))
+		for j := 0; j < 5; j++ {
+			sendPacket(t, host, NewStatusV0(ALFRED_STATUS_TXEND, &TransactionMgmt{Id: i, SeqNo: 1}))
+		}
+		if !waitFor(2*time.Second, func() bool { return stores(s, d) }) {
+			t.Fatalf("transaction %d not stored", i)
+		}
+	}
+}
+
+// a host cannot take part in a transaction of another host by using
+// its ID
+func TestTransactionOtherSource(t *testing.T) {
+	bus := NewMemoryBus(1)
+	s := memoryServer(t, bus, SERVER_MODE_MASTER, 1, nil)
+	host := memoryHost(t, bus, 8)
+	other := memoryHost(t, bus, 9)
+	d := testData(8, 100, "data")
+	sendPacket(t, host, NewPushDataV0(&TransactionMgmt{Id: 5, SeqNo: 0}, []Data{d}))
+	sendPacket(t, other, NewPushDataV0(&TransactionMgmt{Id: 5, SeqNo: 1}, []Data{testData(9, 100, "injected")}))
+	sendPacket(t, other, NewStatusV0(ALFRED_STATUS_TXEND, &TransactionMgmt{Id: 5, SeqNo: 2}))
+	if !waitFor(time.Second, func() bool { return openTransactions(s, 5) == 2 }) {
+		t.Fatalf("%d open transactions", openTransactions(s, 5))
+	}
+	// the other host's transaction is incomplete and dropped
+	if !waitFor(time.Second, func() bool { return openTransactions(s, 5) == 1 }) {
+		t.Fatalf("%d open transactions", openTransactions(s, 5))
+	}
+	if stores(s, d) || stores(s, testData(9, 100, "")) {
+		t.Fatal("data stored from a mixed up transaction")
+	}
+	sendPacket(t, host, NewStatusV0(ALFRED_STATUS_TXEND, &TransactionMgmt{Id: 5, SeqNo: 1}))
+	if !waitFor(time.Second, func() bool { return stores(s, d) }) {
+		t.Error("transaction not stored")
+	}
+}
+
+// a reply to a forwarded request that arrives when nobody waits for
+// it anymore must not keep the transaction from finishing
+func TestTransactionLateReply(t *testing.T) {
+	bus := NewMemoryBus(1)
+	s := memoryServer(t, bus, SERVER_MODE_SLAVE, 1, nil)
+	host := memoryHost(t, bus, 8)
+	// never received from
+	done := make(chan struct{})
+	id := s.initiateTransaction(done, &net.UDPAddr{IP: net.ParseIP("fe80::8"), Port: 16962})
+	d := testData(8, 100, "data")
+	sendPacket(t, host, NewPushDataV0(&TransactionMgmt{Id: id, SeqNo: 0}, []Data{d}))
+	sendPacket(t, host, NewStatusV0(ALFRED_STATUS_TXEND, &TransactionMgmt{Id: id, SeqNo: 1}))
+	if !waitFor(2*time.Second, func() bool { return stores(s, d) }) {
+		t.Fatal("transaction not stored")
+	}
+	if !waitFor(time.Second, func() bool { return openTransactions(s, id) == 0 }) {
+		t.Error("transaction still open")
+	}
+}
+
+// packets still being handled while the server shuts down must not
+// start transactions that keep the shutdown waiting
+func TestTransactionAfterShutdown(t *testing.T) {
+	s := NewServer(SERVER_MODE_MASTER)
+	s.Shutdown()
+	tx, ok := s.getTransaction(1, &net.UDPAddr{IP: net.ParseIP("fe80::8"), Port: 16962}, false)
+	if !ok {
+		t.Fatal("transaction rejected")
+	}
+	s.initiateTransaction(make(chan struct{}, 1), &net.UDPAddr{IP: net.ParseIP("fe80::9"), Port: 16962})
+	returned := make(chan struct{})
+	go func() {
+		tx.push(NewPushDataV0(&TransactionMgmt{Id: 1, SeqNo: 0}, []Data{testData(8, 100, "data")}))
+		tx.end(1)
+		s.wg.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("transaction started after shutdown")
+	}
+}
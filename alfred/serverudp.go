@@ -1,10 +1,11 @@
 package alfred
 
 import (
-	"bufio"
 	"bytes"
 	"log"
 	"net"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,25 +13,98 @@ import (
 
 // keep track of UDP sockets to listen on in these structs
 type listenerUDP struct {
-	iface  *net.Interface
-	ifname string
-	addr   *net.UDPAddr
-	listen *net.UDPConn
-	quit   chan struct{}
+	// set for listeners that talk to static peers via unicast
+	// instead of multicasting on an interface
+	unicast bool
+	ifname  string
+	hwaddr  HardwareAddr
+	address string
+	addr    *net.UDPAddr
+	listen  PacketConn
+	// transport the listener was created with
+	transport Transport
+	since     time.Time
+	metrics   *metrics
+	quit      chan struct{}
+	// static peer masters for unicast listeners
+	peers []*net.UDPAddr
 }
 
-// small function to send announcements
-func announce(dst *net.UDPAddr) {
-	c, err := net.DialUDP("udp", nil, dst)
+// check if an address belongs to one of the static peers
+func (l *listenerUDP) isPeer(addr *net.UDPAddr) bool {
+	for _, p := range l.peers {
+		if p.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if a packet from an address is meant for this listener
+func (l *listenerUDP) accepts(src *net.UDPAddr) bool {
+	if l.unicast {
+		return l.isPeer(src)
+	}
+	return src.Zone == l.ifname
+}
+
+// return the group address (bound to the listener's interface) for
+// sending multicast packets
+func (l *listenerUDP) groupAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: l.addr.IP, Port: l.addr.Port, Zone: l.ifname}
+}
+
+// check if an address is the one the listener sends from
+func (l *listenerUDP) isOwnAddress(addr *net.UDPAddr) bool {
+	local, ok := l.listen.LocalAddr().(*net.UDPAddr)
+	if !ok || local.Port != addr.Port {
+		return false
+	}
+	if local.IP.Equal(addr.IP) {
+		return true
+	}
+	// bound to a wildcard address, check all our addresses
+	addrs, err := l.transport.InterfaceAddrs()
 	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// return the address used as source for local data that is sent
+// out via this listener
+func (l *listenerUDP) hardwareAddr() HardwareAddr {
+	if l.unicast {
+		return nil
+	}
+	return l.hwaddr
+}
+
+// send a single packet via the listener's socket.
+// Sending from the bound socket rather than from an ephemeral port
+// makes sure that replies find their way back to us.
+func (l *listenerUDP) send(dst *net.UDPAddr, p Packet) error {
+	buf := new(bytes.Buffer)
+	if err := p.Write(buf); err != nil {
+		return err
+	}
+	_, err := l.listen.WriteToUDP(buf.Bytes(), dst)
+	if err == nil {
+		l.metrics.sent(p)
+	}
+	return err
+}
+
+// small function to send announcements
+func announce(l *listenerUDP, dst *net.UDPAddr) {
+	log.Printf("alfred/server: announce to %v", dst)
+	if err := l.send(dst, NewAnnounceMasterV0()); err != nil {
 		log.Printf("alfred/server: cannot send announcements to %v: %v", dst, err)
-	} else {
-		cbuf := bufio.NewWriter(c)
-		log.Printf("alfred/server: announce to %v", dst)
-		a := NewAnnounceMasterV0()
-		a.Write(cbuf)
-		cbuf.Flush()
-		c.Close()
 	}
 }
 
@@ -46,18 +120,34 @@ func (s *Server) announceMaster(interval time.Duration) {
 			case <-quit:
 				return
 			case <-time.After(interval):
+				if s.Mode == SERVER_MODE_SLAVE {
+					continue
+				}
+				// static peers always get announcements, so they
+				// learn about us
+				for _, l := range s.getListenersUDP() {
+					for _, p := range l.peers {
+						announce(l, p)
+					}
+				}
 				switch s.Mode {
 				case SERVER_MODE_STEALTH_MASTER:
-					m := s.getPreferredMaster()
-					if m.address != nil {
-						announce(m.address)
+					for _, l := range s.getListenersUDP() {
+						if l.unicast {
+							continue
+						}
+						m := s.getPreferredMaster(l)
+						if m.address != nil {
+							announce(l, m.address)
+						}
 					}
 				case SERVER_MODE_MASTER:
-					s.Lock()
-					for l, _ := range s.listenersudp {
-						announce(l.addr)
+					for _, l := range s.getListenersUDP() {
+						if l.unicast {
+							continue
+						}
+						announce(l, l.groupAddr())
 					}
-					s.Unlock()
 				}
 			}
 		}
@@ -65,16 +155,10 @@ func (s *Server) announceMaster(interval time.Duration) {
 }
 
 // small function to send requests
-func request(dst *net.UDPAddr, req *RequestV0) {
-	c, err := net.DialUDP("udp", nil, dst)
-	if err != nil {
+func request(l *listenerUDP, dst *net.UDPAddr, req *RequestV0) {
+	log.Printf("alfred/server: send request to %v", dst)
+	if err := l.send(dst, req); err != nil {
 		log.Printf("alfred/server: cannot send request to %v: %v", dst, err)
-	} else {
-		cbuf := bufio.NewWriter(c)
-		log.Printf("alfred/server: send request to %v", dst)
-		req.Write(cbuf)
-		cbuf.Flush()
-		c.Close()
 	}
 }
 
@@ -92,115 +176,252 @@ func (s *Server) syncToMasters(interval time.Duration) {
 			case <-time.After(interval):
 				switch s.Mode {
 				case SERVER_MODE_SLAVE, SERVER_MODE_STEALTH_MASTER:
-					m := s.getPreferredMaster()
-					if m.address != nil {
-						log.Printf("alfred/server: syncing to %+v", m.address)
-						c, err := s.dataSenderUDP(m.address, getRandomId())
-						if err == nil {
+					// only masters learned on an interface are
+					// synced to via that interface
+					for _, l := range s.getListenersUDP() {
+						m := s.getPreferredMaster(l)
+						if m.address != nil {
+							log.Printf("alfred/server: syncing to %+v", m.address)
+							c := s.dataSenderUDP(l, m.address, getRandomId(), false)
 							// only push local data
 							s.store.Request(ReqGetAll{TypeFilter: PACKETTYPE_ALL, LocalOnly: true, Return: c})
 						}
 					}
 				case SERVER_MODE_MASTER:
-					s.Lock() // because we loop on listener list
-					for l, _ := range s.listenersudp {
-						c, err := s.dataSenderUDP(l.addr, getRandomId())
-						if err == nil {
-							// push all known data
-							s.store.Request(ReqGetAll{TypeFilter: PACKETTYPE_ALL, LocalOnly: false, Return: c})
+					for _, l := range s.getListenersUDP() {
+						if l.unicast {
+							// no multicast here, push to each
+							// static peer that is alive
+							for _, m := range s.getMasters(l) {
+								c := s.dataSenderUDP(l, m.address, getRandomId(), false)
+								s.store.Request(ReqGetAll{TypeFilter: PACKETTYPE_ALL, LocalOnly: false, VerifiedOnly: s.SyncSecret != nil, Return: c})
+							}
+							continue
 						}
+						c := s.dataSenderUDP(l, l.groupAddr(), getRandomId(), false)
+						// push all known data, except for unverified
+						// data when signing is enabled
+						s.store.Request(ReqGetAll{TypeFilter: PACKETTYPE_ALL, LocalOnly: false, VerifiedOnly: s.SyncSecret != nil, Return: c})
 					}
-					s.Unlock()
 				}
 			}
 		}
 	}()
 }
 
-// opens a connection and passes it to the data sender, returns
-// the data channel it got from the data sender
-func (s *Server) dataSenderUDP(dst net.Addr, txid uint16) (chan<- Data, error) {
-	addr, _ := dst.(*net.UDPAddr)
-	c, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		log.Printf("alfred/server: cannot send to %v: %v", dst, err)
-		return nil, err
-	}
+// passes the listener's socket to the data sender, returns
+// the data channel it got from the data sender. Set reply when
+// answering a request.
+func (s *Server) dataSenderUDP(l *listenerUDP, dst *net.UDPAddr, txid uint16, reply bool) chan<- Data {
 	data := make(chan Data, 100)
+	source := l.hardwareAddr()
+	if source == nil {
+		source = s.primaryHardwareAddr()
+	}
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		s.sendData(c, txid, data, false)
+		s.sendData(func(p Packet) error {
+			return l.send(dst, p)
+		}, txid, data, false, reply, source)
 	}()
-	return data, nil
+	return data
 }
 
 // read and handle a UDP packet
 func (s *Server) readUDP(l *listenerUDP) error {
 	for {
 		back := make([]byte, maxDatagramSize)
-		_, src, err := l.listen.ReadFromUDP(back)
+		n, src, err := l.listen.ReadFromUDP(back)
 		if err != nil {
 			log.Printf("alfred/server: error: %v, UDP Reader shutting down", err)
 			return err
 		}
-		if src.Zone != l.ifname {
+		// handle the packet on behalf of the listener of the
+		// interface it arrived on
+		handler := s.listenerFor(l, src)
+		if handler == nil {
+			if l.unicast {
+				log.Printf("alfred/server: ignoring packet from %v, not a static peer", src)
+			}
 			continue
 		}
-		buf := bytes.NewBuffer(back)
-		pkg, err, _ := Read(buf)
+		l := handler
+		pkg, err := Decode(back[:n])
 		if err != nil {
-			log.Printf("alfred/server: cannot parse data just received.")
-			return err
+			// a single bad packet is no reason to stop listening
+			log.Printf("alfred/server: ignoring packet from %v: %v", src, err)
+			atomic.AddUint64(&s.metrics.packetsInvalid, 1)
+			continue
 		}
+		s.metrics.received(pkg)
 		switch pkg := pkg.(type) {
 		case *AnnounceMasterV0:
-			log.Printf("alfred/server: got master announcement from %+v on %+v", src, l)
+			log.Printf("alfred/server: got master announcement from %+v on %+v", src, l.ifname)
 			s.addMaster(l, src)
 		case *PushDataV0:
 			log.Printf("alfred/server: got push data, transaction %+v", pkg.Tx)
-			t := s.getTransaction(pkg.Tx.Id, false)
-			t.feed <- pkg
+			t, ok := s.getTransaction(pkg.Tx.Id, src, false)
+			if !ok {
+				continue
+			}
+			t.push(pkg)
 		case *StatusV0:
 			log.Printf("alfred/server: got status %+v %+v", pkg.Header, pkg.Tx)
-			t := s.getTransaction(pkg.Tx.Id, false)
+			t, ok := s.getTransaction(pkg.Tx.Id, src, false)
+			if !ok {
+				continue
+			}
 			switch pkg.Header.Type {
 			case ALFRED_STATUS_TXEND:
-				t.complete <- pkg.Tx.SeqNo
+				t.end(pkg.Tx.SeqNo)
 			case ALFRED_STATUS_ERROR:
-				t.abort <- struct{}{}
+				atomic.AddUint64(&s.metrics.transactionsDropped, 1)
+				t.stop()
+			}
+		case *SignatureV0:
+			log.Printf("alfred/server: got signature for transaction %+v", pkg.Tx)
+			t, ok := s.getTransaction(pkg.Tx.Id, src, false)
+			if !ok {
+				continue
 			}
+			t.sign(pkg)
 		case *RequestV0:
 			log.Printf("alfred/server: got request %+v", pkg)
-			c, err := s.dataSenderUDP(src, pkg.TxId)
-			if err == nil {
-				s.store.Request(ReqGetAll{TypeFilter: pkg.RequestedType, LocalOnly: false, Return: c})
-			}
+			c := s.dataSenderUDP(l, src, pkg.TxId, true)
+			// when signing is enabled, unverified data is not
+			// passed on
+			s.store.Request(ReqGetAll{TypeFilter: pkg.RequestedType, LocalOnly: false, VerifiedOnly: s.SyncSecret != nil, Return: c})
 		default:
 			log.Printf("alfred/server: got packet: %+v", pkg)
 		}
 	}
 }
 
+// return the listener of the interface a packet from src arrived on.
+// All listeners are bound to the same port, so the operating system
+// may deliver a unicast packet (sync pushes, replies to requests,
+// final status packets) to the socket of any of them rather than to
+// the one of the interface it arrived on. Packets of static peers
+// belong to the unicast listener they are configured for. Returns nil
+// if there is no listener for the packet (anymore).
+func (s *Server) listenerFor(l *listenerUDP, src *net.UDPAddr) *listenerUDP {
+	if l.accepts(src) {
+		return l
+	}
+	s.Lock()
+	defer s.Unlock()
+	for other, _ := range s.listenersudp {
+		if other.accepts(src) {
+			return other
+		}
+	}
+	return nil
+}
+
+// return a snapshot of the list of UDP listeners, the one that is
+// bound the longest comes first
+func (s *Server) getListenersUDP() []*listenerUDP {
+	s.Lock()
+	defer s.Unlock()
+	listeners := make([]*listenerUDP, 0, len(s.listenersudp))
+	for l, _ := range s.listenersudp {
+		listeners = append(listeners, l)
+	}
+	sort.Slice(listeners, func(i, j int) bool {
+		return listeners[i].since.Before(listeners[j].since)
+	})
+	return listeners
+}
+
+// return the address to use as the source of local data that is
+// not sent out via a specific interface (e.g. answers to clients).
+// This is the address of the interface that is bound the longest.
+func (s *Server) primaryHardwareAddr() HardwareAddr {
+	s.Lock()
+	defer s.Unlock()
+	var primary *listenerUDP
+	for l, _ := range s.listenersudp {
+		if l.unicast {
+			continue
+		}
+		if primary == nil || l.since.Before(primary.since) {
+			primary = l
+		}
+	}
+	if primary == nil {
+		return nil
+	}
+	return primary.hardwareAddr()
+}
+
 // spawn a task that listens of incoming UDP packets
 func (s *Server) NewListenerUDP(address string, ifname string) error {
-	iface, err := net.InterfaceByName(ifname)
+	hwaddr, err := s.Transport.HardwareAddr(ifname)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		return err
 	}
-	if s.firstInterface == nil {
-		s.firstInterface = HardwareAddr(iface.HardwareAddr)
+	listen, err := s.Transport.ListenMulticast(ifname, addr)
+	if err != nil {
+		return err
 	}
+	s.startListenerUDP(&listenerUDP{
+		ifname:    ifname,
+		hwaddr:    hwaddr,
+		address:   address,
+		addr:      addr,
+		listen:    listen,
+		transport: s.Transport,
+		since:     time.Now(),
+		metrics:   &s.metrics,
+		quit:      make(chan struct{}),
+	})
+	return nil
+}
+
+// spawn a task that listens on a local unicast address for UDP packets
+// from a list of static peer masters, e.g. for connecting to masters
+// at other sites via a VPN.
+// The peers get master announcements in master and stealth master
+// mode. Once they announce themselves, they are treated like masters
+// learned on an interface. Packets from other hosts are ignored.
+func (s *Server) NewListenerPeersUDP(address string, peers []string) error {
 	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		return err
 	}
-	listen, err := net.ListenMulticastUDP("udp", iface, addr)
+	peeraddrs := make([]*net.UDPAddr, 0, len(peers))
+	for _, peer := range peers {
+		peeraddr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return err
+		}
+		peeraddrs = append(peeraddrs, peeraddr)
+	}
+	listen, err := s.Transport.ListenUnicast(addr)
 	if err != nil {
 		return err
 	}
-	listen.SetReadBuffer(maxDatagramSize)
-	l := &listenerUDP{iface: iface, ifname: ifname, addr: addr, listen: listen, quit: make(chan struct{})}
+	s.startListenerUDP(&listenerUDP{
+		unicast:   true,
+		address:   address,
+		addr:      addr,
+		listen:    listen,
+		transport: s.Transport,
+		since:     time.Now(),
+		metrics:   &s.metrics,
+		quit:      make(chan struct{}),
+		peers:     peeraddrs,
+	})
+	return nil
+}
+
+// spawn the tasks serving a UDP listener
+func (s *Server) startListenerUDP(l *listenerUDP) {
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -218,5 +439,55 @@ func (s *Server) NewListenerUDP(address string, ifname string) error {
 	s.Lock()
 	s.listenersudp[l] = struct{}{}
 	s.Unlock()
-	return nil
+}
+
+// (re-)bind the UDP listeners to the given list of interfaces.
+// Listeners on interfaces that are no longer wanted are shut down, and
+// masters that were learned on them are forgotten. New listeners use
+// the address of the already existing ones, or DEFAULT_UDP_ADDRESS if
+// there are none.
+// Running transactions are not affected, they either finish or are
+// purged by the background task.
+func (s *Server) ChangeInterfaces(ifnames []string) error {
+	wanted := make(map[string]struct{})
+	for _, ifname := range ifnames {
+		wanted[ifname] = struct{}{}
+	}
+	address := DEFAULT_UDP_ADDRESS
+	s.Lock()
+	for l, _ := range s.listenersudp {
+		if l.unicast {
+			// static peers are not bound to an interface
+			continue
+		}
+		address = l.address
+		if _, keep := wanted[l.ifname]; keep {
+			// already listening on that one
+			delete(wanted, l.ifname)
+			continue
+		}
+		log.Printf("alfred/server: stop listening on interface %v", l.ifname)
+		delete(s.listenersudp, l)
+		for k, m := range s.masters {
+			if m.listenerudp == l {
+				delete(s.masters, k)
+			}
+		}
+		l.quit <- struct{}{}
+	}
+	s.Unlock()
+	var lasterr error
+	for _, ifname := range ifnames {
+		if _, create := wanted[ifname]; !create {
+			continue
+		}
+		log.Printf("alfred/server: start listening on interface %v", ifname)
+		if err := s.NewListenerUDP(address, ifname); err != nil {
+			log.Printf("alfred/server: cannot listen on interface %v: %v", ifname, err)
+			lasterr = err
+		}
+		// only once, even if listed twice
+		delete(wanted, ifname)
+	}
+	return lasterr
 }
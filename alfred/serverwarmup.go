@@ -0,0 +1,97 @@
+package alfred
+
+// A.L.F.R.E.D. server: fetch the data of other masters after starting
+// up, instead of waiting for them to push it
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// request all data from a master learned during the warm-up phase.
+// Called with the lock held.
+func (s *Server) warmUp(l *listenerUDP, addr *net.UDPAddr) {
+	s.warmPending++
+	// buffered, so a shutdown does not block on us when we are
+	// done and about to unregister
+	quit := make(chan interface{}, 1)
+	s.notifyQuit.Register(quit)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.notifyQuit.Unregister(quit)
+		// buffered, so the transaction does not block when we
+		// gave up waiting
+		done := make(chan struct{}, 1)
+		id := s.initiateTransaction(done, addr)
+		log.Printf("alfred/server: fetching data from master %v", addr)
+		request(l, addr, NewRequestV0(PACKETTYPE_ALL, id))
+		select {
+		case <-quit:
+			return
+		case <-time.After(s.WaitForMasterReply):
+			log.Printf("alfred/server: no data from master %v", addr)
+		case <-done:
+		}
+		s.Lock()
+		defer s.Unlock()
+		s.warmPending--
+		s.checkWarm()
+	}()
+}
+
+// task for the warm-up phase: masters get the given time to announce
+// themselves, after that the server is warm as soon as all of them
+// have answered (or failed to answer) the request for their data, or
+// when the timeout is reached
+func (s *Server) warmUpTask(settle time.Duration, timeout time.Duration) {
+	// buffered like in warmUp
+	quit := make(chan interface{}, 1)
+	s.notifyQuit.Register(quit)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.notifyQuit.Unregister(quit)
+		if settle < timeout {
+			select {
+			case <-quit:
+				return
+			case <-time.After(settle):
+				s.Lock()
+				s.warmSettled = true
+				s.checkWarm()
+				s.Unlock()
+			}
+			timeout -= settle
+		}
+		select {
+		case <-quit:
+		case <-time.After(timeout):
+			s.Lock()
+			if !s.warm {
+				log.Printf("alfred/server: still waiting for data from %d masters, considering myself warm anyway", s.warmPending)
+				s.warm = true
+			}
+			s.Unlock()
+		}
+	}()
+}
+
+// finish the warm-up phase if all masters have been asked for their
+// data. Called with the lock held.
+func (s *Server) checkWarm() {
+	if !s.warm && s.warmSettled && s.warmPending == 0 {
+		log.Printf("alfred/server: warm-up finished")
+		s.warm = true
+	}
+}
+
+// check if the server has fetched the data of other masters after
+// starting up (or has given up waiting for them, see WarmUpTime).
+// Until then, answers to requests might be incomplete.
+func (s *Server) IsWarm() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.warm
+}
@@ -0,0 +1,114 @@
+package alfred
+
+// signing of transactions, for securing the synchronization between
+// servers with a shared secret
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"sync"
+	"time"
+)
+
+var ErrSignatureStale = errors.New("signature time is out of the accepted range")
+var ErrSignatureReplayed = errors.New("signature has been seen before")
+
+// Computes the MAC for signing a transaction: a HMAC-SHA256, keyed
+// with the shared secret, over the transaction management header and
+// the data elements of each data packet, in sequence order, followed
+// by the transaction management header of the final status packet
+// and the signing time (8 bytes, big endian). The signing time allows
+// receivers to reject transactions that are replayed later on.
+type TransactionSigner struct {
+	mac hash.Hash
+}
+
+func NewTransactionSigner(secret []byte) *TransactionSigner {
+	return &TransactionSigner{mac: hmac.New(sha256.New, secret)}
+}
+
+// add a data packet, to be called in sequence order
+func (t *TransactionSigner) Add(pd *PushDataV0) {
+	buf := new(bytes.Buffer)
+	pd.Tx.Write(buf)
+	for _, d := range pd.Data {
+		d.Write(buf)
+	}
+	t.mac.Write(buf.Bytes())
+}
+
+// return the MAC, given the transaction management header of the final
+// status packet (i.e. the one stating the number of data packets) and
+// the signing time in nanoseconds since the Unix epoch
+func (t *TransactionSigner) Sum(tx *TransactionMgmt, signed uint64) []byte {
+	buf := new(bytes.Buffer)
+	tx.Write(buf)
+	for i := 0; i < 8; i++ {
+		buf.WriteByte(byte(signed >> uint(56-8*i)))
+	}
+	t.mac.Write(buf.Bytes())
+	return t.mac.Sum(nil)
+}
+
+// sign a transaction now, see Sum
+func (t *TransactionSigner) Sign(tx *TransactionMgmt) *SignatureV0 {
+	signed := uint64(time.Now().UnixNano())
+	return NewSignatureV0(tx, signed, t.Sum(tx, signed))
+}
+
+// check the signature of a transaction, given its data packets by
+// sequence number
+func VerifyTransaction(secret []byte, sig *SignatureV0, packets map[uint16]*PushDataV0) bool {
+	if sig == nil {
+		return false
+	}
+	signer := NewTransactionSigner(secret)
+	for i := uint16(0); i < sig.Tx.SeqNo; i++ {
+		pd, exists := packets[i]
+		if !exists {
+			return false
+		}
+		signer.Add(pd)
+	}
+	if len(packets) != int(sig.Tx.SeqNo) {
+		// there's more data than what was signed
+		return false
+	}
+	return hmac.Equal(signer.Sum(sig.Tx, sig.Time), sig.MAC)
+}
+
+// remembers the signatures of recently accepted transactions, to
+// reject transactions that are replayed
+type replayGuard struct {
+	// signing times, by MAC
+	seen map[string]time.Time
+	sync.Mutex
+}
+
+// Check that a valid signature was made no more than maxAge before or
+// after now and has not been seen within that time before. Signatures
+// that pass are remembered for the time they would be accepted.
+func (g *replayGuard) check(sig *SignatureV0, now time.Time, maxAge time.Duration) error {
+	signed := time.Unix(0, int64(sig.Time))
+	if signed.Before(now.Add(-maxAge)) || signed.After(now.Add(maxAge)) {
+		return ErrSignatureStale
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.seen == nil {
+		g.seen = make(map[string]time.Time)
+	}
+	for mac, t := range g.seen {
+		if t.Before(now.Add(-maxAge)) {
+			delete(g.seen, mac)
+		}
+	}
+	if _, exists := g.seen[string(sig.MAC)]; exists {
+		return ErrSignatureReplayed
+	}
+	g.seen[string(sig.MAC)] = signed
+	return nil
+}
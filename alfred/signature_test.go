@@ -0,0 +1,143 @@
+package alfred
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("shared secret")
+
+// build a signed transaction of n data packets, like sendData does
+func signedTransaction(secret []byte, n int) (map[uint16]*PushDataV0, *SignatureV0) {
+	signer := NewTransactionSigner(secret)
+	packets := make(map[uint16]*PushDataV0)
+	for i := 0; i < n; i++ {
+		pd := NewPushDataV0(&TransactionMgmt{Id: 42, SeqNo: uint16(i)},
+			[]Data{testData(byte(i), 100, "payload"), testData(byte(i), 101, "more")})
+		signer.Add(pd)
+		packets[uint16(i)] = pd
+	}
+	return packets, signer.Sign(&TransactionMgmt{Id: 42, SeqNo: uint16(n)})
+}
+
+func TestVerifyTransaction(t *testing.T) {
+	packets, sig := signedTransaction(testSecret, 3)
+	if !VerifyTransaction(testSecret, sig, packets) {
+		t.Fatal("valid signature not accepted")
+	}
+	if VerifyTransaction([]byte("other secret"), sig, packets) {
+		t.Error("signature accepted with the wrong secret")
+	}
+	if VerifyTransaction(testSecret, nil, packets) {
+		t.Error("missing signature accepted")
+	}
+}
+
+func TestVerifyTransactionTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(packets map[uint16]*PushDataV0, sig *SignatureV0)
+	}{
+		{"payload", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			p[1].Data[0].Data = []byte("PAYLOAD")
+		}},
+		{"source", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			p[0].Data[1].Source = HardwareAddr{0x02, 0, 0, 0, 0, 0xff}
+		}},
+		{"type", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			p[2].Data[0].Header.Type = 158
+		}},
+		{"data removed", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			p[2].Data = p[2].Data[:1]
+		}},
+		{"data added", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			p[0].Data = append(p[0].Data, testData(9, 100, "injected"))
+		}},
+		{"reordered", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			p[0], p[1] = p[1], p[0]
+		}},
+		{"packet missing", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			delete(p, 1)
+		}},
+		{"extra packet", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			p[3] = NewPushDataV0(&TransactionMgmt{Id: 42, SeqNo: 3}, []Data{testData(3, 100, "extra")})
+		}},
+		{"packet count", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			delete(p, 2)
+			sig.Tx.SeqNo = 2
+		}},
+		{"transaction id", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			sig.Tx.Id = 43
+		}},
+		{"time", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			sig.Time += 1
+		}},
+		{"mac", func(p map[uint16]*PushDataV0, sig *SignatureV0) {
+			sig.MAC[0] ^= 1
+		}},
+	}
+	for _, test := range tests {
+		packets, sig := signedTransaction(testSecret, 3)
+		test.tamper(packets, sig)
+		if VerifyTransaction(testSecret, sig, packets) {
+			t.Errorf("%s: tampered transaction accepted", test.name)
+		}
+	}
+}
+
+func TestSignatureEncoding(t *testing.T) {
+	_, sig := signedTransaction(testSecret, 2)
+	buf := new(bytes.Buffer)
+	if err := sig.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != sig.Size() {
+		t.Errorf("wrote %d bytes, size is %d", buf.Len(), sig.Size())
+	}
+	p, err, _ := Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, ok := p.(*SignatureV0)
+	if !ok {
+		t.Fatalf("decoded %T", p)
+	}
+	if decoded.Time != sig.Time || *decoded.Tx != *sig.Tx || !bytes.Equal(decoded.MAC, sig.MAC) {
+		t.Errorf("decoded %+v, want %+v", decoded, sig)
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Now()
+	maxAge := time.Minute
+	g := replayGuard{}
+	_, sig := signedTransaction(testSecret, 1)
+	sig.Time = uint64(now.UnixNano())
+	if err := g.check(sig, now, maxAge); err != nil {
+		t.Fatalf("fresh signature rejected: %v", err)
+	}
+	if err := g.check(sig, now.Add(time.Second), maxAge); err != ErrSignatureReplayed {
+		t.Errorf("replayed signature: got %v", err)
+	}
+	if err := g.check(sig, now.Add(2*maxAge), maxAge); err != ErrSignatureStale {
+		t.Errorf("stale signature: got %v", err)
+	}
+	_, future := signedTransaction(testSecret, 1)
+	future.Time = uint64(now.Add(2 * maxAge).UnixNano())
+	if err := g.check(future, now, maxAge); err != ErrSignatureStale {
+		t.Errorf("signature from the future: got %v", err)
+	}
+	_, other := signedTransaction(testSecret, 2)
+	other.Time = uint64(now.UnixNano())
+	if err := g.check(other, now, maxAge); err != nil {
+		t.Errorf("other signature rejected: %v", err)
+	}
+	// expired signatures are forgotten
+	if err := g.check(future, now.Add(2*maxAge), maxAge); err != nil {
+		t.Errorf("fresh signature rejected: %v", err)
+	}
+	if len(g.seen) != 1 {
+		t.Errorf("%d signatures remembered, want 1", len(g.seen))
+	}
+}
@@ -0,0 +1,69 @@
+package alfred
+
+// A.L.F.R.E.D. server: abstraction of the packet based transport used
+// between servers, so it can be replaced for simulations
+
+import (
+	"net"
+)
+
+// A socket for sending and receiving single packets.
+// *net.UDPConn implements it.
+type PacketConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// A transport provides the packet sockets a server communicates with
+// other servers through.
+type Transport interface {
+	// bind to a multicast group address on a given interface.
+	// Received packets must have the interface name set as the zone
+	// of their source address.
+	ListenMulticast(ifname string, group *net.UDPAddr) (PacketConn, error)
+	// bind to a local unicast address
+	ListenUnicast(addr *net.UDPAddr) (PacketConn, error)
+	// return the hardware address of an interface
+	HardwareAddr(ifname string) (HardwareAddr, error)
+	// return the local addresses, for recognizing our own packets
+	InterfaceAddrs() ([]net.Addr, error)
+}
+
+// The default transport, using the operating system's UDP sockets
+type UDPTransport struct{}
+
+func (u *UDPTransport) ListenMulticast(ifname string, group *net.UDPAddr) (PacketConn, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	listen, err := net.ListenMulticastUDP("udp", iface, group)
+	if err != nil {
+		return nil, err
+	}
+	listen.SetReadBuffer(maxDatagramSize)
+	return listen, nil
+}
+
+func (u *UDPTransport) ListenUnicast(addr *net.UDPAddr) (PacketConn, error) {
+	listen, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listen.SetReadBuffer(maxDatagramSize)
+	return listen, nil
+}
+
+func (u *UDPTransport) HardwareAddr(ifname string) (HardwareAddr, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	return HardwareAddr(iface.HardwareAddr), nil
+}
+
+func (u *UDPTransport) InterfaceAddrs() ([]net.Addr, error) {
+	return net.InterfaceAddrs()
+}
@@ -0,0 +1,307 @@
+package alfred
+
+// in-memory transport connecting servers running in the same process,
+// for simulating networks of masters and slaves
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+var ErrMemoryConnClosed = errors.New("memory bus connection closed")
+
+// number of packets queued for a connection before further packets
+// are dropped
+const memoryConnQueueLength = 1024
+
+// A MemoryBus simulates a single link that nodes can be attached to.
+// Packets sent to a multicast address are delivered to all other
+// connections on the bus that joined that group on the destination
+// port, packets sent to a unicast address are delivered to the
+// connections bound to that address. Like with the operating system's
+// sockets, a node receives a unicast packet on only one of its
+// multicast listeners on the port, the one bound last, even if that
+// is on another interface; the zone of the source address still
+// names the interface it arrived on. Delivery never blocks, packets
+// are dropped when the receiver does not keep up.
+//
+// Loss can be injected with SetDropRate and SetFilter. Random drops
+// use a pseudo random number generator with the seed given to
+// NewMemoryBus, so the same sequence of packets meets the same fate.
+// The seed does not make whole simulations repeatable, though: the
+// servers send from goroutines of their own, driven by wall-clock
+// timers, so the order in which packets of different servers are put
+// on the bus depends on scheduling. Tests should wait for the state
+// they expect rather than for fixed times, and make loss depend on
+// the packets (see SetFilter) where the exact outcome matters.
+type MemoryBus struct {
+	rand      *rand.Rand
+	droprate  float64
+	filter    func(src *net.UDPAddr, dst *net.UDPAddr, packet []byte) bool
+	conns     []*memoryConn
+	delivered uint64
+	dropped   uint64
+	sync.Mutex
+}
+
+// create a new bus, seeding the random number generator used for
+// dropping packets
+func NewMemoryBus(seed int64) *MemoryBus {
+	return &MemoryBus{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// set the probability (0 to 1) for a packet not to be delivered to a
+// receiver
+func (b *MemoryBus) SetDropRate(rate float64) {
+	b.Lock()
+	defer b.Unlock()
+	b.droprate = rate
+}
+
+// set a function that decides for each receiver if a packet is
+// delivered (return value true) or dropped. nil delivers everything.
+// The source address has no zone set.
+func (b *MemoryBus) SetFilter(filter func(src *net.UDPAddr, dst *net.UDPAddr, packet []byte) bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.filter = filter
+}
+
+// return the number of packets delivered and dropped so far
+func (b *MemoryBus) Stats() (delivered uint64, dropped uint64) {
+	b.Lock()
+	defer b.Unlock()
+	return b.delivered, b.dropped
+}
+
+// attach a node to the bus, using the given IP address and hardware
+// address. The returned transport can be set as a server's Transport.
+// The interface name used for multicast listeners is free to choose,
+// it is set as the zone of source addresses the node receives.
+// Further interfaces on other buses can be added with Attach.
+func (b *MemoryBus) Transport(ip net.IP, hwaddr HardwareAddr) *MemoryTransport {
+	return &MemoryTransport{bus: b, ip: ip, hwaddr: hwaddr}
+}
+
+// send a packet to all matching connections except the sending one
+func (b *MemoryBus) send(from *memoryConn, dst *net.UDPAddr, packet []byte) {
+	b.Lock()
+	defer b.Unlock()
+	src := &net.UDPAddr{IP: from.ip, Port: from.port}
+	// nodes that got a unicast packet on one of their multicast
+	// listeners already
+	reached := make(map[*MemoryTransport]bool)
+	for _, c := range b.conns {
+		if c == from || !c.accepts(dst) {
+			continue
+		}
+		// like the operating system, deliver unicast packets to
+		// only one of the sockets bound to the port, which need
+		// not be the one of the interface it arrived on
+		rx := c
+		if c.ifname != "" && !dst.IP.IsMulticast() {
+			if reached[c.node] {
+				continue
+			}
+			reached[c.node] = true
+			rx = c.node.unicastReceiver(c)
+		}
+		if b.droprate > 0 && b.rand.Float64() < b.droprate {
+			b.dropped++
+			continue
+		}
+		if b.filter != nil && !b.filter(src, dst, packet) {
+			b.dropped++
+			continue
+		}
+		// every receiver gets its own copy
+		p := memoryPacket{
+			src:  &net.UDPAddr{IP: from.ip, Port: from.port, Zone: c.ifname},
+			data: append([]byte(nil), packet...),
+		}
+		select {
+		case rx.in <- p:
+			b.delivered++
+		default:
+			b.dropped++
+		}
+	}
+}
+
+func (b *MemoryBus) attach(c *memoryConn) {
+	b.Lock()
+	defer b.Unlock()
+	b.conns = append(b.conns, c)
+}
+
+func (b *MemoryBus) detach(c *memoryConn) {
+	b.Lock()
+	defer b.Unlock()
+	for i, o := range b.conns {
+		if o == c {
+			b.conns = append(b.conns[:i], b.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// A node's attachment to one or more MemoryBus instances
+type MemoryTransport struct {
+	bus    *MemoryBus
+	ip     net.IP
+	hwaddr HardwareAddr
+	// buses of interfaces other than the default one, by name
+	links map[string]*MemoryBus
+	// multicast listeners in the order they were bound
+	multicast []*memoryConn
+	sync.Mutex
+}
+
+// add an interface connecting the node to another bus. Multicast
+// listeners on that interface are attached to the given bus, all
+// others to the one the transport was created for.
+func (t *MemoryTransport) Attach(ifname string, bus *MemoryBus) {
+	t.Lock()
+	defer t.Unlock()
+	if t.links == nil {
+		t.links = make(map[string]*MemoryBus)
+	}
+	t.links[ifname] = bus
+}
+
+func (t *MemoryTransport) ListenMulticast(ifname string, group *net.UDPAddr) (PacketConn, error) {
+	t.Lock()
+	bus, ok := t.links[ifname]
+	if !ok {
+		bus = t.bus
+	}
+	c := t.newConn(bus, group.Port)
+	c.ifname = ifname
+	c.group = group.IP
+	t.multicast = append(t.multicast, c)
+	// the bus calls back into the transport with its lock held
+	t.Unlock()
+	bus.attach(c)
+	return c, nil
+}
+
+// return the multicast listener of the node that receives a unicast
+// packet arriving on the interface of a given one. This is the one
+// bound last to the same port, which may be on another interface.
+func (t *MemoryTransport) unicastReceiver(c *memoryConn) *memoryConn {
+	t.Lock()
+	defer t.Unlock()
+	for i := len(t.multicast) - 1; i >= 0; i-- {
+		if t.multicast[i].port == c.port {
+			return t.multicast[i]
+		}
+	}
+	return c
+}
+
+// forget a multicast listener when it is closed
+func (t *MemoryTransport) remove(c *memoryConn) {
+	t.Lock()
+	defer t.Unlock()
+	for i, o := range t.multicast {
+		if o == c {
+			t.multicast = append(t.multicast[:i], t.multicast[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *MemoryTransport) ListenUnicast(addr *net.UDPAddr) (PacketConn, error) {
+	if addr.IP != nil && !addr.IP.IsUnspecified() && !addr.IP.Equal(t.ip) {
+		return nil, &net.AddrError{Err: "address not on memory bus node", Addr: addr.String()}
+	}
+	c := t.newConn(t.bus, addr.Port)
+	t.bus.attach(c)
+	return c, nil
+}
+
+func (t *MemoryTransport) HardwareAddr(ifname string) (HardwareAddr, error) {
+	return t.hwaddr, nil
+}
+
+func (t *MemoryTransport) InterfaceAddrs() ([]net.Addr, error) {
+	return []net.Addr{&net.IPNet{IP: t.ip, Mask: net.CIDRMask(len(t.ip)*8, len(t.ip)*8)}}, nil
+}
+
+func (t *MemoryTransport) newConn(bus *MemoryBus, port int) *memoryConn {
+	return &memoryConn{
+		bus:    bus,
+		node:   t,
+		ip:     t.ip,
+		port:   port,
+		in:     make(chan memoryPacket, memoryConnQueueLength),
+		closed: make(chan struct{}),
+	}
+}
+
+type memoryPacket struct {
+	src  *net.UDPAddr
+	data []byte
+}
+
+// a connection on a MemoryBus, implementing PacketConn
+type memoryConn struct {
+	bus  *MemoryBus
+	node *MemoryTransport
+	ip   net.IP
+	port int
+	// set for multicast listeners
+	ifname    string
+	group     net.IP
+	in        chan memoryPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// check if a packet sent to dst is to be received on this connection
+func (c *memoryConn) accepts(dst *net.UDPAddr) bool {
+	if dst.Port != c.port {
+		return false
+	}
+	if dst.IP.IsMulticast() {
+		return c.group != nil && c.group.Equal(dst.IP)
+	}
+	return c.ip.Equal(dst.IP)
+}
+
+func (c *memoryConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, ErrMemoryConnClosed
+	case p := <-c.in:
+		// like UDP, excess data is discarded
+		return copy(b, p.data), p.src, nil
+	}
+}
+
+func (c *memoryConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrMemoryConnClosed
+	default:
+	}
+	c.bus.send(c, addr, b)
+	return len(b), nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: c.ip, Port: c.port, Zone: c.ifname}
+}
+
+func (c *memoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.bus.detach(c)
+		c.node.remove(c)
+	})
+	return nil
+}
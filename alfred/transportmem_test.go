@@ -0,0 +1,216 @@
+package alfred
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// start a server attached to a memory bus, with short intervals
+func memoryServer(t *testing.T, bus *MemoryBus, mode int, n byte, configure func(s *Server)) *Server {
+	s := NewServerConfig(mode, func(s *Server) {
+		s.Transport = bus.Transport(net.ParseIP(fmt.Sprintf("fe80::%d", n)), HardwareAddr{0x02, 0, 0, 0, 0, n})
+		s.AnnouncementInterval = 20 * time.Millisecond
+		s.SyncInterval = 50 * time.Millisecond
+		s.MasterMaxAge = time.Second
+		s.MasterPurgeInterval = 100 * time.Millisecond
+		s.TransactionWaitComplete = 50 * time.Millisecond
+		s.TransactionMaxAge = time.Second
+		s.TransactionPurgeInterval = 100 * time.Millisecond
+		s.WaitForMasterReply = 500 * time.Millisecond
+		s.WarmUpTime = 10 * time.Second
+		if configure != nil {
+			configure(s)
+		}
+	})
+	t.Cleanup(s.Shutdown)
+	if err := s.NewListenerUDP(DEFAULT_UDP_ADDRESS, "mem0"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// wait until a condition is met, the order of events on the bus
+// depends on scheduling, so fixed delays do not work reliably
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func putLocal(s *Server, d Data) {
+	s.store.Request(ReqPut{IsLocal: true, Data: d})
+}
+
+func stores(s *Server, d Data) bool {
+	_, exists := storedEntity(s, d)
+	return exists
+}
+
+func knowsMaster(s *Server, other byte) bool {
+	ip := net.ParseIP(fmt.Sprintf("fe80::%d", other))
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range s.masters {
+		if m.address.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func masters(s *Server) []string {
+	s.Lock()
+	defer s.Unlock()
+	addresses := make([]string, 0, len(s.masters))
+	for _, m := range s.masters {
+		addresses = append(addresses, m.address.String())
+	}
+	return addresses
+}
+
+func TestMemoryBusSync(t *testing.T) {
+	bus := NewMemoryBus(1)
+	a := memoryServer(t, bus, SERVER_MODE_MASTER, 1, nil)
+	b := memoryServer(t, bus, SERVER_MODE_MASTER, 2, nil)
+	c := memoryServer(t, bus, SERVER_MODE_SLAVE, 3, nil)
+
+	if !waitFor(2*time.Second, func() bool {
+		return knowsMaster(a, 2) && knowsMaster(b, 1) && knowsMaster(c, 1) && knowsMaster(c, 2)
+	}) {
+		t.Fatalf("masters not announced: a %v, b %v, c %v", masters(a), masters(b), masters(c))
+	}
+	if knowsMaster(a, 3) || knowsMaster(b, 3) {
+		t.Error("slave is taken for a master")
+	}
+	if !waitFor(2*time.Second, func() bool { return a.IsWarm() && b.IsWarm() }) {
+		t.Error("masters did not finish warming up before WarmUpTime")
+	}
+
+	data := []Data{testData(1, 100, "from a"), testData(2, 101, "from b"), testData(3, 102, "from c")}
+	putLocal(a, data[0])
+	putLocal(b, data[1])
+	putLocal(c, data[2])
+	for _, d := range data {
+		if !waitFor(2*time.Second, func() bool { return stores(a, d) && stores(b, d) }) {
+			t.Errorf("data from %v not synced to both masters", d.Source)
+		}
+	}
+}
+
+func TestMemoryBusTwoInterfaces(t *testing.T) {
+	bus0, bus1 := NewMemoryBus(1), NewMemoryBus(2)
+	// a is attached to both links. Its listener for mem1 is bound
+	// last, so unicast packets arriving via mem0 are received on
+	// that listener's socket.
+	a := memoryServer(t, bus0, SERVER_MODE_MASTER, 1, func(s *Server) {
+		s.Transport.(*MemoryTransport).Attach("mem1", bus1)
+	})
+	if err := a.NewListenerUDP(DEFAULT_UDP_ADDRESS, "mem1"); err != nil {
+		t.Fatal(err)
+	}
+	// the slave pushes its data to a via unicast
+	b := memoryServer(t, bus0, SERVER_MODE_SLAVE, 2, nil)
+	c := memoryServer(t, bus1, SERVER_MODE_MASTER, 3, nil)
+
+	if !waitFor(2*time.Second, func() bool {
+		return knowsMaster(a, 3) && knowsMaster(b, 1) && knowsMaster(c, 1)
+	}) {
+		t.Fatalf("masters not announced: a %v, b %v, c %v", masters(a), masters(b), masters(c))
+	}
+
+	data := []Data{testData(1, 100, "from a"), testData(2, 101, "from b"), testData(3, 102, "from c")}
+	putLocal(a, data[0])
+	putLocal(b, data[1])
+	putLocal(c, data[2])
+	for _, d := range data {
+		if !waitFor(2*time.Second, func() bool { return stores(a, d) }) {
+			t.Errorf("data from %v not synced to a", d.Source)
+		}
+	}
+	if !waitFor(2*time.Second, func() bool { return stores(c, data[0]) && stores(c, data[1]) }) {
+		t.Error("data not synced from a to c")
+	}
+}
+
+func TestMemoryBusLoss(t *testing.T) {
+	bus := NewMemoryBus(1)
+	m := memoryServer(t, bus, SERVER_MODE_MASTER, 1, nil)
+	// one data item per packet
+	s := memoryServer(t, bus, SERVER_MODE_SLAVE, 2, func(s *Server) { s.MaxPayload = 150 })
+	slave := net.ParseIP("fe80::2")
+	// drop the first data packet of each transaction from the slave
+	bus.SetFilter(func(src *net.UDPAddr, dst *net.UDPAddr, packet []byte) bool {
+		p, err, _ := Read(bytes.NewReader(packet))
+		if err != nil {
+			t.Errorf("undecodable packet on bus: %v", err)
+			return true
+		}
+		pd, ok := p.(*PushDataV0)
+		return !ok || !src.IP.Equal(slave) || pd.Tx.SeqNo != 0
+	})
+
+	data := []Data{testData(2, 100, string(make([]byte, 100))), testData(2, 101, string(make([]byte, 100)))}
+	putLocal(s, data[0])
+	putLocal(s, data[1])
+	if !waitFor(2*time.Second, func() bool { return atomic.LoadUint64(&m.metrics.transactionsDropped) > 0 }) {
+		t.Fatal("incomplete transaction not dropped")
+	}
+	for _, d := range data {
+		if stores(m, d) {
+			t.Errorf("data type %d of an incomplete transaction stored", d.Header.Type)
+		}
+	}
+	if _, dropped := bus.Stats(); dropped == 0 {
+		t.Error("no packets counted as dropped by the bus")
+	}
+
+	bus.SetFilter(nil)
+	for _, d := range data {
+		if !waitFor(2*time.Second, func() bool { return stores(m, d) }) {
+			t.Errorf("data type %d not synced after loss ended", d.Header.Type)
+		}
+	}
+}
+
+func TestMemoryBusDropRate(t *testing.T) {
+	// the same seed drops the same packets
+	drops := func() []bool {
+		bus := NewMemoryBus(42)
+		bus.SetDropRate(0.5)
+		tr := bus.Transport(net.ParseIP("fe80::1"), HardwareAddr{0x02, 0, 0, 0, 0, 1})
+		rx, _ := bus.Transport(net.ParseIP("fe80::2"), HardwareAddr{0x02, 0, 0, 0, 0, 2}).ListenUnicast(&net.UDPAddr{Port: 1000})
+		tx, _ := tr.ListenUnicast(&net.UDPAddr{Port: 1000})
+		defer rx.Close()
+		defer tx.Close()
+		result := make([]bool, 100)
+		for i := range result {
+			_, before := bus.Stats()
+			tx.WriteToUDP([]byte{byte(i)}, &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 1000})
+			_, after := bus.Stats()
+			result[i] = after > before
+		}
+		return result
+	}
+	first, second := drops(), drops()
+	n := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("packet %d dropped in one run only", i)
+		}
+		if first[i] {
+			n++
+		}
+	}
+	if n == 0 || n == len(first) {
+		t.Errorf("%d of %d packets dropped", n, len(first))
+	}
+}
@@ -17,6 +17,10 @@ const (
 
 var ErrParse = errors.New("parse error")
 
+func init() {
+	alfred.RegisterContent(PACKETTYPE, PACKETVERSION, func() alfred.Content { return &VisV1{} })
+}
+
 // vis data item
 type VisV1 struct {
 	Mac       alfred.HardwareAddr
@@ -79,6 +83,34 @@ func (vis *VisV1) ReadAlfred(data alfred.Data) error {
 	return nil
 }
 
+// Ingest hook for the A.L.F.R.E.D. server that rejects vis data which
+// is not well-formed: the payload must have exactly the size given by
+// the interface and entry counts, and entries must refer to existing
+// interfaces. Data of other packet versions is passed on unchecked.
+func Validate(d *alfred.IngestData) error {
+	if d.Header.Type != PACKETTYPE || d.Header.Version != PACKETVERSION {
+		return nil
+	}
+	vis := VisV1{}
+	if err := vis.ReadAlfred(d.Data); err != nil {
+		return err
+	}
+	if len(d.Data.Data) != 8+6*int(vis.Iface_n)+8*int(vis.Entries_n) {
+		return ErrParse
+	}
+	for _, e := range vis.Entries {
+		if e.IfIndex >= vis.Iface_n {
+			return ErrParse
+		}
+	}
+	return nil
+}
+
+// install Validate for vis data on a server
+func AddValidators(s *alfred.Server) {
+	s.AddIngestHook(PACKETTYPE, alfred.IngestHookFunc(Validate))
+}
+
 func (vis *VisV1) GetPacketType() uint8 {
 	return PACKETTYPE
 }
@@ -0,0 +1,68 @@
+package batadvvis
+
+import (
+	"github.com/hwhw/mesh/alfred"
+	"testing"
+)
+
+// build a vis payload with the given interface and entry counts
+func visPayload(ifaces int, entries [][2]uint8) []byte {
+	payload := []byte{0x02, 0, 0, 0, 0, 1, uint8(ifaces), uint8(len(entries))}
+	for i := 0; i < ifaces; i++ {
+		payload = append(payload, 0x02, 0, 0, 0, 1, uint8(i))
+	}
+	for i, e := range entries {
+		payload = append(payload, 0x02, 0, 0, 0, 2, uint8(i), e[0], e[1])
+	}
+	return payload
+}
+
+func ingestData(version uint8, payload []byte) *alfred.IngestData {
+	return &alfred.IngestData{Data: alfred.Data{
+		Source: alfred.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		Header: &alfred.TLV{Type: PACKETTYPE, Version: version, Length: uint16(len(payload))},
+		Data:   payload,
+	}}
+}
+
+func TestValidate(t *testing.T) {
+	valid := visPayload(2, [][2]uint8{{0, 255}, {1, 128}})
+	tests := []struct {
+		name    string
+		version uint8
+		payload []byte
+		ok      bool
+	}{
+		{"valid", PACKETVERSION, valid, true},
+		{"no entries", PACKETVERSION, visPayload(1, nil), true},
+		{"other version", PACKETVERSION + 1, []byte{1, 2, 3}, true},
+		{"empty", PACKETVERSION, []byte{}, false},
+		{"short header", PACKETVERSION, valid[:7], false},
+		{"no interfaces", PACKETVERSION, visPayload(0, nil), false},
+		{"truncated interfaces", PACKETVERSION, valid[:8+6+3], false},
+		{"truncated entries", PACKETVERSION, valid[:len(valid)-1], false},
+		{"trailing data", PACKETVERSION, append(visPayload(1, nil), 0), false},
+		{"unknown interface", PACKETVERSION, visPayload(2, [][2]uint8{{2, 255}}), false},
+	}
+	for _, test := range tests {
+		if err := Validate(ingestData(test.version, test.payload)); test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+func TestReadAlfred(t *testing.T) {
+	vis := VisV1{}
+	if err := vis.ReadAlfred(ingestData(PACKETVERSION, visPayload(2, [][2]uint8{{1, 200}})).Data); err != nil {
+		t.Fatal(err)
+	}
+	if vis.Iface_n != 2 || len(vis.Ifaces) != 2 || vis.Ifaces[1].Mac.String() != "02:00:00:00:01:01" {
+		t.Errorf("interfaces %+v", vis.Ifaces)
+	}
+	if len(vis.Entries) != 1 || vis.Entries[0].IfIndex != 1 || vis.Entries[0].Qual != 200 ||
+		vis.Entries[0].Mac.String() != "02:00:00:00:02:00" {
+		t.Errorf("entries %+v", vis.Entries)
+	}
+}
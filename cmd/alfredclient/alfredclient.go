@@ -4,19 +4,29 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/hwhw/mesh/alfred"
+	// data types that can be decoded
+	_ "github.com/hwhw/mesh/batadvvis"
+	_ "github.com/hwhw/mesh/gluon"
 	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
 )
 
-var network = flag.String("p", "unix", "network (unix, tcp) to use for connecting server")
+var network = flag.String("p", "unix", "network (unix, tcp, tls) to use for connecting server")
 var address = flag.String("a", "/var/run/alfred.sock", "address to connect to")
+var tlsca = flag.String("tlsca", "", "verify TLS server certificate against CAs from this file (PEM)")
+var tlscert = flag.String("tlscert", "", "TLS client certificate file (PEM)")
+var tlskey = flag.String("tlskey", "", "TLS client key file (PEM)")
 var zlibpipe = flag.Bool("z", false, "zlib compress/uncompress data")
 var gzippipe = flag.Bool("g", false, "gzip/gunzip data")
+var manifestFile = flag.String("m", "", "set data for several types from a manifest file (- for stdin)")
+var decode = flag.Bool("d", false, "decode data of known types and output it as JSON")
 
 func failure(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg, args...)
@@ -30,8 +40,11 @@ Usage:
 alfredclient [options] <command> <command options>
 
 available options:
- -p<network>  network to use (unix, tcp)
+ -p<network>  network to use (unix, tcp, tls)
  -a<address>  address to use for connecting server
+ -tlsca <file>, -tlscert <file>, -tlskey <file>
+              CAs to verify the server against, client certificate
+              and key, for the tls network
 
 available commands and additional options if any:
 
@@ -39,18 +52,37 @@ available commands and additional options if any:
                data will be read from stdin.
      -g        gzip compress data before storing
      -z        zlib compress data before storing
+     -m <manifest>
+               instead of a single type, set local data for several
+               types at once, in a single transaction. The JSON
+               manifest is read from the given file, or from stdin
+               for "-". It lists the items, each with a type and
+               either the data as a string, base64 encoded, or a file
+               to read it from:
+               [{"type": 158, "file": "/tmp/nodeinfo.json"},
+                {"type": 160, "data": "some text"},
+                {"type": 161, "base64": "AAEC"}]
 
  get <type>    will fetch and output data
      -g        gzip uncompress data before outputting
      -z        zlib uncompress data before outputting
+     -d        decode data of known types (gluon nodeinfo and
+               statistics, batman-adv vis) and output it as
+               indented JSON, other data is output as usual
 
  mode <modeid> will request server to switch to operation mode <modeid>
                0: slave mode
                1: master mode
                2: stealth master mode (only go-based alfred implementation)
 
+ status        will query and output the server status
+
+ events [type] will wait for and output notifications about changed
+               data of type <type>, or all types if none is given
+
  interfaces <iface list>
-               request server to listen on given interfaces.
+               request server to listen on given interfaces,
+               separated by commas (e.g. "bat0,bat1").
 `)
 }
 
@@ -101,12 +133,84 @@ func uncompress(data []byte) []byte {
 	}
 }
 
+// an item in a manifest for the set command
+type manifestItem struct {
+	Type   int     `json:"type"`
+	Data   *string `json:"data"`
+	Base64 *string `json:"base64"`
+	File   *string `json:"file"`
+}
+
+// read a manifest for the set command, returning the
+// (compressed, if requested) data by type
+func readManifest(r io.Reader) (map[uint8][]byte, error) {
+	items := make([]manifestItem, 0)
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, err
+	}
+	data := make(map[uint8][]byte)
+	for _, item := range items {
+		if item.Type < 1 || item.Type > 255 {
+			return nil, fmt.Errorf("invalid type %v", item.Type)
+		}
+		if _, exists := data[uint8(item.Type)]; exists {
+			return nil, fmt.Errorf("type %v is listed twice", item.Type)
+		}
+		var payload []byte
+		var err error
+		switch {
+		case item.Data != nil && item.Base64 == nil && item.File == nil:
+			payload = []byte(*item.Data)
+		case item.Data == nil && item.Base64 != nil && item.File == nil:
+			payload, err = base64.StdEncoding.DecodeString(*item.Base64)
+		case item.Data == nil && item.Base64 == nil && item.File != nil:
+			payload, err = ioutil.ReadFile(*item.File)
+		default:
+			return nil, fmt.Errorf("type %v needs exactly one of data, base64 or file", item.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("type %v: %v", item.Type, err)
+		}
+		data[uint8(item.Type)] = compress(payload)
+	}
+	return data, nil
+}
+
 func main() {
 	flag.Parse()
-	client := alfred.NewClient(*network, *address, nil)
+	var client *alfred.Client
+	if *network == "tls" {
+		config, err := alfred.NewClientTLSConfig(*tlsca, *tlscert, *tlskey)
+		if err != nil {
+			failure("error: TLS configuration: %v\n", err)
+		}
+		client = alfred.NewTLSClient(*address, config, nil)
+	} else {
+		client = alfred.NewClient(*network, *address, nil)
+	}
 	var reterr error
 	switch flag.Arg(0) {
 	case "set":
+		if *manifestFile != "" {
+			if flag.Arg(1) != "" {
+				failure("error: no type can be given along with a manifest\n")
+			}
+			manifest := io.Reader(os.Stdin)
+			if *manifestFile != "-" {
+				f, err := os.Open(*manifestFile)
+				if err != nil {
+					failure("error: opening manifest, %v\n", err)
+				}
+				defer f.Close()
+				manifest = f
+			}
+			data, err := readManifest(manifest)
+			if err != nil {
+				failure("error: reading manifest, %v\n", err)
+			}
+			reterr = client.PushDataMulti(data)
+			break
+		}
 		id, err := strconv.Atoi(flag.Arg(1))
 		if err != nil || id < 1 || id > 255 {
 			failure("error: invalid type %v\n", flag.Arg(1))
@@ -124,6 +228,20 @@ func main() {
 			goto failure
 		}
 		reterr = client.Request(uint8(id), func(d alfred.Data) error {
+			if *decode {
+				content, err := alfred.DecodeContent(d)
+				if err == nil {
+					out, err := json.MarshalIndent(content, "", "  ")
+					if err != nil {
+						return err
+					}
+					fmt.Printf("%s\n", out)
+					return nil
+				}
+				if err != alfred.ErrUnknownContent {
+					fmt.Fprintf(os.Stderr, "cannot decode data from %s: %v\n", d.Source, err)
+				}
+			}
 			fmt.Printf("{%s, \"", d.Source)
 			buf := uncompress(d.Data)
 			for _, c := range buf {
@@ -148,6 +266,64 @@ func main() {
 			goto failure
 		}
 		reterr = client.ModeSwitch(uint8(mode))
+	case "status":
+		var status *alfred.ServerStatusRepV0
+		status, reterr = client.ServerStatus()
+		if reterr != nil {
+			break
+		}
+		switch status.Mode {
+		case alfred.ALFRED_MODESWITCH_SLAVE:
+			fmt.Printf("mode: slave\n")
+		case alfred.ALFRED_MODESWITCH_MASTER:
+			fmt.Printf("mode: master\n")
+		case alfred.SERVER_MODE_STEALTH_MASTER:
+			fmt.Printf("mode: stealth master\n")
+		default:
+			fmt.Printf("mode: unknown (%d)\n", status.Mode)
+		}
+		for _, iface := range status.NetIfaces {
+			active := "inactive"
+			if iface.Active {
+				active = "active"
+			}
+			fmt.Printf("net_iface: %s, %s\n", iface.Name, active)
+		}
+		if status.BatIface != "" {
+			fmt.Printf("bat_iface: %s\n", status.BatIface)
+		}
+		for _, r := range status.Retention {
+			if r.Type == alfred.PACKETTYPE_ALL {
+				fmt.Printf("retention: default, %v\n", r.TTL)
+			} else {
+				fmt.Printf("retention: type %d, %v\n", r.Type, r.TTL)
+			}
+		}
+		if status.Warm != nil {
+			if *status.Warm {
+				fmt.Printf("warm: yes\n")
+			} else {
+				fmt.Printf("warm: no, still fetching data from other masters\n")
+			}
+		}
+	case "events":
+		id := 0
+		if flag.Arg(1) != "" {
+			var err error
+			id, err = strconv.Atoi(flag.Arg(1))
+			if err != nil || id < 1 || id > 255 {
+				failure("error: invalid type %v\n", flag.Arg(1))
+				goto failure
+			}
+		}
+		var events <-chan *alfred.EventNotifyV0
+		events, reterr = client.Subscribe(uint8(id), nil)
+		if reterr != nil {
+			break
+		}
+		for event := range events {
+			fmt.Printf("{%d, %s},\n", event.Type, event.Source)
+		}
 	case "interfaces":
 		ifaces := []byte(flag.Arg(1))
 		if len(ifaces) < 1 {
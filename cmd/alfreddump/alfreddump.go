@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hwhw/mesh/alfred"
+	// data types that can be decoded
+	_ "github.com/hwhw/mesh/batadvvis"
+	_ "github.com/hwhw/mesh/gluon"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var port = flag.Int("port", alfred.ALFRED_PORT, "UDP port of A.L.F.R.E.D. traffic")
+var jsonOutput = flag.Bool("json", false, "output JSON objects, one per line")
+var decode = flag.Bool("decode", false, "decode payloads of known data types")
+var summaryOnly = flag.Bool("q", false, "only output the transaction summaries")
+
+func failure(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg, args...)
+	os.Exit(-1)
+}
+
+func usage() {
+	failure(`
+Usage:
+
+alfreddump [options] <file> [<file>...]
+
+Reads capture files (pcap or pcapng format, e.g. written by tcpdump or
+wireshark) and outputs the A.L.F.R.E.D. packets found in UDP traffic.
+Data that was sent in transactions (push data, followed by a final
+status packet) is summarized per transaction at the end of each file,
+listing missing packets.
+
+available options:
+ -port <port>  UDP port to look for (default 16962 = 0x4242)
+ -json         output JSON objects, one per line
+ -decode       decode payloads of known data types (gluon nodeinfo
+               and statistics, batman-adv vis)
+ -q            only output the transaction summaries
+`)
+}
+
+// a data item found in a push data packet
+type dumpData struct {
+	Source       alfred.HardwareAddr `json:"source"`
+	Type         uint8               `json:"type"`
+	Version      uint8               `json:"version"`
+	Length       int                 `json:"length"`
+	Content      interface{}         `json:"content,omitempty"`
+	ContentError string              `json:"content_error,omitempty"`
+}
+
+// a decoded A.L.F.R.E.D. packet
+type dumpPacket struct {
+	Kind          string              `json:"kind"`
+	File          string              `json:"file"`
+	Frame         int                 `json:"frame"`
+	Time          time.Time           `json:"time"`
+	Src           string              `json:"src"`
+	Dst           string              `json:"dst"`
+	Type          string              `json:"type"`
+	Version       uint8               `json:"version"`
+	TxId          *uint16             `json:"tx_id,omitempty"`
+	SeqNo         *uint16             `json:"seqno,omitempty"`
+	RequestedType *uint8              `json:"requested_type,omitempty"`
+	Mode          *uint8              `json:"mode,omitempty"`
+	Interfaces    []string            `json:"interfaces,omitempty"`
+	Source        alfred.HardwareAddr `json:"source,omitempty"`
+	DataType      *uint8              `json:"data_type,omitempty"`
+	MAC           string              `json:"mac,omitempty"`
+	Data          []dumpData          `json:"data,omitempty"`
+	Error         string              `json:"error,omitempty"`
+}
+
+// state of a transaction, collected from the packets belonging to it
+type dumpTransaction struct {
+	Kind  string    `json:"kind"`
+	File  string    `json:"file"`
+	Src   string    `json:"src"`
+	Dst   string    `json:"dst"`
+	TxId  uint16    `json:"tx_id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// sequence numbers of the push data packets seen
+	Seen []uint16 `json:"seen"`
+	// number of push data packets according to the final status
+	// packet, nil if it was not seen
+	Count     *uint16  `json:"count,omitempty"`
+	Missing   []uint16 `json:"missing,omitempty"`
+	Items     int      `json:"items"`
+	Signed    bool     `json:"signed"`
+	Complete  bool     `json:"complete"`
+	Duplicate int      `json:"duplicate,omitempty"`
+	seen      map[uint16]struct{}
+}
+
+// collects transactions in the order they were started
+type transactions struct {
+	file  string
+	list  []*dumpTransaction
+	index map[string]*dumpTransaction
+}
+
+// find or start the transaction that a packet belongs to.
+// Transaction IDs are chosen by the requester, so the same ID may be
+// used by several senders.
+func (t *transactions) get(src *net.UDPAddr, dst *net.UDPAddr, id uint16, ts time.Time) *dumpTransaction {
+	key := fmt.Sprintf("%s %s %d", src.IP, dst.IP, id)
+	tx, exists := t.index[key]
+	if !exists {
+		tx = &dumpTransaction{
+			Kind:  "transaction",
+			File:  t.file,
+			Src:   src.String(),
+			Dst:   dst.String(),
+			TxId:  id,
+			Start: ts,
+			Seen:  make([]uint16, 0),
+			seen:  make(map[uint16]struct{}),
+		}
+		t.index[key] = tx
+		t.list = append(t.list, tx)
+	}
+	tx.End = ts
+	return tx
+}
+
+// check which sequence numbers are missing
+func (tx *dumpTransaction) finish() {
+	sort.Slice(tx.Seen, func(i, j int) bool { return tx.Seen[i] < tx.Seen[j] })
+	var last uint16
+	if tx.Count != nil {
+		last = *tx.Count
+	} else if len(tx.Seen) > 0 {
+		// without a final packet, only gaps can be detected
+		last = tx.Seen[len(tx.Seen)-1]
+	}
+	for i := uint16(0); i < last; i++ {
+		if _, exists := tx.seen[i]; !exists {
+			tx.Missing = append(tx.Missing, i)
+		}
+	}
+	tx.Complete = tx.Count != nil && len(tx.Missing) == 0
+}
+
+func u8(v uint8) *uint8    { return &v }
+func u16(v uint16) *uint16 { return &v }
+
+// decode the A.L.F.R.E.D. packet in a datagram
+func dumpDatagram(n int, ts time.Time, d *datagram, txs *transactions) *dumpPacket {
+	p := &dumpPacket{
+		Kind:  "packet",
+		File:  txs.file,
+		Frame: n,
+		Time:  ts,
+		Src:   d.src.String(),
+		Dst:   d.dst.String(),
+	}
+	pkg, err := alfred.Decode(d.payload)
+	if h := alfred.PacketHeader(pkg); h != nil {
+		p.Type = alfred.PacketTypeName(h.Type)
+		p.Version = h.Version
+	}
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	switch pkg := pkg.(type) {
+	case *alfred.PushDataV0:
+		p.TxId, p.SeqNo = u16(pkg.Tx.Id), u16(pkg.Tx.SeqNo)
+		p.Data = make([]dumpData, 0, len(pkg.Data))
+		for _, item := range pkg.Data {
+			p.Data = append(p.Data, dumpItem(item))
+		}
+		tx := txs.get(d.src, d.dst, pkg.Tx.Id, ts)
+		if _, exists := tx.seen[pkg.Tx.SeqNo]; exists {
+			tx.Duplicate++
+		} else {
+			tx.seen[pkg.Tx.SeqNo] = struct{}{}
+			tx.Seen = append(tx.Seen, pkg.Tx.SeqNo)
+			tx.Items += len(pkg.Data)
+		}
+	case *alfred.StatusV0:
+		p.TxId, p.SeqNo = u16(pkg.Tx.Id), u16(pkg.Tx.SeqNo)
+		if pkg.Header.Type == alfred.ALFRED_STATUS_TXEND {
+			tx := txs.get(d.src, d.dst, pkg.Tx.Id, ts)
+			tx.Count = u16(pkg.Tx.SeqNo)
+		}
+	case *alfred.SignatureV0:
+		p.TxId, p.SeqNo = u16(pkg.Tx.Id), u16(pkg.Tx.SeqNo)
+		p.MAC = hex.EncodeToString(pkg.MAC)
+		txs.get(d.src, d.dst, pkg.Tx.Id, ts).Signed = true
+	case *alfred.RequestV0:
+		p.TxId, p.RequestedType = u16(pkg.TxId), u8(pkg.RequestedType)
+	case *alfred.ModeSwitchV0:
+		p.Mode = u8(pkg.Mode)
+	case *alfred.ChangeInterfaceV0:
+		p.Interfaces = pkg.Interfaces()
+	case *alfred.ServerStatusReqV0:
+		p.TxId, p.SeqNo = u16(pkg.Tx.Id), u16(pkg.Tx.SeqNo)
+	case *alfred.ServerStatusRepV0:
+		p.TxId, p.SeqNo = u16(pkg.Tx.Id), u16(pkg.Tx.SeqNo)
+		p.Mode = u8(pkg.Mode)
+		for _, iface := range pkg.NetIfaces {
+			p.Interfaces = append(p.Interfaces, iface.Name)
+		}
+	case *alfred.EventNotifyV0:
+		p.Source, p.DataType = pkg.Source, u8(pkg.Type)
+	}
+	return p
+}
+
+// describe a data item, decoding its content if asked to
+func dumpItem(item alfred.Data) dumpData {
+	d := dumpData{
+		Source:  item.Source,
+		Type:    item.Header.Type,
+		Version: item.Header.Version,
+		Length:  len(item.Data),
+	}
+	if !*decode {
+		return d
+	}
+	content, err := alfred.DecodeContent(item)
+	if err == nil {
+		d.Content = content
+	} else if err != alfred.ErrUnknownContent {
+		d.ContentError = err.Error()
+	}
+	return d
+}
+
+func optional16(name string, v *uint16) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf(" %s=%d", name, *v)
+}
+
+func optional8(name string, v *uint8) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf(" %s=%d", name, *v)
+}
+
+func printPacket(w io.Writer, p *dumpPacket) {
+	if *jsonOutput {
+		json.NewEncoder(w).Encode(p)
+		return
+	}
+	fmt.Fprintf(w, "#%d %s %s > %s %s", p.Frame, p.Time.Format(time.RFC3339Nano), p.Src, p.Dst, p.Type)
+	fmt.Fprint(w, optional16("tx", p.TxId), optional16("seq", p.SeqNo), optional8("type", p.RequestedType), optional8("mode", p.Mode))
+	if p.Interfaces != nil {
+		fmt.Fprintf(w, " interfaces=%s", strings.Join(p.Interfaces, ","))
+	}
+	if p.DataType != nil {
+		fmt.Fprintf(w, " source=%v type=%d", p.Source, *p.DataType)
+	}
+	if p.MAC != "" {
+		fmt.Fprintf(w, " mac=%s", p.MAC)
+	}
+	if p.Data != nil {
+		fmt.Fprintf(w, " items=%d", len(p.Data))
+	}
+	if p.Error != "" {
+		fmt.Fprintf(w, " error: %s", p.Error)
+	}
+	fmt.Fprintln(w)
+	for _, d := range p.Data {
+		fmt.Fprintf(w, "    %v type=%d version=%d length=%d\n", d.Source, d.Type, d.Version, d.Length)
+		if d.ContentError != "" {
+			fmt.Fprintf(w, "      cannot decode: %s\n", d.ContentError)
+		} else if d.Content != nil {
+			content, _ := json.Marshal(d.Content)
+			fmt.Fprintf(w, "      %s\n", content)
+		}
+	}
+}
+
+func formatSeqNos(seqnos []uint16) string {
+	s := make([]string, len(seqnos))
+	for i, n := range seqnos {
+		s[i] = fmt.Sprintf("%d", n)
+	}
+	return strings.Join(s, ",")
+}
+
+func printTransaction(w io.Writer, tx *dumpTransaction) {
+	if *jsonOutput {
+		json.NewEncoder(w).Encode(tx)
+		return
+	}
+	fmt.Fprintf(w, "transaction %d %s > %s: %d packets, %d items", tx.TxId, tx.Src, tx.Dst, len(tx.Seen), tx.Items)
+	if tx.Signed {
+		fmt.Fprint(w, ", signed")
+	}
+	if tx.Duplicate > 0 {
+		fmt.Fprintf(w, ", %d duplicates", tx.Duplicate)
+	}
+	switch {
+	case tx.Complete:
+		fmt.Fprint(w, ", complete")
+	case tx.Count == nil:
+		fmt.Fprint(w, ", final packet missing")
+	default:
+		fmt.Fprintf(w, ", %d expected", *tx.Count)
+	}
+	if len(tx.Missing) > 0 {
+		fmt.Fprintf(w, ", missing: %s", formatSeqNos(tx.Missing))
+	}
+	fmt.Fprintln(w)
+}
+
+// read a capture file and output the packets in it, followed by the
+// transactions
+func dumpFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	capture, err := openCapture(f)
+	if err != nil {
+		return err
+	}
+	txs := &transactions{file: filename, index: make(map[string]*dumpTransaction)}
+	// a truncated file is not unusual when capturing is interrupted,
+	// so show what was found anyway
+	defer func() {
+		for _, tx := range txs.list {
+			tx.finish()
+			printTransaction(os.Stdout, tx)
+		}
+	}()
+	for n := 1; ; n++ {
+		fr, err := capture.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		d := decodeFrame(fr)
+		if d == nil || (d.src.Port != *port && d.dst.Port != *port) {
+			continue
+		}
+		p := dumpDatagram(n, fr.time, d, txs)
+		if !*summaryOnly {
+			printPacket(os.Stdout, p)
+		}
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	for _, filename := range flag.Args() {
+		if flag.NArg() > 1 && !*jsonOutput {
+			fmt.Printf("# %s\n", filename)
+		}
+		if err := dumpFile(filename); err != nil {
+			failure("Error reading %s: %v\n", filename, err)
+		}
+	}
+}
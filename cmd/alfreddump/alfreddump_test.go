@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hwhw/mesh/alfred"
+)
+
+func pushData(id uint16, seqno uint16, items ...string) []byte {
+	data := make([]alfred.Data, 0, len(items))
+	for _, item := range items {
+		data = append(data, alfred.Data{
+			Source: alfred.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+			Header: &alfred.TLV{Type: 100, Version: 0, Length: uint16(len(item))},
+			Data:   []byte(item),
+		})
+	}
+	buf := new(bytes.Buffer)
+	alfred.NewPushDataV0(&alfred.TransactionMgmt{Id: id, SeqNo: seqno}, data).Write(buf)
+	return buf.Bytes()
+}
+
+func txEnd(id uint16, count uint16) []byte {
+	buf := new(bytes.Buffer)
+	alfred.NewStatusV0(alfred.ALFRED_STATUS_TXEND, &alfred.TransactionMgmt{Id: id, SeqNo: count}).Write(buf)
+	return buf.Bytes()
+}
+
+// a captured ethernet frame with an IPv6 UDP datagram
+func alfredFrame(ts time.Time, sport, dport int, payload []byte) frame {
+	return frame{
+		time:     ts,
+		linktype: LINKTYPE_ETHERNET,
+		data:     ethernetFrame(ETHERTYPE_IPV6, ipv6Packet(IPPROTO_UDP, udpHeader(sport, dport, payload))),
+	}
+}
+
+// decode a capture like dumpFile does
+func dumpCapture(t *testing.T, file []byte) ([]*dumpPacket, []*dumpTransaction) {
+	frames, err := readFrames(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := &transactions{file: "test", index: make(map[string]*dumpTransaction)}
+	packets := []*dumpPacket{}
+	for n, f := range frames {
+		d := decodeFrame(f)
+		if d == nil || (d.src.Port != alfred.ALFRED_PORT && d.dst.Port != alfred.ALFRED_PORT) {
+			continue
+		}
+		packets = append(packets, dumpDatagram(n+1, f.time, d, txs))
+	}
+	for _, tx := range txs.list {
+		tx.finish()
+	}
+	return packets, txs.list
+}
+
+func TestDumpTransactions(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	frames := []frame{
+		alfredFrame(at(0), alfred.ALFRED_PORT, alfred.ALFRED_PORT, pushData(5, 0, "one", "two")),
+		// not A.L.F.R.E.D.
+		alfredFrame(at(1), 53, 53, []byte("dns")),
+		// seqno 1 is missing
+		alfredFrame(at(2), alfred.ALFRED_PORT, alfred.ALFRED_PORT, pushData(5, 2, "three")),
+		alfredFrame(at(3), alfred.ALFRED_PORT, alfred.ALFRED_PORT, pushData(5, 0, "one", "two")),
+		alfredFrame(at(4), alfred.ALFRED_PORT, alfred.ALFRED_PORT, txEnd(5, 3)),
+		// a transaction without final packet
+		alfredFrame(at(5), alfred.ALFRED_PORT, alfred.ALFRED_PORT, pushData(6, 1, "four")),
+		alfredFrame(at(6), alfred.ALFRED_PORT, alfred.ALFRED_PORT, []byte{0, 0, 0}),
+		// one packet per datagram
+		alfredFrame(at(7), alfred.ALFRED_PORT, alfred.ALFRED_PORT, concat(txEnd(7, 1), txEnd(7, 1))),
+	}
+	captures := map[string][]byte{
+		"pcap":   pcapFile(binary.BigEndian, false, LINKTYPE_ETHERNET, frames),
+		"pcapng": pcapngFile(binary.LittleEndian, 0, frames),
+	}
+	for name, file := range captures {
+		packets, txs := dumpCapture(t, file)
+		if len(packets) != 7 {
+			t.Fatalf("%s: got %d packets", name, len(packets))
+		}
+		if p := packets[3]; p.Frame != 5 || p.Type != alfred.PacketTypeName(alfred.ALFRED_STATUS_TXEND) || *p.SeqNo != 3 {
+			t.Errorf("%s: got packet %+v", name, p)
+		}
+		for _, p := range packets[5:] {
+			if p.Error == "" {
+				t.Errorf("%s: got packet %+v for garbage", name, p)
+			}
+		}
+		if len(txs) != 2 {
+			t.Fatalf("%s: got %d transactions", name, len(txs))
+		}
+
+		tx := txs[0]
+		if tx.TxId != 5 || tx.Items != 3 || tx.Duplicate != 1 || tx.Count == nil || *tx.Count != 3 {
+			t.Errorf("%s: got transaction %+v", name, tx)
+		}
+		if len(tx.Missing) != 1 || tx.Missing[0] != 1 || tx.Complete {
+			t.Errorf("%s: missing %v, complete %v", name, tx.Missing, tx.Complete)
+		}
+		if !tx.Start.Equal(at(0)) || !tx.End.Equal(at(4)) {
+			t.Errorf("%s: transaction from %v to %v", name, tx.Start, tx.End)
+		}
+		out := new(bytes.Buffer)
+		printTransaction(out, tx)
+		if !strings.Contains(out.String(), "3 expected, missing: 1") {
+			t.Errorf("%s: printed %q", name, out)
+		}
+
+		// without a final packet, the gap before seqno 1 is still found
+		tx = txs[1]
+		if tx.TxId != 6 || tx.Count != nil || len(tx.Missing) != 1 || tx.Missing[0] != 0 || tx.Complete {
+			t.Errorf("%s: got transaction %+v", name, tx)
+		}
+	}
+}
+
+func TestFinishTransaction(t *testing.T) {
+	tests := []struct {
+		seen     []uint16
+		count    *uint16
+		missing  []uint16
+		complete bool
+	}{
+		{[]uint16{0, 1, 2}, u16(3), nil, true},
+		{[]uint16{2, 0, 1}, u16(3), nil, true},
+		{[]uint16{0, 2}, u16(3), []uint16{1}, false},
+		{[]uint16{0, 1}, u16(4), []uint16{2, 3}, false},
+		{[]uint16{}, u16(0), nil, true},
+		{[]uint16{}, u16(2), []uint16{0, 1}, false},
+		{[]uint16{0, 3}, nil, []uint16{1, 2}, false},
+		{[]uint16{0, 1}, nil, nil, false},
+		{[]uint16{}, nil, nil, false},
+	}
+	for _, test := range tests {
+		tx := &dumpTransaction{Seen: append([]uint16{}, test.seen...), Count: test.count, seen: make(map[uint16]struct{})}
+		for _, seqno := range test.seen {
+			tx.seen[seqno] = struct{}{}
+		}
+		tx.finish()
+		if formatSeqNos(tx.Missing) != formatSeqNos(test.missing) || tx.Complete != test.complete {
+			t.Errorf("seen %v: missing %v, complete %v, want %v, %v", test.seen, tx.Missing, tx.Complete, test.missing, test.complete)
+		}
+	}
+}
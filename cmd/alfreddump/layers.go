@@ -0,0 +1,192 @@
+package main
+
+// extraction of UDP datagrams from captured frames
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// link layer types, see http://www.tcpdump.org/linktypes.html
+const (
+	LINKTYPE_NULL       = 0
+	LINKTYPE_ETHERNET   = 1
+	LINKTYPE_RAW        = 101
+	LINKTYPE_LOOP       = 108
+	LINKTYPE_LINUX_SLL  = 113
+	LINKTYPE_IPV4       = 228
+	LINKTYPE_IPV6       = 229
+	LINKTYPE_LINUX_SLL2 = 276
+)
+
+const (
+	ETHERTYPE_IPV4  = 0x0800
+	ETHERTYPE_IPV6  = 0x86DD
+	ETHERTYPE_VLAN  = 0x8100
+	ETHERTYPE_QINQ  = 0x88A8
+	IPPROTO_UDP     = 17
+	IPPROTO_HOPOPTS = 0
+	IPPROTO_ROUTING = 43
+	IPPROTO_FRAG    = 44
+	IPPROTO_AH      = 51
+	IPPROTO_DSTOPTS = 60
+)
+
+// a UDP datagram found in a frame
+type datagram struct {
+	src     *net.UDPAddr
+	dst     *net.UDPAddr
+	payload []byte
+}
+
+// find the UDP datagram in a frame, returns nil if there is none.
+// Fragmented IP packets are not reassembled and hence ignored.
+func decodeFrame(f *frame) *datagram {
+	data := f.data
+	switch f.linktype {
+	case LINKTYPE_ETHERNET:
+		if len(data) < 14 {
+			return nil
+		}
+		ethertype := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for (ethertype == ETHERTYPE_VLAN || ethertype == ETHERTYPE_QINQ) && len(data) >= 4 {
+			ethertype = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		return decodeEthertype(ethertype, data)
+	case LINKTYPE_LINUX_SLL:
+		if len(data) < 16 {
+			return nil
+		}
+		return decodeEthertype(binary.BigEndian.Uint16(data[14:16]), data[16:])
+	case LINKTYPE_LINUX_SLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		return decodeEthertype(binary.BigEndian.Uint16(data[0:2]), data[20:])
+	case LINKTYPE_NULL, LINKTYPE_LOOP:
+		// address family in host byte order, the IP version tells
+		// just as well
+		if len(data) < 4 {
+			return nil
+		}
+		return decodeIP(data[4:])
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		return decodeIP(data)
+	}
+	return nil
+}
+
+func decodeEthertype(ethertype uint16, data []byte) *datagram {
+	switch ethertype {
+	case ETHERTYPE_IPV4, ETHERTYPE_IPV6:
+		return decodeIP(data)
+	}
+	return nil
+}
+
+// decode an IPv4 or IPv6 packet
+func decodeIP(data []byte) *datagram {
+	if len(data) < 1 {
+		return nil
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return decodeIPv4(data)
+	case 6:
+		return decodeIPv6(data)
+	}
+	return nil
+}
+
+func decodeIPv4(data []byte) *datagram {
+	if len(data) < 20 {
+		return nil
+	}
+	hlen := int(data[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	if hlen < 20 || total < hlen || len(data) < hlen {
+		return nil
+	}
+	if total < len(data) {
+		// strip link layer padding
+		data = data[:total]
+	}
+	// more fragments flag or fragment offset set
+	if binary.BigEndian.Uint16(data[6:8])&0x3FFF != 0 {
+		return nil
+	}
+	if data[9] != IPPROTO_UDP {
+		return nil
+	}
+	return decodeUDP(net.IP(data[12:16]), net.IP(data[16:20]), data[hlen:])
+}
+
+func decodeIPv6(data []byte) *datagram {
+	if len(data) < 40 {
+		return nil
+	}
+	payloadlen := int(binary.BigEndian.Uint16(data[4:6]))
+	next := data[6]
+	src, dst := net.IP(data[8:24]), net.IP(data[24:40])
+	data = data[40:]
+	if payloadlen < len(data) {
+		data = data[:payloadlen]
+	}
+	// skip extension headers
+	for {
+		switch next {
+		case IPPROTO_UDP:
+			return decodeUDP(src, dst, data)
+		case IPPROTO_HOPOPTS, IPPROTO_ROUTING, IPPROTO_DSTOPTS:
+			if len(data) < 8 {
+				return nil
+			}
+			hlen := (int(data[1]) + 1) * 8
+			if len(data) < hlen {
+				return nil
+			}
+			next = data[0]
+			data = data[hlen:]
+		case IPPROTO_AH:
+			if len(data) < 8 {
+				return nil
+			}
+			hlen := (int(data[1]) + 2) * 4
+			if len(data) < hlen {
+				return nil
+			}
+			next = data[0]
+			data = data[hlen:]
+		case IPPROTO_FRAG:
+			if len(data) < 8 {
+				return nil
+			}
+			// fragment offset or more fragments flag set
+			if binary.BigEndian.Uint16(data[2:4]) != 0 {
+				return nil
+			}
+			next = data[0]
+			data = data[8:]
+		default:
+			return nil
+		}
+	}
+}
+
+func decodeUDP(src net.IP, dst net.IP, data []byte) *datagram {
+	if len(data) < 8 {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length < 8 || length > len(data) {
+		// truncated capture
+		length = len(data)
+	}
+	return &datagram{
+		src:     &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(data[0:2]))},
+		dst:     &net.UDPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(data[2:4]))},
+		payload: data[8:length],
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var (
+	testSrc4 = net.IPv4(192, 0, 2, 1).To4()
+	testDst4 = net.IPv4(192, 0, 2, 2).To4()
+	testSrc6 = net.ParseIP("fe80::1")
+	testDst6 = net.ParseIP("ff02::1")
+)
+
+func udpHeader(sport, dport int, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], uint16(sport))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dport))
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+len(payload)))
+	return append(b, payload...)
+}
+
+// build an IPv4 packet, fragment holds flags and fragment offset
+func ipv4Packet(proto byte, fragment uint16, payload []byte) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(20+len(payload)))
+	binary.BigEndian.PutUint16(b[6:8], fragment)
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:16], testSrc4)
+	copy(b[16:20], testDst4)
+	return append(b, payload...)
+}
+
+// build an IPv6 packet, payload may start with extension headers
+func ipv6Packet(next byte, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(payload))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = next
+	b[7] = 64
+	copy(b[8:24], testSrc6)
+	copy(b[24:40], testDst6)
+	return append(b, payload...)
+}
+
+func ethernetFrame(ethertype uint16, payload []byte) []byte {
+	b := make([]byte, 14, 14+len(payload))
+	copy(b[0:6], []byte{0x33, 0x33, 0, 0, 0, 1})
+	copy(b[6:12], []byte{0x02, 0, 0, 0, 0, 1})
+	binary.BigEndian.PutUint16(b[12:14], ethertype)
+	return append(b, payload...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDecodeFrame(t *testing.T) {
+	payload := []byte("alfred")
+	udp := udpHeader(4000, 16962, payload)
+	v4 := ipv4Packet(IPPROTO_UDP, 0, udp)
+	v6 := ipv6Packet(IPPROTO_UDP, udp)
+	vlan := []byte{0, 42, 0x86, 0xDD}
+	hopopts := []byte{IPPROTO_UDP, 0, 0, 0, 0, 0, 0, 0}
+	// offset 0, no more fragments: a complete packet
+	atomicFragment := []byte{IPPROTO_UDP, 0, 0, 0, 0, 0, 0, 1}
+	sll := concat([]byte{0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0}, []byte{0x86, 0xDD})
+	sll2 := concat([]byte{0x86, 0xDD}, make([]byte, 18))
+
+	tests := []struct {
+		name     string
+		linktype uint32
+		data     []byte
+		ip       net.IP
+		payload  []byte
+	}{
+		{"ethernet IPv6", LINKTYPE_ETHERNET, ethernetFrame(ETHERTYPE_IPV6, v6), testSrc6, payload},
+		{"ethernet IPv4", LINKTYPE_ETHERNET, ethernetFrame(ETHERTYPE_IPV4, v4), testSrc4, payload},
+		{"ethernet padding", LINKTYPE_ETHERNET, ethernetFrame(ETHERTYPE_IPV4, concat(v4, make([]byte, 20))), testSrc4, payload},
+		{"VLAN", LINKTYPE_ETHERNET, ethernetFrame(ETHERTYPE_VLAN, concat(vlan, v6)), testSrc6, payload},
+		{"QinQ", LINKTYPE_ETHERNET, ethernetFrame(ETHERTYPE_QINQ, concat([]byte{0, 1, 0x81, 0}, vlan, v6)), testSrc6, payload},
+		{"hop-by-hop options", LINKTYPE_ETHERNET, ethernetFrame(ETHERTYPE_IPV6, ipv6Packet(IPPROTO_HOPOPTS, concat(hopopts, udp))), testSrc6, payload},
+		{"atomic fragment", LINKTYPE_RAW, ipv6Packet(IPPROTO_FRAG, concat(atomicFragment, udp)), testSrc6, payload},
+		{"cooked", LINKTYPE_LINUX_SLL, concat(sll, v6), testSrc6, payload},
+		{"cooked v2", LINKTYPE_LINUX_SLL2, concat(sll2, v6), testSrc6, payload},
+		{"loopback", LINKTYPE_NULL, concat([]byte{24, 0, 0, 0}, v6), testSrc6, payload},
+		{"raw IPv4", LINKTYPE_IPV4, v4, testSrc4, payload},
+		{"raw IPv6", LINKTYPE_IPV6, v6, testSrc6, payload},
+		{"truncated UDP", LINKTYPE_RAW, ipv6Packet(IPPROTO_UDP, udp[:10]), testSrc6, payload[:2]},
+
+		{"other ethertype", LINKTYPE_ETHERNET, ethernetFrame(0x0806, v4), nil, nil},
+		{"IPv4 fragment", LINKTYPE_RAW, ipv4Packet(IPPROTO_UDP, 0x2000, udp), nil, nil},
+		{"IPv6 fragment", LINKTYPE_RAW, ipv6Packet(IPPROTO_FRAG, concat([]byte{IPPROTO_UDP, 0, 0, 9, 0, 0, 0, 1}, udp)), nil, nil},
+		{"TCP", LINKTYPE_RAW, ipv4Packet(6, 0, udp), nil, nil},
+		{"short ethernet", LINKTYPE_ETHERNET, ethernetFrame(ETHERTYPE_IPV6, nil)[:13], nil, nil},
+		{"short IPv6", LINKTYPE_RAW, v6[:39], nil, nil},
+		{"short UDP", LINKTYPE_RAW, ipv4Packet(IPPROTO_UDP, 0, udp[:7]), nil, nil},
+		{"unknown link type", 12345, v6, nil, nil},
+	}
+	for _, test := range tests {
+		d := decodeFrame(&frame{linktype: test.linktype, data: test.data})
+		if test.ip == nil {
+			if d != nil {
+				t.Errorf("%s: found datagram %+v", test.name, d)
+			}
+			continue
+		}
+		if d == nil {
+			t.Errorf("%s: no datagram found", test.name)
+			continue
+		}
+		if !d.src.IP.Equal(test.ip) || d.src.Port != 4000 || d.dst.Port != 16962 || !bytes.Equal(d.payload, test.payload) {
+			t.Errorf("%s: got %v > %v %q", test.name, d.src, d.dst, d.payload)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+// reading of capture files in pcap and pcapng format
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrFormat = errors.New("not a pcap or pcapng file")
+var ErrTruncated = errors.New("capture file is truncated")
+
+// sanity limit for the size of frames and blocks, larger ones are
+// considered to be garbage
+const maxBlockLength = 1 << 24
+
+// a frame read from a capture file
+type frame struct {
+	time     time.Time
+	linktype uint32
+	data     []byte
+}
+
+type captureReader interface {
+	// return the next frame, io.EOF at the end of the file
+	next() (*frame, error)
+}
+
+// open a capture file, detecting its format
+func openCapture(r io.Reader) (captureReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	switch {
+	case binary.LittleEndian.Uint32(magic) == 0x0A0D0D0A:
+		return &pcapngReader{r: br}, nil
+	case binary.LittleEndian.Uint32(magic) == 0xA1B2C3D4:
+		return newPcapReader(br, binary.LittleEndian, time.Microsecond)
+	case binary.BigEndian.Uint32(magic) == 0xA1B2C3D4:
+		return newPcapReader(br, binary.BigEndian, time.Microsecond)
+	case binary.LittleEndian.Uint32(magic) == 0xA1B23C4D:
+		return newPcapReader(br, binary.LittleEndian, time.Nanosecond)
+	case binary.BigEndian.Uint32(magic) == 0xA1B23C4D:
+		return newPcapReader(br, binary.BigEndian, time.Nanosecond)
+	}
+	return nil, ErrFormat
+}
+
+// read exactly n bytes, reporting a truncated file if there are less
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// classic pcap format
+type pcapReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	resolution time.Duration
+	linktype   uint32
+}
+
+func newPcapReader(r io.Reader, order binary.ByteOrder, resolution time.Duration) (*pcapReader, error) {
+	header, err := readBytes(r, 24)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapReader{
+		r:          r,
+		order:      order,
+		resolution: resolution,
+		linktype:   order.Uint32(header[20:24]),
+	}, nil
+}
+
+func (p *pcapReader) next() (*frame, error) {
+	header, err := readBytes(p.r, 16)
+	if err != nil {
+		return nil, err
+	}
+	caplen := p.order.Uint32(header[8:12])
+	if caplen > maxBlockLength {
+		return nil, ErrFormat
+	}
+	data, err := readBytes(p.r, int(caplen))
+	if err != nil {
+		if err == io.EOF {
+			err = ErrTruncated
+		}
+		return nil, err
+	}
+	sec := int64(p.order.Uint32(header[0:4]))
+	frac := int64(p.order.Uint32(header[4:8]))
+	return &frame{
+		time:     time.Unix(sec, frac*int64(p.resolution)),
+		linktype: p.linktype,
+		data:     data,
+	}, nil
+}
+
+// block types in pcapng files
+const (
+	PCAPNG_SECTION_HEADER   = 0x0A0D0D0A
+	PCAPNG_INTERFACE        = 0x00000001
+	PCAPNG_PACKET           = 0x00000002
+	PCAPNG_SIMPLE_PACKET    = 0x00000003
+	PCAPNG_ENHANCED_PACKET  = 0x00000006
+	PCAPNG_OPTION_END       = 0
+	PCAPNG_OPTION_TSRESOL   = 9
+	PCAPNG_BYTE_ORDER_MAGIC = 0x1A2B3C4D
+)
+
+// interface described in a pcapng file
+type pcapngInterface struct {
+	linktype uint32
+	snaplen  uint32
+	// timestamp units per second
+	units uint64
+}
+
+// pcapng format
+type pcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+}
+
+func (p *pcapngReader) next() (*frame, error) {
+	for {
+		header, err := readBytes(p.r, 8)
+		if err != nil {
+			return nil, err
+		}
+		blocktype := binary.LittleEndian.Uint32(header[0:4])
+		if blocktype == PCAPNG_SECTION_HEADER {
+			// the section header determines the byte order of
+			// everything up to the next section header
+			bom, err := readBytes(p.r, 4)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case binary.LittleEndian.Uint32(bom) == PCAPNG_BYTE_ORDER_MAGIC:
+				p.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(bom) == PCAPNG_BYTE_ORDER_MAGIC:
+				p.order = binary.BigEndian
+			default:
+				return nil, ErrFormat
+			}
+			p.interfaces = nil
+			length := p.order.Uint32(header[4:8])
+			if length < 28 || length%4 != 0 || length > maxBlockLength {
+				return nil, ErrFormat
+			}
+			if _, err := readBytes(p.r, int(length)-12); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if p.order == nil {
+			return nil, ErrFormat
+		}
+		blocktype = p.order.Uint32(header[0:4])
+		length := p.order.Uint32(header[4:8])
+		if length < 12 || length%4 != 0 || length > maxBlockLength {
+			return nil, ErrFormat
+		}
+		// body and trailing length
+		body, err := readBytes(p.r, int(length)-8)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrTruncated
+			}
+			return nil, err
+		}
+		body = body[:len(body)-4]
+		switch blocktype {
+		case PCAPNG_INTERFACE:
+			if len(body) < 8 {
+				return nil, ErrFormat
+			}
+			p.interfaces = append(p.interfaces, pcapngInterface{
+				linktype: uint32(p.order.Uint16(body[0:2])),
+				snaplen:  p.order.Uint32(body[4:8]),
+				units:    timestampUnits(body[8:], p.order),
+			})
+		case PCAPNG_ENHANCED_PACKET:
+			if len(body) < 20 {
+				return nil, ErrFormat
+			}
+			return p.frame(p.order.Uint32(body[0:4]), body[4:12], p.order.Uint32(body[12:16]), body[20:])
+		case PCAPNG_PACKET:
+			if len(body) < 20 {
+				return nil, ErrFormat
+			}
+			return p.frame(uint32(p.order.Uint16(body[0:2])), body[4:12], p.order.Uint32(body[12:16]), body[20:])
+		case PCAPNG_SIMPLE_PACKET:
+			if len(body) < 4 || len(p.interfaces) == 0 {
+				return nil, ErrFormat
+			}
+			caplen := p.order.Uint32(body[0:4])
+			if snaplen := p.interfaces[0].snaplen; snaplen != 0 && caplen > snaplen {
+				caplen = snaplen
+			}
+			if int(caplen) > len(body)-4 {
+				return nil, ErrFormat
+			}
+			return &frame{
+				linktype: p.interfaces[0].linktype,
+				data:     body[4 : 4+caplen],
+			}, nil
+		}
+		// skip all other blocks
+	}
+}
+
+// find the timestamp resolution (units per second) in the options of
+// an interface block
+func timestampUnits(options []byte, order binary.ByteOrder) uint64 {
+	for len(options) >= 4 {
+		code := order.Uint16(options[0:2])
+		length := int(order.Uint16(options[2:4]))
+		// option values are padded to 32 bit
+		padded := (length + 3) &^ 3
+		if code == PCAPNG_OPTION_END || 4+padded > len(options) {
+			break
+		}
+		if code == PCAPNG_OPTION_TSRESOL && length >= 1 {
+			v := options[4]
+			if v&0x80 != 0 && v&0x7F < 64 {
+				return 1 << (v & 0x7F)
+			}
+			if v <= 19 {
+				units := uint64(1)
+				for i := uint8(0); i < v; i++ {
+					units *= 10
+				}
+				return units
+			}
+			break
+		}
+		options = options[4+padded:]
+	}
+	// microseconds by default
+	return 1000000
+}
+
+// build a frame from the parts of a packet block
+func (p *pcapngReader) frame(ifid uint32, timestamp []byte, caplen uint32, data []byte) (*frame, error) {
+	if int(ifid) >= len(p.interfaces) || int(caplen) > len(data) {
+		return nil, ErrFormat
+	}
+	iface := p.interfaces[ifid]
+	ts := uint64(p.order.Uint32(timestamp[0:4]))<<32 | uint64(p.order.Uint32(timestamp[4:8]))
+	secs, frac := ts/iface.units, ts%iface.units
+	var nsecs uint64
+	if iface.units >= 1e9 {
+		nsecs = frac / (iface.units / 1e9)
+	} else {
+		nsecs = frac * 1e9 / iface.units
+	}
+	return &frame{
+		time:     time.Unix(int64(secs), int64(nsecs)),
+		linktype: iface.linktype,
+		data:     data[:caplen],
+	}, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// frames for the fixtures, with microsecond timestamps so all formats
+// can represent them
+var testFrames = []frame{
+	{time: time.Unix(1600000000, 123456000), linktype: LINKTYPE_ETHERNET, data: []byte("first frame")},
+	{time: time.Unix(1600000001, 0), linktype: LINKTYPE_ETHERNET, data: []byte("2nd")},
+	{time: time.Unix(1600000002, 999999000), linktype: LINKTYPE_ETHERNET, data: []byte{}},
+}
+
+// build a classic pcap file
+func pcapFile(order binary.ByteOrder, nanoseconds bool, linktype uint32, frames []frame) []byte {
+	buf := new(bytes.Buffer)
+	magic := uint32(0xA1B2C3D4)
+	if nanoseconds {
+		magic = 0xA1B23C4D
+	}
+	binary.Write(buf, order, magic)
+	binary.Write(buf, order, uint16(2))
+	binary.Write(buf, order, uint16(4))
+	binary.Write(buf, order, int32(0))
+	binary.Write(buf, order, uint32(0))
+	binary.Write(buf, order, uint32(65535))
+	binary.Write(buf, order, linktype)
+	for _, f := range frames {
+		frac := f.time.Nanosecond() / 1000
+		if nanoseconds {
+			frac = f.time.Nanosecond()
+		}
+		binary.Write(buf, order, uint32(f.time.Unix()))
+		binary.Write(buf, order, uint32(frac))
+		binary.Write(buf, order, uint32(len(f.data)))
+		binary.Write(buf, order, uint32(len(f.data)))
+		buf.Write(f.data)
+	}
+	return buf.Bytes()
+}
+
+// write a pcapng block, padding the body to 32 bit
+func pcapngBlock(buf *bytes.Buffer, order binary.ByteOrder, blocktype uint32, body []byte) {
+	padded := (len(body) + 3) &^ 3
+	length := uint32(12 + padded)
+	binary.Write(buf, order, blocktype)
+	binary.Write(buf, order, length)
+	buf.Write(body)
+	buf.Write(make([]byte, padded-len(body)))
+	binary.Write(buf, order, length)
+}
+
+// build a pcapng file with one interface, using enhanced packet blocks
+// and, if tsresol is not 0, that timestamp resolution option
+func pcapngFile(order binary.ByteOrder, tsresol byte, frames []frame) []byte {
+	buf := new(bytes.Buffer)
+	shb := new(bytes.Buffer)
+	binary.Write(shb, order, uint32(PCAPNG_BYTE_ORDER_MAGIC))
+	binary.Write(shb, order, uint16(1))
+	binary.Write(shb, order, uint16(0))
+	binary.Write(shb, order, int64(-1))
+	pcapngBlock(buf, order, PCAPNG_SECTION_HEADER, shb.Bytes())
+
+	idb := new(bytes.Buffer)
+	binary.Write(idb, order, uint16(frames[0].linktype))
+	binary.Write(idb, order, uint16(0))
+	binary.Write(idb, order, uint32(0))
+	units := uint64(1000000)
+	if tsresol != 0 {
+		binary.Write(idb, order, uint16(PCAPNG_OPTION_TSRESOL))
+		binary.Write(idb, order, uint16(1))
+		idb.Write([]byte{tsresol, 0, 0, 0})
+		binary.Write(idb, order, uint16(PCAPNG_OPTION_END))
+		binary.Write(idb, order, uint16(0))
+		if tsresol&0x80 != 0 {
+			units = 1 << (tsresol & 0x7F)
+		} else {
+			units = 1
+			for i := byte(0); i < tsresol; i++ {
+				units *= 10
+			}
+		}
+	}
+	pcapngBlock(buf, order, PCAPNG_INTERFACE, idb.Bytes())
+
+	// a block that readers skip
+	pcapngBlock(buf, order, 0x00000BAD, []byte("unknown"))
+
+	for _, f := range frames {
+		ts := uint64(f.time.Unix())*units + uint64(f.time.Nanosecond())*units/1e9
+		epb := new(bytes.Buffer)
+		binary.Write(epb, order, uint32(0))
+		binary.Write(epb, order, uint32(ts>>32))
+		binary.Write(epb, order, uint32(ts))
+		binary.Write(epb, order, uint32(len(f.data)))
+		binary.Write(epb, order, uint32(len(f.data)))
+		epb.Write(f.data)
+		pcapngBlock(buf, order, PCAPNG_ENHANCED_PACKET, epb.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// read all frames from a capture
+func readFrames(data []byte) ([]*frame, error) {
+	capture, err := openCapture(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]*frame, 0)
+	for {
+		f, err := capture.next()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, f)
+	}
+}
+
+func TestReadCapture(t *testing.T) {
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"pcap little endian", pcapFile(binary.LittleEndian, false, LINKTYPE_ETHERNET, testFrames)},
+		{"pcap big endian", pcapFile(binary.BigEndian, false, LINKTYPE_ETHERNET, testFrames)},
+		{"pcap nanoseconds little endian", pcapFile(binary.LittleEndian, true, LINKTYPE_ETHERNET, testFrames)},
+		{"pcap nanoseconds big endian", pcapFile(binary.BigEndian, true, LINKTYPE_ETHERNET, testFrames)},
+		{"pcapng little endian", pcapngFile(binary.LittleEndian, 0, testFrames)},
+		{"pcapng big endian", pcapngFile(binary.BigEndian, 0, testFrames)},
+		{"pcapng nanoseconds", pcapngFile(binary.LittleEndian, 9, testFrames)},
+		{"pcapng binary resolution", pcapngFile(binary.BigEndian, 0x80|20, testFrames)},
+	}
+	for _, test := range tests {
+		frames, err := readFrames(test.file)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(frames) != len(testFrames) {
+			t.Errorf("%s: read %d frames, want %d", test.name, len(frames), len(testFrames))
+			continue
+		}
+		for i, f := range frames {
+			want := testFrames[i]
+			// binary fractions of a second are not exact
+			if d := f.time.Sub(want.time); d < -time.Microsecond || d > time.Microsecond {
+				t.Errorf("%s: frame %d at %v, want %v", test.name, i, f.time, want.time)
+			}
+			if f.linktype != want.linktype || !bytes.Equal(f.data, want.data) {
+				t.Errorf("%s: frame %d is %+v, want %+v", test.name, i, f, want)
+			}
+		}
+	}
+}
+
+func TestReadCaptureErrors(t *testing.T) {
+	pcap := pcapFile(binary.BigEndian, false, LINKTYPE_ETHERNET, testFrames)
+	pcapng := pcapngFile(binary.BigEndian, 0, testFrames)
+	// 24 bytes file header, 16 bytes frame header, 11 bytes data
+	firstFrame := 24 + 16 + 11
+	tests := []struct {
+		name   string
+		file   []byte
+		frames int
+		err    error
+	}{
+		{"empty", []byte{}, 0, ErrFormat},
+		{"no capture", []byte("this is not a capture file"), 0, ErrFormat},
+		{"pcap header truncated", pcap[:20], 0, ErrTruncated},
+		{"pcap frame header truncated", pcap[:firstFrame+8], 1, ErrTruncated},
+		{"pcap frame data truncated", pcap[:firstFrame+16+2], 1, ErrTruncated},
+		{"pcap ends after a frame", pcap[:firstFrame], 1, nil},
+		{"pcapng block truncated", pcapng[:len(pcapng)-4], 2, ErrTruncated},
+		{"pcapng block header truncated", append(pcapng[:len(pcapng):len(pcapng)], 0, 0, 0), 3, ErrTruncated},
+		{"pcapng without section header", pcapng[28:], 0, ErrFormat},
+	}
+	for _, test := range tests {
+		frames, err := readFrames(test.file)
+		if err != test.err || len(frames) != test.frames {
+			t.Errorf("%s: read %d frames, error %v, want %d frames, error %v", test.name, len(frames), err, test.frames, test.err)
+		}
+	}
+}
+
+func TestTimestampUnits(t *testing.T) {
+	option := func(code uint16, value ...byte) []byte {
+		b := []byte{byte(code >> 8), byte(code), 0, byte(len(value))}
+		b = append(b, value...)
+		return append(b, make([]byte, (4-len(value)%4)%4)...)
+	}
+	tests := []struct {
+		options []byte
+		units   uint64
+	}{
+		{nil, 1000000},
+		{option(PCAPNG_OPTION_TSRESOL, 6), 1000000},
+		{option(PCAPNG_OPTION_TSRESOL, 9), 1000000000},
+		{option(PCAPNG_OPTION_TSRESOL, 0x80|10), 1024},
+		// other options come first
+		{append(option(2, 'e', 't', 'h', '0', 0), option(PCAPNG_OPTION_TSRESOL, 3)...), 1000},
+		// after the end of options
+		{append(option(PCAPNG_OPTION_END), option(PCAPNG_OPTION_TSRESOL, 3)...), 1000000},
+		// out of range
+		{option(PCAPNG_OPTION_TSRESOL, 20), 1000000},
+		// truncated option
+		{option(PCAPNG_OPTION_TSRESOL, 3)[:4], 1000000},
+	}
+	for _, test := range tests {
+		if units := timestampUnits(test.options, binary.BigEndian); units != test.units {
+			t.Errorf("%x: got %d units per second, want %d", test.options, units, test.units)
+		}
+	}
+}
@@ -1,14 +1,101 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
+	"fmt"
 	"github.com/hwhw/mesh/alfred"
+	"github.com/hwhw/mesh/batadvvis"
+	"github.com/hwhw/mesh/gluon"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
+// parse a data type (or "default")
+func parseType(packettype string) (uint8, error) {
+	if packettype == "default" {
+		return alfred.PACKETTYPE_ALL, nil
+	}
+	t, err := strconv.Atoi(packettype)
+	if err != nil || t < 1 || t > 255 {
+		return 0, fmt.Errorf("invalid data type %q", packettype)
+	}
+	return uint8(t), nil
+}
+
+// parse a retention setting: a data type (or "default") and a
+// duration
+func parseRetention(packettype string, ttl string) (uint8, time.Duration, error) {
+	t, err := parseType(packettype)
+	if err != nil {
+		return 0, 0, err
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t, d, nil
+}
+
+// split a list of settings like "default=10m,158=1h" and call a
+// handler for each of them
+func parseTypeSettings(list string, handler func(packettype string, value string) error) error {
+	for _, setting := range strings.Split(list, ",") {
+		if setting == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid setting %q", setting)
+		}
+		if err := handler(kv[0], kv[1]); err != nil {
+			return fmt.Errorf("invalid setting %q: %v", setting, err)
+		}
+	}
+	return nil
+}
+
+// read retention settings from a file, one "<type> <duration>" pair
+// per line. Empty lines and lines starting with "#" are ignored.
+func readRetentionFile(filename string, server *alfred.Server) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%v:%d: expected <type> <duration>", filename, line)
+		}
+		t, ttl, err := parseRetention(fields[0], fields[1])
+		if err != nil {
+			return fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		server.SetRetention(t, ttl)
+	}
+	return scanner.Err()
+}
+
+// parse a stream listener policy, an empty one allows everything
+func parsePolicy(description string) (*alfred.StreamPolicy, error) {
+	if description == "" {
+		return nil, nil
+	}
+	return alfred.ParseStreamPolicy(description)
+}
+
 func main() {
 	modePtr := flag.String(
 		"m",
@@ -17,7 +104,11 @@ func main() {
 	ifacePtr := flag.String(
 		"i",
 		"bat0",
-		"interface to listen on")
+		"interface(s) to listen on, separated by commas")
+	batifPtr := flag.String(
+		"b",
+		"",
+		"batman-adv interface (only reported in status information)")
 	tcpaddrPtr := flag.String(
 		"t",
 		"",
@@ -30,6 +121,102 @@ func main() {
 		"a",
 		"[ff02::1]:16962",
 		"address/port to listen on for UDP requests")
+	peerAddrPtr := flag.String(
+		"pa",
+		"",
+		"local address/port to listen on for UDP packets from static peer masters")
+	peersPtr := flag.String(
+		"p",
+		"",
+		"static peer masters (address/port) to reach via unicast, separated by commas, requires -pa")
+	tqSourcePtr := flag.String(
+		"tq",
+		"",
+		"choose master by batman-adv TQ, reading originators via \"batctl\" (for the -b interface) or from the given debugfs directory, e.g. /sys/kernel/debug/batman_adv/bat0")
+	metricsPtr := flag.String(
+		"metrics",
+		"",
+		"address/port to serve metrics via HTTP on, leave empty to disable")
+	adminPtr := flag.String(
+		"admin",
+		"",
+		"address/port to serve the read-only admin API via HTTP on, leave empty to disable")
+	storePtr := flag.String(
+		"s",
+		"",
+		"keep a snapshot of the data store in this file across restarts")
+	storeIntervalPtr := flag.Duration(
+		"si",
+		time.Minute,
+		"interval for writing the data store snapshot")
+	ttlPtr := flag.String(
+		"ttl",
+		"",
+		"retention times by data type, e.g. \"default=10m,158=1h,159=2m\"")
+	ttlConfigPtr := flag.String(
+		"ttlconfig",
+		"",
+		"read retention times from this file, one \"<type> <duration>\" per line")
+	maxSourceBytesPtr := flag.Int(
+		"maxsourcebytes",
+		0,
+		"maximum payload bytes stored per remote source, 0 for no limit")
+	maxSourceTypesPtr := flag.Int(
+		"maxsourcetypes",
+		0,
+		"maximum number of data types stored per remote source, 0 for no limit")
+	maxPayloadPtr := flag.String(
+		"maxpayload",
+		"",
+		"maximum payload bytes of remote data by data type, e.g. \"default=4096,158=16384\"")
+	maxTxPtr := flag.Int(
+		"maxtx",
+		1024,
+		"maximum number of open transactions started by other hosts, 0 for no limit")
+	maxTxSourcePtr := flag.Int(
+		"maxtxsource",
+		64,
+		"maximum number of open transactions per remote host, 0 for no limit")
+	maxTxBytesPtr := flag.Int(
+		"maxtxbytes",
+		16*1024*1024,
+		"maximum data bytes buffered per transaction of another host, 0 for no limit")
+	validatePtr := flag.Bool(
+		"validate",
+		false,
+		"reject malformed Gluon nodeinfo/statistics (158/159) and vis (1) data")
+	tcpPolicyPtr := flag.String(
+		"tpolicy",
+		"",
+		"access policy for the TCP listener, e.g. \"read; push net=10.0.0.0/8\", leave empty to allow everything")
+	unixPolicyPtr := flag.String(
+		"upolicy",
+		"",
+		"access policy for the unix socket, e.g. \"read; all uid=0\", leave empty to allow everything")
+	tlsaddrPtr := flag.String(
+		"tls",
+		"",
+		"address/port to listen on for TLS secured TCP requests")
+	tlsCertPtr := flag.String(
+		"tlscert",
+		"",
+		"certificate file (PEM) for the TLS listener")
+	tlsKeyPtr := flag.String(
+		"tlskey",
+		"",
+		"key file (PEM) for the TLS listener")
+	tlsClientCAPtr := flag.String(
+		"tlsclientca",
+		"",
+		"require TLS clients to present a certificate signed by a CA from this file (PEM)")
+	tlsPolicyPtr := flag.String(
+		"tlspolicy",
+		"",
+		"access policy for the TLS listener, leave empty to allow everything")
+	syncSecretPtr := flag.String(
+		"syncsecret",
+		"",
+		"file containing a shared secret for signing the synchronization with other servers")
 	flag.Parse()
 
 	var mode int
@@ -44,22 +231,152 @@ func main() {
 		log.Fatalf("invalid mode specified")
 	}
 
-	server := alfred.NewServer(mode)
+	var secret []byte
+	if *syncSecretPtr != "" {
+		var err error
+		secret, err = ioutil.ReadFile(*syncSecretPtr)
+		if err != nil {
+			log.Fatalf("error reading shared secret: %v", err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			log.Fatalf("shared secret in %v is empty", *syncSecretPtr)
+		}
+	}
+
+	var storeErr error
+	server := alfred.NewServerConfig(mode, func(s *alfred.Server) {
+		s.BatInterface = *batifPtr
+		s.SyncSecret = secret
+		if *ttlConfigPtr != "" {
+			if err := readRetentionFile(*ttlConfigPtr, s); err != nil {
+				log.Fatalf("error reading retention times: %v", err)
+			}
+		}
+		err := parseTypeSettings(*ttlPtr, func(packettype string, value string) error {
+			t, ttl, err := parseRetention(packettype, value)
+			if err == nil {
+				s.SetRetention(t, ttl)
+			}
+			return err
+		})
+		if err != nil {
+			log.Fatalf("error in retention times: %v", err)
+		}
+		limits := alfred.StoreLimits{
+			MaxBytesPerSource: *maxSourceBytesPtr,
+			MaxTypesPerSource: *maxSourceTypesPtr,
+			MaxPayload:        make(map[uint8]int),
+		}
+		err = parseTypeSettings(*maxPayloadPtr, func(packettype string, value string) error {
+			t, err := parseType(packettype)
+			if err != nil {
+				return err
+			}
+			limits.MaxPayload[t], err = strconv.Atoi(value)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("error in payload limits: %v", err)
+		}
+		s.SetLimits(limits)
+		s.TransactionLimits = alfred.TransactionLimits{
+			MaxOpen:          *maxTxPtr,
+			MaxOpenPerSource: *maxTxSourcePtr,
+			MaxBytes:         *maxTxBytesPtr,
+		}
+		if *validatePtr {
+			gluon.AddValidators(s)
+			batadvvis.AddValidators(s)
+		}
+		switch *tqSourcePtr {
+		case "":
+		case "batctl":
+			batif := *batifPtr
+			if batif == "" {
+				batif = "bat0"
+			}
+			s.MasterSelection = &alfred.TQMasterSelection{
+				Source: alfred.NewBatctlOriginatorSource(batif)}
+		default:
+			s.MasterSelection = &alfred.TQMasterSelection{
+				Source: alfred.NewDebugfsOriginatorSource(*tqSourcePtr)}
+		}
+		if *storePtr != "" {
+			storeErr = s.PersistStore(*storePtr, *storeIntervalPtr)
+		}
+	})
+	if storeErr != nil {
+		log.Fatalf("error loading data store snapshot from %v: %v", *storePtr, storeErr)
+	}
 	if *tcpaddrPtr != "" {
-		err := server.NewListenerStream("tcp", *tcpaddrPtr)
+		policy, err := parsePolicy(*tcpPolicyPtr)
+		if err != nil {
+			log.Fatalf("error in TCP listener policy: %v", err)
+		}
+		err = server.NewListenerStreamPolicy("tcp", *tcpaddrPtr, policy)
 		if err != nil {
 			log.Fatalf("error listening on TCP address %v: %v", *tcpaddrPtr, err)
 		}
 	}
+	if *tlsaddrPtr != "" {
+		config, err := alfred.NewServerTLSConfig(*tlsCertPtr, *tlsKeyPtr, *tlsClientCAPtr)
+		if err != nil {
+			log.Fatalf("error in TLS configuration: %v", err)
+		}
+		policy, err := parsePolicy(*tlsPolicyPtr)
+		if err != nil {
+			log.Fatalf("error in TLS listener policy: %v", err)
+		}
+		err = server.NewListenerStreamTLS(*tlsaddrPtr, config, policy)
+		if err != nil {
+			log.Fatalf("error listening on TLS address %v: %v", *tlsaddrPtr, err)
+		}
+	}
+	if *metricsPtr != "" {
+		err := server.NewListenerMetrics(*metricsPtr)
+		if err != nil {
+			log.Fatalf("error listening on metrics address %v: %v", *metricsPtr, err)
+		}
+	}
+	if *adminPtr != "" {
+		err := server.NewListenerAdmin(*adminPtr)
+		if err != nil {
+			log.Fatalf("error listening on admin address %v: %v", *adminPtr, err)
+		}
+	}
 	if *unixaddrPtr != "" {
-		err := server.NewListenerStream("unix", *unixaddrPtr)
+		policy, err := parsePolicy(*unixPolicyPtr)
+		if err != nil {
+			log.Fatalf("error in unix socket policy: %v", err)
+		}
+		err = server.NewListenerStreamPolicy("unix", *unixaddrPtr, policy)
 		if err != nil {
 			log.Fatalf("error listening on Unix socket %v: %v", *unixaddrPtr, err)
 		}
 	}
-	err := server.NewListenerUDP(*addrPtr, *ifacePtr)
-	if err != nil {
-		log.Fatalf("error listening on interface %v, address %v: %v", *ifacePtr, *addrPtr, err)
+	for _, iface := range strings.Split(*ifacePtr, ",") {
+		if iface == "" {
+			continue
+		}
+		err := server.NewListenerUDP(*addrPtr, iface)
+		if err != nil {
+			log.Fatalf("error listening on interface %v, address %v: %v", iface, *addrPtr, err)
+		}
+	}
+	if *peerAddrPtr != "" {
+		peers := make([]string, 0)
+		for _, peer := range strings.Split(*peersPtr, ",") {
+			if peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		err := server.NewListenerPeersUDP(*peerAddrPtr, peers)
+		if err != nil {
+			log.Fatalf("error listening for static peers on %v: %v", *peerAddrPtr, err)
+		}
+	} else if *peersPtr != "" {
+		log.Fatalf("static peers need a local address to listen on (-pa)")
 	}
 	log.Printf("now running!")
 	c := make(chan os.Signal, 1)
@@ -29,11 +29,23 @@ var retryWaitPtr = flag.Duration(
 var clientNetworkPtr = flag.String(
 	"clientnetwork",
 	"unix",
-	"use this type of socket (unix, tcp)")
+	"use this type of socket (unix, tcp, tls)")
 var clientAddressPtr = flag.String(
 	"clientaddress",
 	"/var/run/alfred.sock",
 	"use this socket address (e.g. unix domain socket, \"host:port\")")
+var clientTLSCAPtr = flag.String(
+	"clienttlsca",
+	"",
+	"verify the alfred server's TLS certificate against CAs from this file (PEM)")
+var clientTLSCertPtr = flag.String(
+	"clienttlscert",
+	"",
+	"present this TLS client certificate (PEM) to the alfred server")
+var clientTLSKeyPtr = flag.String(
+	"clienttlskey",
+	"",
+	"key file (PEM) for the TLS client certificate")
 var httpdStaticPtr = flag.String(
 	"staticroot",
 	"/opt/meshviewer/build",
@@ -101,7 +113,16 @@ func main() {
 		}
 	}
 
-	client := alfred.NewClient(*clientNetworkPtr, *clientAddressPtr, nil)
+	var client *alfred.Client
+	if *clientNetworkPtr == "tls" {
+		config, err := alfred.NewClientTLSConfig(*clientTLSCAPtr, *clientTLSCertPtr, *clientTLSKeyPtr)
+		if err != nil {
+			log.Fatalf("Error in TLS configuration: %v", err)
+		}
+		client = alfred.NewTLSClient(*clientAddressPtr, config, nil)
+	} else {
+		client = alfred.NewClient(*clientNetworkPtr, *clientAddressPtr, nil)
+	}
 	db.StartUpdater(client, *updateWaitPtr, *retryWaitPtr)
 	db.StartPurger(*gluonPurgeIntPtr, *batAdvVisPurgeIntPtr)
 	db.StartLogger(*nodeOfflineDuration)
@@ -8,12 +8,22 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/hwhw/mesh/alfred"
+	"io"
+	"io/ioutil"
 )
 
 var ErrParse = errors.New("parse error")
 
+// maximum size of uncompressed JSON data, to not fall for data that
+// inflates to huge amounts
+const MaxUncompressed = 1024 * 1024
+
+var ErrTooLarge = errors.New("uncompressed data too large")
+
 // convenience function that will compare packet type and version
-// and also care for proper unzipping and deserializing JSON data
+// and also care for proper unzipping and deserializing JSON data.
+// The whole gzip stream including its checksum must be valid and
+// contain exactly one JSON value.
 func readJSON(data alfred.Data, packetType uint8, packetVersion uint8, v interface{}) error {
 	if data.Header.Type != packetType {
 		return ErrParse
@@ -25,10 +35,12 @@ func readJSON(data alfred.Data, packetType uint8, packetVersion uint8, v interfa
 	if err != nil {
 		return err
 	}
-	dec := json.NewDecoder(unzip)
-	err = dec.Decode(v)
+	j, err := ioutil.ReadAll(io.LimitReader(unzip, MaxUncompressed+1))
 	if err != nil {
 		return err
 	}
-	return nil
+	if len(j) > MaxUncompressed {
+		return ErrTooLarge
+	}
+	return json.Unmarshal(j, v)
 }
@@ -12,6 +12,10 @@ const (
 	NODEINFO_PACKETVERSION = 0
 )
 
+func init() {
+	alfred.RegisterContent(NODEINFO_PACKETTYPE, NODEINFO_PACKETVERSION, func() alfred.Content { return &NodeInfo{} })
+}
+
 // wrapper type for storing the metadata and its origin
 type NodeInfo struct {
 	Source alfred.HardwareAddr
@@ -11,6 +11,10 @@ const (
 	STATISTICS_PACKETVERSION = 0
 )
 
+func init() {
+	alfred.RegisterContent(STATISTICS_PACKETTYPE, STATISTICS_PACKETVERSION, func() alfred.Content { return &Statistics{} })
+}
+
 // wrapper type for storing the statistics data and its origin
 type Statistics struct {
 	Source alfred.HardwareAddr
@@ -0,0 +1,51 @@
+package gluon
+
+import (
+	"errors"
+	"github.com/hwhw/mesh/alfred"
+)
+
+var ErrNoNodeID = errors.New("data without node ID")
+
+// Ingest hook for the A.L.F.R.E.D. server that rejects NodeInfo and
+// Statistics data which is not gzip-compressed JSON of the expected
+// structure, or which lacks the node ID. Data of other packet
+// versions is passed on unchecked.
+// NodeInfo data is annotated with the node's hostname.
+func Validate(d *alfred.IngestData) error {
+	switch d.Header.Type {
+	case NODEINFO_PACKETTYPE:
+		if d.Header.Version != NODEINFO_PACKETVERSION {
+			return nil
+		}
+		ni := NodeInfoData{}
+		if err := readJSON(d.Data, NODEINFO_PACKETTYPE, NODEINFO_PACKETVERSION, &ni); err != nil {
+			return err
+		}
+		if ni.NodeID == "" {
+			return ErrNoNodeID
+		}
+		if ni.Hostname != "" {
+			d.Annotate("hostname", ni.Hostname)
+		}
+	case STATISTICS_PACKETTYPE:
+		if d.Header.Version != STATISTICS_PACKETVERSION {
+			return nil
+		}
+		stat := StatisticsData{}
+		if err := readJSON(d.Data, STATISTICS_PACKETTYPE, STATISTICS_PACKETVERSION, &stat); err != nil {
+			return err
+		}
+		if stat.NodeID == "" {
+			return ErrNoNodeID
+		}
+	}
+	return nil
+}
+
+// install Validate for NodeInfo and Statistics data on a server
+func AddValidators(s *alfred.Server) {
+	hook := alfred.IngestHookFunc(Validate)
+	s.AddIngestHook(NODEINFO_PACKETTYPE, hook)
+	s.AddIngestHook(STATISTICS_PACKETTYPE, hook)
+}
@@ -0,0 +1,66 @@
+package gluon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/hwhw/mesh/alfred"
+	"testing"
+)
+
+func gzipped(s string) []byte {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func ingestData(packettype uint8, version uint8, payload []byte) *alfred.IngestData {
+	return &alfred.IngestData{Data: alfred.Data{
+		Source: alfred.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		Header: &alfred.TLV{Type: packettype, Version: version, Length: uint16(len(payload))},
+		Data:   payload,
+	}}
+}
+
+func TestValidate(t *testing.T) {
+	valid := gzipped(`{"node_id":"020000000001","hostname":"node"}`)
+	truncated := valid[:len(valid)-4]
+	tests := []struct {
+		name    string
+		ptype   uint8
+		payload []byte
+		ok      bool
+	}{
+		{"nodeinfo", NODEINFO_PACKETTYPE, valid, true},
+		{"statistics", STATISTICS_PACKETTYPE, gzipped(`{"node_id":"020000000001"}`), true},
+		{"null", NODEINFO_PACKETTYPE, gzipped(`null`), false},
+		{"empty object", NODEINFO_PACKETTYPE, gzipped(`{}`), false},
+		{"statistics without node id", STATISTICS_PACKETTYPE, gzipped(`{"uptime":1}`), false},
+		{"not compressed", NODEINFO_PACKETTYPE, []byte(`{"node_id":"020000000001"}`), false},
+		{"truncated gzip", NODEINFO_PACKETTYPE, truncated, false},
+		{"trailing data", NODEINFO_PACKETTYPE, gzipped(`{"node_id":"020000000001"} {}`), false},
+		{"too large", NODEINFO_PACKETTYPE, gzipped(`{"node_id":"020000000001","hostname":"` + string(bytes.Repeat([]byte{'x'}, MaxUncompressed)) + `"}`), false},
+	}
+	for _, test := range tests {
+		version := uint8(NODEINFO_PACKETVERSION)
+		if test.ptype == STATISTICS_PACKETTYPE {
+			version = STATISTICS_PACKETVERSION
+		}
+		d := ingestData(test.ptype, version, test.payload)
+		err := Validate(d)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+	d := ingestData(NODEINFO_PACKETTYPE, NODEINFO_PACKETVERSION, valid)
+	if Validate(d); d.Annotations["hostname"] != "node" {
+		t.Errorf("annotations %v", d.Annotations)
+	}
+	// other versions are not checked
+	if err := Validate(ingestData(NODEINFO_PACKETTYPE, NODEINFO_PACKETVERSION+1, []byte("x"))); err != nil {
+		t.Errorf("other version: %v", err)
+	}
+}
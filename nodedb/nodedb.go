@@ -87,13 +87,18 @@ func (db *NodeDB) StopLogger() {
 	db.NotifyQuitLogger.Broadcast <- struct{}{}
 }
 
+// start an update client for each data type registered with the alfred
+// package that the database knows how to store
 func (db *NodeDB) StartUpdater(client *alfred.Client, updatewait, retrywait time.Duration) {
-	i := &NodeInfo{}
-	go client.Updater(i, updatewait, retrywait, db.NotifyQuitUpdater, db.NotifyUpdateNodeInfo, db.updateNodeInfo(i, false))
-	s := &Statistics{}
-	go client.Updater(s, updatewait, retrywait, db.NotifyQuitUpdater, db.NotifyUpdateStatistics, db.updateStatistics(s))
-	v := &VisData{}
-	go client.Updater(v, updatewait, retrywait, db.NotifyQuitUpdater, db.NotifyUpdateVis, db.updateVisData(v))
+	for _, t := range alfred.RegisteredContent() {
+		factory, _ := alfred.LookupContent(t.Type, t.Version)
+		content := factory()
+		handler, notify := db.contentUpdater(content)
+		if handler == nil {
+			continue
+		}
+		go client.Updater(content, updatewait, retrywait, db.NotifyQuitUpdater, notify, handler)
+	}
 }
 
 func (db *NodeDB) StopUpdater() {
@@ -2,9 +2,43 @@ package nodedb
 
 import (
 	"github.com/boltdb/bolt"
+	"github.com/hwhw/mesh/alfred"
+	"github.com/hwhw/mesh/batadvvis"
+	"github.com/hwhw/mesh/gluon"
 	"github.com/hwhw/mesh/store"
+	"github.com/tv42/topic"
 )
 
+// return the update handler for data read into a Content item and the
+// topic to notify after successful updates. The handler is nil for
+// content the database does not store.
+func (db *NodeDB) contentUpdater(content alfred.Content) (func() error, *topic.Topic) {
+	switch c := content.(type) {
+	case *gluon.NodeInfo:
+		i := &NodeInfo{}
+		update := db.updateNodeInfo(i, false)
+		return func() error {
+			i.NodeInfo = *c
+			return update()
+		}, db.NotifyUpdateNodeInfo
+	case *gluon.Statistics:
+		s := &Statistics{}
+		update := db.updateStatistics(s)
+		return func() error {
+			s.Statistics = *c
+			return update()
+		}, db.NotifyUpdateStatistics
+	case *batadvvis.VisV1:
+		v := &VisData{}
+		update := db.updateVisData(v)
+		return func() error {
+			v.VisV1 = *c
+			return update()
+		}, db.NotifyUpdateVis
+	}
+	return nil, nil
+}
+
 func (db *NodeDB) updateNodeInfo(i *NodeInfo, persistent bool) func() error {
 	return func() error {
 		db.Main.Batch(func(tx *bolt.Tx) error {